@@ -0,0 +1,183 @@
+package cleaner
+
+import (
+	"bytes"
+	"clean_sw_dirty/ydmeta"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	tikverr "github.com/tikv/client-go/v2/error"
+)
+
+// The actions recorded in the audit trail.
+const (
+	AuditDelete     = "delete"
+	AuditQuarantine = "quarantine"
+	AuditPurge      = "purge"
+	AuditRelease    = "release"
+	AuditAbort      = "abort"
+	AuditMigrate    = ydmeta.AuditMigrate
+)
+
+// SetAuditLog makes execute mode append every audit entry to w as well as
+// to TiKV, one JSON object per line.
+func (c *Cleaner) SetAuditLog(w io.Writer) {
+	c.auditLog = w
+}
+
+// newRun names the destructive actions of a scan, purge or release started
+// at start in the audit trail.
+func (c *Cleaner) newRun(start time.Time) string {
+	c.runID = fmt.Sprintf("%s-%d", c.owner, start.UnixNano())
+	atomic.StoreInt64(&c.auditSeq, 0)
+	return c.runID
+}
+
+// audit records entries before their actions are taken, so that no action
+// goes unrecorded. An entry may thus record an action that then failed, in
+// which case its record is still there and a later run retries it.
+func (c *Cleaner) audit(ctx context.Context, entries ...*ydmeta.AuditEntry) error {
+	now := time.Now()
+	for _, e := range entries {
+		e.Time = now
+		e.RunID = c.runID
+		e.Seq = atomic.AddInt64(&c.auditSeq, 1)
+	}
+	err := c.throttle.tikvTxn(ctx, func() error {
+		return c.om.AppendAudit(entries...)
+	})
+	if err != nil {
+		return fmt.Errorf("write audit entries: %w", err)
+	}
+	if c.auditLog == nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range entries {
+		if err = enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	if _, err = c.auditLog.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("write audit log: %w", err)
+	}
+	return nil
+}
+
+// partAuditEntry is the audit entry of an action on the part at key.
+func partAuditEntry(action string, reason string, key string, value []byte,
+	fids []ydmeta.FileIdInfo) *ydmeta.AuditEntry {
+	e := &ydmeta.AuditEntry{
+		Action: action,
+		Key:    []byte(key),
+		Value:  value,
+		Fids:   fileIds(fids),
+		Reason: reason,
+	}
+	if pk, ok := ydmeta.ParsePartKey(key); ok {
+		e.Bucket, e.UploadID = pk.Bucket, pk.UploadID
+	} else if _, pk, ok := ydmeta.ParseDeletedPartKey(key); ok {
+		e.Bucket, e.UploadID = pk.Bucket, pk.UploadID
+	}
+	return e
+}
+
+func fileIds(fids []ydmeta.FileIdInfo) []string {
+	if len(fids) == 0 {
+		return nil
+	}
+	ids := make([]string, 0, len(fids))
+	for _, fid := range fids {
+		ids = append(ids, fid.FileId)
+	}
+	return ids
+}
+
+// AuditQuery selects audit entries. The zero value selects all.
+type AuditQuery struct {
+	Bucket string
+	// Object also selects the entries of the uploads the object, or one of
+	// its recorded versions, was completed from.
+	Object   string
+	UploadID string
+	RunID    string
+	Since    time.Time
+}
+
+func (q AuditQuery) match(e *ydmeta.AuditEntry, uploads map[string]struct{}) bool {
+	if q.Bucket != "" && e.Bucket != q.Bucket {
+		return false
+	}
+	if q.RunID != "" && e.RunID != q.RunID {
+		return false
+	}
+	if q.UploadID != "" && e.UploadID != q.UploadID {
+		return false
+	}
+	if q.Object == "" || e.Object == q.Object {
+		return true
+	}
+	_, ok := uploads[e.UploadID]
+	return ok && e.UploadID != ""
+}
+
+// QueryAudit calls fn for each audit entry q selects, oldest first.
+func (c *Cleaner) QueryAudit(ctx context.Context, q AuditQuery, fn func(*ydmeta.AuditEntry) error) error {
+	uploads := make(map[string]struct{})
+	if q.Object != "" {
+		ob, err := c.om.GetObject(q.Bucket, q.Object)
+		if err != nil && !errors.Is(err, tikverr.ErrNotExist) {
+			return err
+		}
+		if ob != nil && ob.UploadID != "" {
+			uploads[ob.UploadID] = struct{}{}
+		}
+		err = c.iterAudit(ctx, q.Since, func(e *ydmeta.AuditEntry) error {
+			if e.Object != q.Object || (q.Bucket != "" && e.Bucket != q.Bucket) {
+				return nil
+			}
+			version := &ydmeta.ObjectInfo{}
+			if ydmeta.DecodeValue(e.Value, version) == nil && version.UploadID != "" {
+				uploads[version.UploadID] = struct{}{}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return c.iterAudit(ctx, q.Since, func(e *ydmeta.AuditEntry) error {
+		if !q.match(e, uploads) {
+			return nil
+		}
+		return fn(e)
+	})
+}
+
+func (c *Cleaner) iterAudit(ctx context.Context, since time.Time, fn func(*ydmeta.AuditEntry) error) error {
+	iter, err := c.om.ListAuditByIter(since)
+	if err != nil {
+		return err
+	}
+	cur := iter.Cursor()
+	defer cur.Close()
+	for c.throttle.scanRead(cur.Next) {
+		if err = c.throttle.scanKey(ctx); err != nil {
+			return err
+		}
+		item := cur.Item()
+		if item.Err != nil {
+			return fmt.Errorf("audit entry: %w", item.Err)
+		}
+		if err = fn(item.Entry); err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
@@ -0,0 +1,41 @@
+package cleaner
+
+import (
+	"clean_sw_dirty/ydmeta"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPartAuditEntry(t *testing.T) {
+	part := ydmeta.PartKey{Bucket: "b", UploadID: "u", PartNumber: 2}
+	fids := []ydmeta.FileIdInfo{{FileId: "3,01"}, {FileId: "3,02"}}
+	e := partAuditEntry(AuditDelete, reasonOrphanedPart, part.String(), []byte(`{}`), fids)
+	require.Equal(t, "b", e.Bucket)
+	require.Equal(t, "u", e.UploadID)
+	require.Equal(t, []byte(part.String()), e.Key)
+	require.Equal(t, []string{"3,01", "3,02"}, e.Fids)
+
+	e = partAuditEntry(AuditQuarantine, reasonOrphanedPart, part.String(), nil, nil)
+	require.Nil(t, e.Fids)
+}
+
+func TestAuditQuery(t *testing.T) {
+	object := &ydmeta.AuditEntry{Bucket: "b", Object: "o", RunID: "r1"}
+	part := &ydmeta.AuditEntry{Bucket: "b", UploadID: "u", RunID: "r2"}
+	other := &ydmeta.AuditEntry{Bucket: "b", UploadID: "v", RunID: "r2"}
+	uploads := map[string]struct{}{"u": {}}
+
+	q := AuditQuery{Bucket: "b", Object: "o"}
+	require.True(t, q.match(object, uploads))
+	require.True(t, q.match(part, uploads))
+	require.False(t, q.match(other, uploads))
+	require.False(t, q.match(part, nil))
+
+	require.True(t, AuditQuery{}.match(other, nil))
+	require.False(t, AuditQuery{Bucket: "c"}.match(object, nil))
+	require.True(t, AuditQuery{UploadID: "v"}.match(other, nil))
+	require.False(t, AuditQuery{UploadID: "v"}.match(part, nil))
+	require.True(t, AuditQuery{RunID: "r2"}.match(part, nil))
+	require.False(t, AuditQuery{RunID: "r2"}.match(object, nil))
+}
@@ -0,0 +1,808 @@
+package cleaner
+
+import (
+	"clean_sw_dirty/ydmeta"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	PhaseIdle       = "idle"
+	PhaseObjects    = "objects"
+	PhaseDeleted    = "deleted-objects"
+	PhaseMultiparts = "multiparts"
+
+	// LeaseName is the TiKV lease that guards execute mode.
+	LeaseName = "cleaner"
+
+	defaultLeaseTTL  = 30 * time.Second
+	defaultBatchSize = 100
+
+	// DefaultGracePeriod is how long a part is taken to belong to an upload
+	// in progress after it was written, whether or not its upload record is
+	// seen.
+	DefaultGracePeriod = 24 * time.Hour
+)
+
+// FidDeleter removes file data from SeaweedFS.
+type FidDeleter interface {
+	DeleteFid(ctx context.Context, fid string) error
+}
+
+// Cleaner finds multipart data that is referenced by neither a live nor a
+// deleted large object, and the data of objects deleted for longer than the
+// retention, and deletes them in execute mode.
+type Cleaner struct {
+	bm *ydmeta.BucketMetaManager
+	om *ydmeta.ObjectMetaManager
+
+	execute     bool
+	swfs        FidDeleter
+	owner       string
+	leaseTTL    time.Duration
+	batchSize   int
+	concurrency int
+	gracePeriod time.Duration
+	scope       scope
+	throttle    *Throttle
+
+	staleUploadAge   time.Duration
+	abortAfter       time.Duration
+	deletedRetention time.Duration
+	quarantineWindow time.Duration
+
+	auditLog io.Writer
+	runID    string
+	auditSeq int64
+
+	protectedBuckets map[string]struct{}
+	// protected holds the buckets protected during the current run
+	protected map[string]struct{}
+	// scoped holds the buckets in scope during the current run, when the
+	// scope is restricted
+	scoped map[string]struct{}
+
+	progress progress
+}
+
+func NewCleaner(bm *ydmeta.BucketMetaManager, om *ydmeta.ObjectMetaManager) *Cleaner {
+	return &Cleaner{
+		bm:          bm,
+		om:          om,
+		leaseTTL:    defaultLeaseTTL,
+		batchSize:   defaultBatchSize,
+		concurrency: 1,
+		gracePeriod: DefaultGracePeriod,
+
+		staleUploadAge:   DefaultStaleUploadAge,
+		deletedRetention: DefaultDeletedObjectRetention,
+		quarantineWindow: DefaultQuarantineWindow,
+	}
+}
+
+// EnableExecute makes Scan delete the orphans it finds. A scan in execute
+// mode first takes the cleaner lease as owner and only deletes while it
+// still holds it, so concurrent instances never delete at the same time.
+func (c *Cleaner) EnableExecute(swfs FidDeleter, owner string) {
+	c.execute = true
+	c.swfs = swfs
+	c.owner = owner
+}
+
+// SetThrottle limits the load of subsequent scans. The throttle may be
+// adjusted while a scan is running.
+func (c *Cleaner) SetThrottle(t *Throttle) {
+	c.throttle = t
+}
+
+// SetConcurrency sets how many orphans are deleted from SeaweedFS in
+// parallel.
+func (c *Cleaner) SetConcurrency(n int) {
+	if n < 1 {
+		n = 1
+	}
+	c.concurrency = n
+}
+
+// SetGracePeriod makes the scan leave alone the parts written within d
+// before it started, as parts of uploads that may still be in progress. It
+// covers the uploads whose record the scan does not see, such as the ones
+// still being initiated. Zero only relies on the upload records.
+func (c *Cleaner) SetGracePeriod(d time.Duration) {
+	c.gracePeriod = d
+}
+
+// SetScope limits the scan to the buckets in include, or all buckets when
+// include is empty, minus the ones in exclude. Both hold names or
+// path.Match patterns.
+func (c *Cleaner) SetScope(include []string, exclude []string) {
+	types := c.scope.types
+	c.scope = newScope(include, exclude)
+	c.scope.types = types
+}
+
+// SetBucketTypes further limits the scan to the buckets of the types, such
+// as seaweedfs, or all types when types is empty.
+func (c *Cleaner) SetBucketTypes(types []string) {
+	c.scope.types = nil
+	if len(types) > 0 {
+		c.scope.types = make(map[string]struct{}, len(types))
+		for _, t := range types {
+			c.scope.types[t] = struct{}{}
+		}
+	}
+}
+
+type scope struct {
+	include []string
+	exclude []string
+	types   map[string]struct{}
+}
+
+func newScope(include []string, exclude []string) scope {
+	return scope{
+		include: append([]string(nil), include...),
+		exclude: append([]string(nil), exclude...),
+	}
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// contains tells whether the scope includes the bucket called name, going
+// by its name only.
+func (s scope) contains(name string) bool {
+	if matchAny(s.exclude, name) {
+		return false
+	}
+	return len(s.include) == 0 || matchAny(s.include, name)
+}
+
+func (s scope) containsBucket(b *ydmeta.BucketInfo) bool {
+	if !s.contains(b.Name) {
+		return false
+	}
+	if s.types == nil {
+		return true
+	}
+	_, ok := s.types[b.Type]
+	return ok
+}
+
+// restricted tells whether the scope selects some buckets rather than all
+// but some. A restricted scan only reads the records of the buckets in
+// scope, and only the ones that exist when it starts.
+func (s scope) restricted() bool {
+	return len(s.include) > 0 || s.types != nil
+}
+
+// loadBuckets reads which buckets are in scope and which are protected for
+// the run about to start.
+func (c *Cleaner) loadBuckets() error {
+	buckets, err := c.bm.ListBuckets()
+	if err != nil {
+		return err
+	}
+	c.setBuckets(buckets)
+	return nil
+}
+
+func (c *Cleaner) setBuckets(buckets []*ydmeta.BucketInfo) {
+	c.protected = protectedBuckets(c.protectedBuckets, buckets)
+	c.scoped = nil
+	if c.scope.restricted() {
+		c.scoped = make(map[string]struct{})
+		for _, b := range buckets {
+			if c.scope.containsBucket(b) {
+				c.scoped[b.Name] = struct{}{}
+			}
+		}
+	}
+}
+
+// inScope tells whether the current run cleans the bucket called name.
+func (c *Cleaner) inScope(name string) bool {
+	if !c.scope.restricted() {
+		return c.scope.contains(name)
+	}
+	_, ok := c.scoped[name]
+	return ok
+}
+
+// scopedBuckets returns the names of the buckets a restricted run cleans.
+func (c *Cleaner) scopedBuckets() []string {
+	names := make([]string, 0, len(c.scoped))
+	for b := range c.scoped {
+		names = append(names, b)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type orphan struct {
+	key   string
+	value []byte
+	meta  *ydmeta.MultipartPartMetaV1
+}
+
+// Progress is a snapshot of the counters of the running scan.
+type Progress struct {
+	Running           bool      `json:"running"`
+	Phase             string    `json:"phase"`
+	StartTime         time.Time `json:"startTime"`
+	BucketsScanned    int64     `json:"bucketsScanned"`
+	ObjectsScanned    int64     `json:"objectsScanned"`
+	DeletedScanned    int64     `json:"deletedScanned"`
+	MultipartsScanned int64     `json:"multipartsScanned"`
+	UploadsScanned    int64     `json:"uploadsScanned"`
+	OrphanCount       int64     `json:"orphanCount"`
+	OrphanSize        int64     `json:"orphanSize"`
+	ReclaimedCount    int64     `json:"reclaimedCount"`
+	ReclaimedSize     int64     `json:"reclaimedSize"`
+}
+
+type progress struct {
+	running           int32
+	phase             atomic.Value
+	startTime         atomic.Value
+	bucketsScanned    int64
+	objectsScanned    int64
+	deletedScanned    int64
+	multipartsScanned int64
+	uploadsScanned    int64
+	orphanCount       int64
+	orphanSize        int64
+	reclaimedCount    int64
+	reclaimedSize     int64
+}
+
+func (p *progress) reset(start time.Time) {
+	atomic.StoreInt64(&p.bucketsScanned, 0)
+	atomic.StoreInt64(&p.objectsScanned, 0)
+	atomic.StoreInt64(&p.deletedScanned, 0)
+	atomic.StoreInt64(&p.multipartsScanned, 0)
+	atomic.StoreInt64(&p.uploadsScanned, 0)
+	atomic.StoreInt64(&p.orphanCount, 0)
+	atomic.StoreInt64(&p.orphanSize, 0)
+	atomic.StoreInt64(&p.reclaimedCount, 0)
+	atomic.StoreInt64(&p.reclaimedSize, 0)
+	p.startTime.Store(start)
+	p.phase.Store(PhaseIdle)
+}
+
+func (p *progress) snapshot() Progress {
+	s := Progress{
+		Running:           atomic.LoadInt32(&p.running) == 1,
+		Phase:             PhaseIdle,
+		BucketsScanned:    atomic.LoadInt64(&p.bucketsScanned),
+		ObjectsScanned:    atomic.LoadInt64(&p.objectsScanned),
+		DeletedScanned:    atomic.LoadInt64(&p.deletedScanned),
+		MultipartsScanned: atomic.LoadInt64(&p.multipartsScanned),
+		UploadsScanned:    atomic.LoadInt64(&p.uploadsScanned),
+		OrphanCount:       atomic.LoadInt64(&p.orphanCount),
+		OrphanSize:        atomic.LoadInt64(&p.orphanSize),
+		ReclaimedCount:    atomic.LoadInt64(&p.reclaimedCount),
+		ReclaimedSize:     atomic.LoadInt64(&p.reclaimedSize),
+	}
+	if v, ok := p.phase.Load().(string); ok {
+		s.Phase = v
+	}
+	if v, ok := p.startTime.Load().(time.Time); ok {
+		s.StartTime = v
+	}
+	return s
+}
+
+// Progress returns the counters of the current (or last) scan.
+func (c *Cleaner) Progress() Progress {
+	return c.progress.snapshot()
+}
+
+// Scan walks the buckets in scope and reports the multipart data that is no
+// longer referenced. It stops early with ctx.Err() when ctx is canceled.
+func (c *Cleaner) Scan(ctx context.Context) (report *Report, err error) {
+	if !atomic.CompareAndSwapInt32(&c.progress.running, 0, 1) {
+		return nil, ErrScanRunning
+	}
+	defer atomic.StoreInt32(&c.progress.running, 0)
+
+	report = &Report{StartTime: time.Now(), Execute: c.execute}
+	c.progress.reset(report.StartTime)
+	defer func() {
+		c.progress.phase.Store(PhaseIdle)
+		report.finish(err)
+	}()
+
+	var lease *ydmeta.Lease
+	if c.execute {
+		var done func() error
+		lease, ctx, done, err = c.holdLease(ctx)
+		if err != nil {
+			return report, err
+		}
+		report.LeaseToken = lease.Token()
+		report.RunID = c.newRun(report.StartTime)
+		defer func() {
+			if leaseErr := done(); leaseErr != nil {
+				err = leaseErr
+			}
+		}()
+	}
+
+	if err = c.loadBuckets(); err != nil {
+		return report, err
+	}
+
+	// The upload records are collected before the objects are read: a part
+	// without an upload record then belongs to an upload that had already
+	// been completed or aborted, so a completed one is seen by the object
+	// scan. The multipart records are read once more afterwards, so that no
+	// snapshot has to last the whole scan.
+	c.progress.phase.Store(PhaseMultiparts)
+	uploads, err := c.collectUploads(ctx)
+	if err != nil {
+		return report, err
+	}
+
+	validMultipart, err := c.collectValidMultiparts(ctx, lease, report)
+	if err != nil {
+		return report, err
+	}
+
+	mpIter, err := c.listMultiparts()
+	if err != nil {
+		return report, err
+	}
+	mpCur := mpIter.Cursor()
+	defer mpCur.Close()
+
+	c.progress.phase.Store(PhaseMultiparts)
+	var batch []orphan
+	// an upload record sorts before its parts, as it prefixes their keys
+	for c.throttle.scanRead(mpCur.Next) {
+		if err = c.throttle.scanKey(ctx); err != nil {
+			return report, err
+		}
+		atomic.AddInt64(&c.progress.multipartsScanned, 1)
+		report.MultipartsScanned++
+
+		item := mpCur.Item()
+		bucket, name, ok := ydmeta.ParseMultipartKey(item.Key)
+		if !ok || !c.inScope(bucket) {
+			continue
+		}
+		pk, isPart := ydmeta.ParsePartKey(item.Key)
+		if !isPart {
+			uploads[ydmeta.PartKey{Bucket: bucket, UploadID: name}] = struct{}{}
+			continue
+		}
+		// a part that cannot be decoded is left alone: its fids are unknown
+		if item.Err != nil {
+			log.Printf("skip part: %s", item.Err.Error())
+			report.UndecodableSkipped++
+			continue
+		}
+		mp := item.Part
+		if c.inProgress(pk, mp, uploads, report.StartTime) {
+			report.InProgressParts++
+			continue
+		}
+		if _, ok := validMultipart[pk]; ok {
+			continue
+		}
+		if c.isProtected(pk.Bucket) {
+			report.ProtectedSkipped++
+			continue
+		}
+
+		atomic.AddInt64(&c.progress.orphanCount, 1)
+		atomic.AddInt64(&c.progress.orphanSize, mp.Size)
+		report.OrphanCount++
+		report.OrphanSize += mp.Size
+
+		if !c.execute {
+			continue
+		}
+		batch = append(batch, orphan{key: item.Key, value: mpCur.RawValue(), meta: mp})
+		if len(batch) >= c.batchSize {
+			if err = c.reclaimOrphans(ctx, lease, batch, reasonOrphanedPart, report); err != nil {
+				return report, err
+			}
+			batch = batch[:0]
+		}
+	}
+	if err = mpCur.Err(); err != nil {
+		return report, err
+	}
+	if len(batch) > 0 {
+		if err = c.reclaimOrphans(ctx, lease, batch, reasonOrphanedPart, report); err != nil {
+			return report, err
+		}
+	}
+	if err = c.scanDeletedParts(ctx, lease, report); err != nil {
+		return report, err
+	}
+	if err = c.scanUploads(ctx, lease, report); err != nil || !c.execute {
+		return report, err
+	}
+	c.progress.phase.Store(PhaseQuarantine)
+	return report, c.purgeQuarantine(ctx, lease, QuarantineFilter{Before: report.StartTime.Add(-c.quarantineWindow)}, report)
+}
+
+// listMultiparts iterates the upload records and parts of the buckets in
+// scope.
+func (c *Cleaner) listMultiparts() (*ydmeta.MultipartMetaIter, error) {
+	if c.scope.restricted() {
+		return c.om.ListBucketsMultipartByIter(c.scopedBuckets())
+	}
+	return c.om.ListMultipartByIter()
+}
+
+// collectUploads returns the uploads in scope that have a record.
+func (c *Cleaner) collectUploads(ctx context.Context) (map[ydmeta.PartKey]struct{}, error) {
+	iter, err := c.listMultiparts()
+	if err != nil {
+		return nil, err
+	}
+	cur := iter.Cursor()
+	defer cur.Close()
+	uploads := make(map[ydmeta.PartKey]struct{})
+	for c.throttle.scanRead(cur.Next) {
+		if err = c.throttle.scanKey(ctx); err != nil {
+			return nil, err
+		}
+		key := cur.Item().Key
+		bucket, name, ok := ydmeta.ParseMultipartKey(key)
+		if !ok || !c.inScope(bucket) {
+			continue
+		}
+		if _, isPart := ydmeta.ParsePartKey(key); !isPart {
+			uploads[ydmeta.PartKey{Bucket: bucket, UploadID: name}] = struct{}{}
+		}
+	}
+	return uploads, cur.Err()
+}
+
+// inProgress tells whether the part at pk, which the scan started at start
+// found, may belong to an upload in progress: its upload record is in
+// uploads, or it was written since the scan started or within the grace
+// period. A part written since the scan started may belong to an upload
+// that began after the upload records were collected and was completed
+// after the objects were read. Such parts are never orphans.
+func (c *Cleaner) inProgress(pk ydmeta.PartKey, mp *ydmeta.MultipartPartMetaV1,
+	uploads map[ydmeta.PartKey]struct{}, start time.Time) bool {
+	if _, ok := uploads[ydmeta.PartKey{Bucket: pk.Bucket, UploadID: pk.UploadID}]; ok {
+		return true
+	}
+	if mp.ModTime.After(start) {
+		return true
+	}
+	return c.gracePeriod > 0 && mp.ModTime.After(start.Add(-c.gracePeriod))
+}
+
+// holdLease takes the cleaner lease and keeps it alive until done is called.
+// The returned context is canceled when the lease is lost, in which case
+// done returns the error.
+func (c *Cleaner) holdLease(ctx context.Context) (lease *ydmeta.Lease, leaseCtx context.Context,
+	done func() error, err error) {
+	lease, err = c.om.AcquireLease(LeaseName, c.owner, c.leaseTTL)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	leaseCtx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	var leaseErr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if leaseErr = lease.KeepAlive(leaseCtx, c.leaseTTL/3); leaseErr != nil {
+			cancel()
+		}
+	}()
+	done = func() error {
+		cancel()
+		wg.Wait()
+		if releaseErr := lease.Release(); releaseErr != nil {
+			log.Printf("release cleaner lease failed: %s", releaseErr.Error())
+		}
+		if leaseErr != nil {
+			return fmt.Errorf("cleaner lease lost: %w", leaseErr)
+		}
+		return nil
+	}
+	return lease, leaseCtx, done, nil
+}
+
+// reclaimOrphans quarantines the orphans for reason, or deletes them when
+// there is no quarantine window.
+func (c *Cleaner) reclaimOrphans(ctx context.Context, lease *ydmeta.Lease, batch []orphan, reason string,
+	report *Report) error {
+	if c.quarantineWindow > 0 {
+		return c.quarantineOrphans(ctx, lease, batch, reason, report)
+	}
+	return c.deleteOrphans(ctx, lease, batch, reason, report)
+}
+
+// deleteOrphans removes the SeaweedFS data of each orphan and then its
+// multipart key. An orphan whose data could not be removed keeps its key so
+// that the next run retries it. The lease is checked before touching
+// SeaweedFS and again atomically with the key deletion.
+func (c *Cleaner) deleteOrphans(ctx context.Context, lease *ydmeta.Lease, batch []orphan, reason string,
+	report *Report) error {
+	err := c.throttle.tikvTxn(ctx, func() error {
+		return c.om.CheckLease(lease)
+	})
+	if err != nil {
+		return err
+	}
+	entries := make([]*ydmeta.AuditEntry, len(batch))
+	for i, o := range batch {
+		entries[i] = partAuditEntry(AuditDelete, reason, o.key, o.value, o.meta.FidInfos)
+	}
+	if err = c.audit(ctx, entries...); err != nil {
+		return err
+	}
+
+	fids := make([][]ydmeta.FileIdInfo, len(batch))
+	for i, o := range batch {
+		fids[i] = o.meta.FidInfos
+	}
+	errs := c.deleteFidLists(ctx, fids)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	keys := make([]string, 0, len(batch))
+	var size int64
+	for i, o := range batch {
+		if errs[i] != nil {
+			log.Printf("delete data of %s failed: %s", o.key, errs[i].Error())
+			report.FailedCount++
+			continue
+		}
+		keys = append(keys, o.key)
+		size += o.meta.Size
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	err = c.throttle.tikvTxn(ctx, func() error {
+		return c.om.DeleteMultipartKeys(lease, keys...)
+	})
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&c.progress.reclaimedCount, int64(len(keys)))
+	atomic.AddInt64(&c.progress.reclaimedSize, size)
+	report.ReclaimedCount += int64(len(keys))
+	report.ReclaimedSize += size
+	return nil
+}
+
+// deleteFidLists deletes the lists of fids from SeaweedFS, concurrency of
+// them at a time, and returns the error of each list.
+func (c *Cleaner) deleteFidLists(ctx context.Context, fids [][]ydmeta.FileIdInfo) []error {
+	errs := make([]error, len(fids))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < c.concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				errs[i] = c.deleteFids(ctx, fids[i])
+			}
+		}()
+	}
+	for i := range fids {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+	return errs
+}
+
+func (c *Cleaner) deleteFids(ctx context.Context, fids []ydmeta.FileIdInfo) error {
+	for _, fid := range fids {
+		fileId := fid.FileId
+		err := c.throttle.swfsDelete(ctx, fid.FileSize, func() error {
+			return c.swfs.DeleteFid(ctx, fileId)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collectValidMultiparts returns the multipart keys referenced by live and
+// deleted large objects. On the way it reclaims the data of the deleted
+// objects past the retention that no other record references, and removes
+// the records of the deleted large objects past the retention, whose parts
+// are then valid only when another record references them.
+//
+// The deleted objects are read first, so that the expired ones are known
+// when the other records are read for the fids they reference: the live
+// objects, and then the deleted objects again. An object overwritten or
+// deleted between the first two reads is in neither of them, but its record
+// is in the last: it holds parts and fids the live object that replaced it
+// may no longer reference. When there are expired objects, the last read
+// covers the deleted objects of all buckets, since records of any bucket
+// may share fids.
+func (c *Cleaner) collectValidMultiparts(ctx context.Context, lease *ydmeta.Lease,
+	report *Report) (map[ydmeta.PartKey]struct{}, error) {
+	buckets, err := c.bm.ListBuckets()
+	if err != nil {
+		return nil, err
+	}
+
+	validMultipart := make(map[ydmeta.PartKey]struct{})
+	refs := newFidRefs()
+
+	c.progress.phase.Store(PhaseDeleted)
+	delIter, err := c.listDeletedObjects()
+	if err != nil {
+		return nil, err
+	}
+	cutoff := report.StartTime.Add(-c.deletedRetention)
+	var expired []expiredObject
+	err = c.walkObjects(ctx, delIter, func(cur *ydmeta.ObjectCursor) error {
+		atomic.AddInt64(&c.progress.deletedScanned, 1)
+		ob := cur.Item().Object
+		e, ok := c.checkExpired(cur.Item().Key, ob, cutoff)
+		if ok && c.keepsObject(ob) {
+			report.ProtectedSkipped++
+			ok = false
+		}
+		if !ok {
+			addValidMultiparts(validMultipart, ob)
+			return nil
+		}
+		if e.large {
+			report.ExpiredLargeCount++
+		} else {
+			report.ExpiredObjectCount++
+			report.ExpiredObjectSize += ob.Size
+		}
+		if len(expired) >= maxExpiredPerScan {
+			// left to the next scan, until which its parts stay valid
+			addValidMultiparts(validMultipart, ob)
+			return nil
+		}
+		if c.execute {
+			e.value = cur.RawValue()
+		}
+		expired = append(expired, e)
+		refs.addExpired(e.fids)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c.progress.phase.Store(PhaseObjects)
+	for _, b := range buckets {
+		// a copy may share fids with an object of any bucket
+		inScope := c.inScope(b.Name)
+		if !inScope && len(expired) == 0 {
+			continue
+		}
+		iter, err := c.om.ListBucketObjectsByIter(b.Name)
+		if err != nil {
+			return nil, err
+		}
+		err = c.walkObjects(ctx, iter, func(cur *ydmeta.ObjectCursor) error {
+			atomic.AddInt64(&c.progress.objectsScanned, 1)
+			ob := cur.Item().Object
+			if inScope {
+				addValidMultiparts(validMultipart, ob)
+			}
+			return refs.addObject(ob)
+		})
+		if err != nil {
+			return nil, err
+		}
+		atomic.AddInt64(&c.progress.bucketsScanned, 1)
+	}
+
+	c.progress.phase.Store(PhaseDeleted)
+	candidates := make(map[string]struct{}, len(expired))
+	for _, e := range expired {
+		candidates[e.key] = struct{}{}
+	}
+	if len(expired) == 0 {
+		delIter, err = c.listDeletedObjects()
+	} else {
+		delIter, err = c.om.ListDeletedObjectsByIter()
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = c.walkObjects(ctx, delIter, func(cur *ydmeta.ObjectCursor) error {
+		if _, ok := candidates[cur.Item().Key]; ok {
+			return nil
+		}
+		ob := cur.Item().Object
+		if c.inScope(ob.Bucket) {
+			addValidMultiparts(validMultipart, ob)
+		}
+		return refs.addObject(ob)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(expired) == 0 {
+		return validMultipart, nil
+	}
+
+	if err = c.reclaimExpired(ctx, lease, expired, refs, report); err != nil {
+		return nil, err
+	}
+	return validMultipart, nil
+}
+
+// walkObjects calls fn for each record of iter until it fails, and closes
+// it. A record that cannot be decoded ends the walk with its error: what it
+// references is unknown, so nothing it may reference can be reclaimed
+// safely.
+func (c *Cleaner) walkObjects(ctx context.Context, iter *ydmeta.ObjectMetaIter,
+	fn func(cur *ydmeta.ObjectCursor) error) error {
+	cur := iter.Cursor()
+	defer cur.Close()
+	for c.throttle.scanRead(cur.Next) {
+		if err := c.throttle.scanKey(ctx); err != nil {
+			return err
+		}
+		if err := cur.Item().Err; err != nil {
+			return err
+		}
+		if err := fn(cur); err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+// listDeletedObjects iterates the deleted objects the run may reclaim: the
+// ones of the buckets in scope through the deleted index, and the legacy
+// records it misses, when the scope is restricted and the index is
+// complete, all of them otherwise.
+func (c *Cleaner) listDeletedObjects() (*ydmeta.ObjectMetaIter, error) {
+	if !c.scope.restricted() {
+		return c.om.ListDeletedObjectsByIter()
+	}
+	status, err := c.om.MigrationStatus(ydmeta.DeletedIndexMigration)
+	if err != nil {
+		return nil, err
+	}
+	if !status.Done {
+		log.Printf("migration %s is not done, reading the deleted objects of all buckets",
+			ydmeta.DeletedIndexMigration)
+		return c.om.ListDeletedObjectsByIter()
+	}
+	return c.om.ListBucketsDeletedObjectsByIter(c.scopedBuckets())
+}
+
+func addValidMultiparts(valid map[ydmeta.PartKey]struct{}, ob *ydmeta.ObjectInfo) {
+	if ob.Type != ydmeta.ObjectLargeType {
+		return
+	}
+	for i := 0; i < int(ob.PartTotal); i++ {
+		valid[ydmeta.PartKey{Bucket: ob.Bucket, UploadID: ob.UploadID, PartNumber: i}] = struct{}{}
+	}
+}
@@ -0,0 +1,115 @@
+package cleaner
+
+import (
+	"clean_sw_dirty/ydmeta"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// liveStore connects to the TiKV of META_SERVER_ADDRESS, and skips the test
+// when there is none.
+func liveStore(t *testing.T) *ydmeta.Store {
+	addr := os.Getenv("META_SERVER_ADDRESS")
+	if addr == "" {
+		t.Skip("META_SERVER_ADDRESS is not set")
+	}
+	store, err := ydmeta.NewStore(addr)
+	require.Nil(t, err)
+	return store
+}
+
+// TestCollectSharedFids runs copies and overwrites through real object and
+// deleted records, and checks which fids and parts the scan keeps.
+func TestCollectSharedFids(t *testing.T) {
+	store := liveStore(t)
+	defer store.Close()
+	bm, om := store.Buckets(), store.Objects()
+
+	prefix := fmt.Sprintf("cleaner-refs-%d", time.Now().UnixNano())
+	src, dst := prefix+"-src", prefix+"-dst"
+	for _, b := range []string{src, dst} {
+		require.Nil(t, bm.CreateBucket(b, &ydmeta.BucketInfo{Name: b, Type: "seaweedfs", CreateTime: time.Now()}))
+	}
+	defer func() {
+		iter, err := om.ListDeletedObjectsByIter()
+		require.Nil(t, err)
+		cur := iter.Cursor()
+		var keys []string
+		for cur.Next() {
+			if ob := cur.Item().Object; ob != nil && (ob.Bucket == src || ob.Bucket == dst) {
+				keys = append(keys, cur.Item().Key)
+			}
+		}
+		cur.Close()
+		for _, key := range keys {
+			om.DeleteByDeletedKey(key)
+		}
+		for _, o := range [][2]string{{src, "copied"}, {dst, "copy"}, {src, "overwritten"}, {src, "replaced"}, {src, "large"}} {
+			om.DeleteObject(o[0], o[1])
+		}
+		bm.DeleteBucket(src)
+		bm.DeleteBucket(dst)
+	}()
+
+	save := func(bucket string, name string, etag string, fids ...string) {
+		ob := &ydmeta.ObjectInfo{Name: name, Bucket: bucket, Etag: etag, ModTime: time.Now()}
+		infos := make([]ydmeta.FileIdInfo, 0, len(fids))
+		for _, fid := range fids {
+			infos = append(infos, ydmeta.FileIdInfo{FileId: fid, FileSize: 10})
+			ob.Size += 10
+		}
+		ob.SetFids(infos)
+		value, err := json.Marshal(ob)
+		require.Nil(t, err)
+		require.Nil(t, om.SaveObject(bucket, name, value))
+	}
+	// copied to another bucket, then deleted
+	save(src, "copied", "a", "1,01")
+	save(dst, "copy", "a", "1,01")
+	require.Nil(t, om.MarkObjectDeleted(src, "copied"))
+	// overwritten by a metadata-only update
+	save(src, "overwritten", "b", "1,02")
+	save(src, "overwritten", "c", "1,02")
+	// overwritten with new data
+	save(src, "replaced", "d", "1,03")
+	save(src, "replaced", "e", "1,04")
+	// a large object overwritten by a small one
+	large := &ydmeta.ObjectInfo{Name: "large", Bucket: src, Type: ydmeta.ObjectLargeType,
+		UploadID: prefix, PartTotal: 2, ModTime: time.Now()}
+	value, err := json.Marshal(large)
+	require.Nil(t, err)
+	require.Nil(t, om.SaveObject(src, "large", value))
+	save(src, "large", "f", "1,05")
+
+	c := NewCleaner(bm, om)
+	c.SetScope([]string{src}, nil)
+	parts := []ydmeta.PartKey{{Bucket: src, UploadID: prefix}, {Bucket: src, UploadID: prefix, PartNumber: 1}}
+
+	// past the retention, the fids a live record shares are kept
+	c.SetDeletedObjectRetention(time.Nanosecond)
+	report := &Report{StartTime: time.Now()}
+	valid, err := c.collectValidMultiparts(context.Background(), nil, report)
+	require.Nil(t, err)
+	require.Equal(t, int64(3), report.ExpiredObjectCount)
+	require.Equal(t, int64(1), report.ExpiredLargeCount)
+	require.Equal(t, int64(2), report.SharedFidCount)
+	for _, pk := range parts {
+		require.NotContains(t, valid, pk)
+	}
+
+	// within it, the parts of the large object are kept
+	c.SetDeletedObjectRetention(time.Hour)
+	report = &Report{StartTime: time.Now()}
+	valid, err = c.collectValidMultiparts(context.Background(), nil, report)
+	require.Nil(t, err)
+	require.Zero(t, report.ExpiredObjectCount)
+	for _, pk := range parts {
+		require.Contains(t, valid, pk)
+	}
+}
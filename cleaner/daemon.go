@@ -0,0 +1,135 @@
+package cleaner
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Scanner is the unit of work run by a Daemon.
+type Scanner interface {
+	Scan(ctx context.Context) (*Report, error)
+	Progress() Progress
+}
+
+// Daemon runs scans on a schedule and on demand, at most one at a time.
+type Daemon struct {
+	scanner  Scanner
+	schedule Schedule
+	onReport func(*Report)
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+	latest *Report
+}
+
+func NewDaemon(scanner Scanner, schedule Schedule) *Daemon {
+	return &Daemon{scanner: scanner, schedule: schedule}
+}
+
+// OnReport registers fn to be called with the report of every finished scan.
+func (d *Daemon) OnReport(fn func(*Report)) {
+	d.onReport = fn
+}
+
+// Run triggers scans according to the schedule until ctx is done, then
+// cancels the running scan and waits for it to return.
+func (d *Daemon) Run(ctx context.Context) {
+	for {
+		var timer *time.Timer
+		var fire <-chan time.Time
+		if d.schedule != nil {
+			if next := d.schedule.Next(time.Now()); !next.IsZero() {
+				timer = time.NewTimer(time.Until(next))
+				fire = timer.C
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			d.Cancel()
+			d.Wait()
+			return
+		case <-fire:
+			if err := d.Trigger(ctx); err != nil {
+				log.Printf("scheduled scan skipped: %s", err.Error())
+			}
+		}
+	}
+}
+
+// Trigger starts a scan in the background. The scan is bound to ctx and can
+// also be stopped through Cancel.
+func (d *Daemon) Trigger(ctx context.Context) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.done != nil {
+		return ErrScanRunning
+	}
+
+	scanCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	d.cancel, d.done = cancel, done
+
+	go func() {
+		defer close(done)
+		defer cancel()
+
+		report, err := d.scanner.Scan(scanCtx)
+		if err != nil {
+			log.Printf("scan failed: %s", err.Error())
+		}
+
+		d.mu.Lock()
+		if report != nil {
+			d.latest = report
+		}
+		d.cancel, d.done = nil, nil
+		d.mu.Unlock()
+
+		if report != nil {
+			log.Println(report.String())
+			if d.onReport != nil {
+				d.onReport(report)
+			}
+		}
+	}()
+	return nil
+}
+
+// Cancel stops the running scan.
+func (d *Daemon) Cancel() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cancel == nil {
+		return ErrNoScan
+	}
+	d.cancel()
+	return nil
+}
+
+// Wait blocks until the running scan, if any, has returned.
+func (d *Daemon) Wait() {
+	d.mu.Lock()
+	done := d.done
+	d.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+}
+
+// LatestReport returns the report of the last finished scan, or nil.
+func (d *Daemon) LatestReport() *Report {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.latest
+}
+
+func (d *Daemon) Progress() Progress {
+	return d.scanner.Progress()
+}
@@ -0,0 +1,224 @@
+package cleaner
+
+import (
+	"clean_sw_dirty/ydmeta"
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultDeletedObjectRetention is how long the data of a deleted or
+// superseded object is kept.
+const DefaultDeletedObjectRetention = 7 * 24 * time.Hour
+
+const (
+	reasonExpiredObject = "deleted object past retention"
+	reasonExpiredLarge  = "deleted large object past retention, its parts left to the orphan scan"
+)
+
+// SetDeletedObjectRetention makes execute mode reclaim the data of deleted
+// object records and of deleted parts once they are older than d, and then
+// remove the records. The record of a deleted large object is removed
+// without its data: its parts are then referenced by no record and are
+// reclaimed as orphans, through the quarantine. Zero disables it.
+func (c *Cleaner) SetDeletedObjectRetention(d time.Duration) {
+	c.deletedRetention = d
+}
+
+// maxExpiredPerScan bounds how many expired records a scan holds in memory
+// for the reference check. The rest are left to the next scan.
+const maxExpiredPerScan = 100000
+
+// expiredObject is a deleted object record whose data is to be reclaimed.
+type expiredObject struct {
+	key    string
+	value  []byte
+	bucket string
+	name   string
+	fids   []ydmeta.FileIdInfo
+	// large records hold no fids, the parts of their upload are their data
+	large bool
+}
+
+// fidRefs tells which fids of the expired records are still referenced by
+// another record. A metadata-only overwrite or a copy leaves several records
+// pointing at the same fids, and deleting the data of one of them must not
+// destroy the data of a live object or of a version still retained.
+//
+// Only the fids of the expired records are tracked, so the memory used is
+// bounded by maxExpiredPerScan rather than by the number of objects.
+type fidRefs struct {
+	expired    map[string]struct{}
+	referenced map[string]struct{}
+}
+
+func newFidRefs() *fidRefs {
+	return &fidRefs{
+		expired:    make(map[string]struct{}),
+		referenced: make(map[string]struct{}),
+	}
+}
+
+// addExpired registers the fids of an expired record. It must be called
+// for every expired record before the references are added.
+func (r *fidRefs) addExpired(fids []ydmeta.FileIdInfo) {
+	for _, fid := range fids {
+		r.expired[fid.FileId] = struct{}{}
+	}
+}
+
+// addReferences marks the fids held by a record that is not reclaimed.
+func (r *fidRefs) addReferences(fids []ydmeta.FileIdInfo) {
+	for _, fid := range fids {
+		if _, ok := r.expired[fid.FileId]; ok {
+			r.referenced[fid.FileId] = struct{}{}
+		}
+	}
+}
+
+// addObject marks the fids of ob, a record that is not reclaimed. It fails
+// when the fids of ob cannot be read: ob may reference any expired fid.
+func (r *fidRefs) addObject(ob *ydmeta.ObjectInfo) error {
+	if len(r.expired) == 0 || ob.Type == ydmeta.ObjectLargeType {
+		return nil
+	}
+	fids, err := ob.Fids()
+	if err != nil {
+		return err
+	}
+	r.addReferences(fids)
+	return nil
+}
+
+// unreferenced returns the fids that no other record references.
+func (r *fidRefs) unreferenced(fids []ydmeta.FileIdInfo) []ydmeta.FileIdInfo {
+	var ret []ydmeta.FileIdInfo
+	for _, fid := range fids {
+		if _, ok := r.referenced[fid.FileId]; !ok {
+			ret = append(ret, fid)
+		}
+	}
+	return ret
+}
+
+// checkExpired tells whether the deleted object record at key was deleted
+// before cutoff and holds data the cleaner knows how to reclaim: parts for a
+// large object, fids, or none at all for an empty object.
+func (c *Cleaner) checkExpired(key string, ob *ydmeta.ObjectInfo, cutoff time.Time) (expiredObject, bool) {
+	// a record that failed to decode has no bucket
+	if c.deletedRetention <= 0 || ob.Bucket == "" || !c.inScope(ob.Bucket) {
+		return expiredObject{}, false
+	}
+	deleted, ok := ydmeta.ParseDeletedObjectKey(key)
+	if !ok || !time.Unix(0, deleted).Before(cutoff) {
+		return expiredObject{}, false
+	}
+	if ob.Type == ydmeta.ObjectLargeType {
+		return expiredObject{key: key, bucket: ob.Bucket, name: ob.Name, large: true}, true
+	}
+	fids, err := ob.Fids()
+	if err != nil {
+		log.Printf("skip deleted object %s: %s", key, err.Error())
+		return expiredObject{}, false
+	}
+	if len(fids) == 0 && ob.Size != 0 {
+		return expiredObject{}, false
+	}
+	return expiredObject{key: key, bucket: ob.Bucket, name: ob.Name, fids: fids}, true
+}
+
+// reclaimExpired reclaims the expired records in batches, keeping the fids
+// that refs reports as referenced.
+func (c *Cleaner) reclaimExpired(ctx context.Context, lease *ydmeta.Lease, expired []expiredObject,
+	refs *fidRefs, report *Report) error {
+	batch := make([]expiredObject, 0, c.batchSize)
+	for _, e := range expired {
+		fids := refs.unreferenced(e.fids)
+		report.SharedFidCount += int64(len(e.fids) - len(fids))
+		if !c.execute {
+			continue
+		}
+		e.fids = fids
+		batch = append(batch, e)
+		if len(batch) >= c.batchSize {
+			if err := c.deleteExpired(ctx, lease, batch, report); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	if len(batch) > 0 {
+		return c.deleteExpired(ctx, lease, batch, report)
+	}
+	return nil
+}
+
+// deleteExpired removes the SeaweedFS data of each expired record and then
+// the record, like deleteOrphans. Several records may share a fid, which is
+// harmless as deleting a missing fid succeeds.
+func (c *Cleaner) deleteExpired(ctx context.Context, lease *ydmeta.Lease, batch []expiredObject, report *Report) error {
+	err := c.throttle.tikvTxn(ctx, func() error {
+		return c.om.CheckLease(lease)
+	})
+	if err != nil {
+		return err
+	}
+	entries := make([]*ydmeta.AuditEntry, len(batch))
+	for i, e := range batch {
+		reason := reasonExpiredObject
+		if e.large {
+			reason = reasonExpiredLarge
+		}
+		entries[i] = &ydmeta.AuditEntry{
+			Action: AuditDelete,
+			Bucket: e.bucket,
+			Object: e.name,
+			Key:    []byte(e.key),
+			Value:  e.value,
+			Fids:   fileIds(e.fids),
+			Reason: reason,
+		}
+	}
+	if err = c.audit(ctx, entries...); err != nil {
+		return err
+	}
+
+	fids := make([][]ydmeta.FileIdInfo, len(batch))
+	for i, e := range batch {
+		fids[i] = e.fids
+	}
+	errs := c.deleteFidLists(ctx, fids)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	keys := make([]string, 0, len(batch))
+	var size int64
+	for i, e := range batch {
+		if errs[i] != nil {
+			log.Printf("delete data of %s failed: %s", e.key, errs[i].Error())
+			report.FailedCount++
+			continue
+		}
+		keys = append(keys, e.key)
+		for _, fid := range e.fids {
+			size += fid.FileSize
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	err = c.throttle.tikvTxn(ctx, func() error {
+		return c.om.DeleteDeletedObjectKeys(lease, keys...)
+	})
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&c.progress.reclaimedCount, int64(len(keys)))
+	atomic.AddInt64(&c.progress.reclaimedSize, size)
+	report.ReclaimedObjectCount += int64(len(keys))
+	report.ReclaimedObjectSize += size
+	return nil
+}
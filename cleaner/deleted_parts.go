@@ -0,0 +1,183 @@
+package cleaner
+
+import (
+	"clean_sw_dirty/ydmeta"
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	PhaseDeletedParts = "deleted-parts"
+
+	reasonExpiredPart = "deleted part past retention"
+)
+
+// deletedPart is a deleted multipart record holding a part: one replaced by
+// a new upload of the same part, or left by an aborted upload.
+type deletedPart struct {
+	key   string
+	value []byte
+	pk    ydmeta.PartKey
+	meta  *ydmeta.MultipartPartMetaV1
+}
+
+// scanDeletedParts reclaims the data of the deleted parts of the buckets in
+// scope once they are older than the deleted object retention, and then
+// removes their records. Nothing but the part at the same key can reference
+// the data of a deleted part, so the fids it shares with that part are kept.
+func (c *Cleaner) scanDeletedParts(ctx context.Context, lease *ydmeta.Lease, report *Report) error {
+	if c.deletedRetention <= 0 {
+		return nil
+	}
+	c.progress.phase.Store(PhaseDeletedParts)
+	iter, err := c.om.ListDeletedMultipartsByIter()
+	if err != nil {
+		return err
+	}
+	cur := iter.Cursor()
+	defer cur.Close()
+
+	cutoff := report.StartTime.Add(-c.deletedRetention)
+	var batch []deletedPart
+	for c.throttle.scanRead(cur.Next) {
+		if err = c.throttle.scanKey(ctx); err != nil {
+			return err
+		}
+		item := cur.Item()
+		deleted, pk, ok := ydmeta.ParseDeletedPartKey(item.Key)
+		if !ok {
+			continue
+		}
+		// the records are ordered by deletion time
+		if !time.Unix(0, deleted).Before(cutoff) {
+			break
+		}
+		if !c.inScope(pk.Bucket) {
+			continue
+		}
+		if item.Err != nil {
+			log.Printf("skip deleted part: %s", item.Err.Error())
+			report.UndecodableSkipped++
+			continue
+		}
+		if c.isProtected(pk.Bucket) {
+			report.ProtectedSkipped++
+			continue
+		}
+		report.ExpiredPartCount++
+		report.ExpiredPartSize += item.Part.Size
+
+		batch = append(batch, deletedPart{key: item.Key, value: cur.RawValue(), pk: pk, meta: item.Part})
+		if len(batch) >= c.batchSize {
+			if err = c.reclaimDeletedParts(ctx, lease, batch, report); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	if err = cur.Err(); err != nil {
+		return err
+	}
+	if len(batch) > 0 {
+		return c.reclaimDeletedParts(ctx, lease, batch, report)
+	}
+	return nil
+}
+
+// reclaimDeletedParts drops the fids the parts at the keys of the batch
+// still hold, and deletes the rest in execute mode.
+func (c *Cleaner) reclaimDeletedParts(ctx context.Context, lease *ydmeta.Lease, batch []deletedPart,
+	report *Report) error {
+	pks := make([]ydmeta.PartKey, len(batch))
+	for i, p := range batch {
+		pks[i] = p.pk
+	}
+	var live map[ydmeta.PartKey]*ydmeta.MultipartPartMetaV1
+	err := c.throttle.tikvTxn(ctx, func() error {
+		var err error
+		live, err = c.om.GetParts(pks)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for i, p := range batch {
+		meta := *p.meta
+		if part, ok := live[p.pk]; ok {
+			meta.FidInfos = withoutFids(p.meta.FidInfos, part.FidInfos)
+		}
+		report.SharedFidCount += int64(len(p.meta.FidInfos) - len(meta.FidInfos))
+		batch[i].meta = &meta
+	}
+	if !c.execute {
+		return nil
+	}
+	return c.deleteDeletedParts(ctx, lease, batch, report)
+}
+
+// withoutFids returns the fids that are not in held.
+func withoutFids(fids []ydmeta.FileIdInfo, held []ydmeta.FileIdInfo) []ydmeta.FileIdInfo {
+	refs := newFidRefs()
+	refs.addExpired(fids)
+	refs.addReferences(held)
+	return refs.unreferenced(fids)
+}
+
+// deleteDeletedParts removes the SeaweedFS data of each deleted part and
+// then its record, like deleteOrphans.
+func (c *Cleaner) deleteDeletedParts(ctx context.Context, lease *ydmeta.Lease, batch []deletedPart,
+	report *Report) error {
+	err := c.throttle.tikvTxn(ctx, func() error {
+		return c.om.CheckLease(lease)
+	})
+	if err != nil {
+		return err
+	}
+	entries := make([]*ydmeta.AuditEntry, len(batch))
+	for i, p := range batch {
+		entries[i] = partAuditEntry(AuditDelete, reasonExpiredPart, p.key, p.value, p.meta.FidInfos)
+	}
+	if err = c.audit(ctx, entries...); err != nil {
+		return err
+	}
+
+	fids := make([][]ydmeta.FileIdInfo, len(batch))
+	for i, p := range batch {
+		fids[i] = p.meta.FidInfos
+	}
+	errs := c.deleteFidLists(ctx, fids)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	keys := make([]string, 0, len(batch))
+	var size int64
+	for i, p := range batch {
+		if errs[i] != nil {
+			log.Printf("delete data of %s failed: %s", p.key, errs[i].Error())
+			report.FailedCount++
+			continue
+		}
+		keys = append(keys, p.key)
+		for _, fid := range p.meta.FidInfos {
+			size += fid.FileSize
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	err = c.throttle.tikvTxn(ctx, func() error {
+		return c.om.DeleteMultipartKeys(lease, keys...)
+	})
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&c.progress.reclaimedCount, int64(len(keys)))
+	atomic.AddInt64(&c.progress.reclaimedSize, size)
+	report.ReclaimedCount += int64(len(keys))
+	report.ReclaimedSize += size
+	return nil
+}
@@ -0,0 +1,131 @@
+package cleaner
+
+import (
+	"clean_sw_dirty/ydmeta"
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckExpired(t *testing.T) {
+	now := time.Now()
+	c := NewCleaner(nil, nil)
+	c.SetScope(nil, []string{"excluded"})
+	cutoff := now.Add(-c.deletedRetention)
+	key := func(deleted time.Time, bucket string) string {
+		return string(ydmeta.Pack(ydmeta.DELETED_OBJECT_PREFIX, deleted.UnixNano(), bucket, "o"))
+	}
+	old, recent := now.Add(-8*24*time.Hour), now.Add(-time.Hour)
+	fids := []ydmeta.FileIdInfo{{FileId: "3,01637037d6", FileSize: 10}}
+
+	ob := &ydmeta.ObjectInfo{Name: "o", Bucket: "b", Size: 10}
+	ob.SetFids(fids)
+	e, ok := c.checkExpired(key(old, "b"), ob, cutoff)
+	require.True(t, ok)
+	require.Equal(t, fids, e.fids)
+
+	// legacy keys carry the deletion time too
+	_, ok = c.checkExpired("YDS3_DELETED_OBJECT#"+strconv.FormatInt(old.UnixNano(), 10)+"#b#o", ob, cutoff)
+	require.True(t, ok)
+
+	_, ok = c.checkExpired(key(recent, "b"), ob, cutoff)
+	require.False(t, ok)
+
+	excluded := *ob
+	excluded.Bucket = "excluded"
+	_, ok = c.checkExpired(key(old, "excluded"), &excluded, cutoff)
+	require.False(t, ok)
+
+	// data the cleaner cannot locate is left alone, empty objects are not
+	_, ok = c.checkExpired(key(old, "b"), &ydmeta.ObjectInfo{Name: "o", Bucket: "b", Size: 10}, cutoff)
+	require.False(t, ok)
+	e, ok = c.checkExpired(key(old, "b"), &ydmeta.ObjectInfo{Name: "o", Bucket: "b"}, cutoff)
+	require.True(t, ok)
+	require.Empty(t, e.fids)
+
+	// the parts of large objects are their data
+	large := &ydmeta.ObjectInfo{Name: "o", Bucket: "b", Size: 10, Type: ydmeta.ObjectLargeType}
+	e, ok = c.checkExpired(key(old, "b"), large, cutoff)
+	require.True(t, ok)
+	require.True(t, e.large)
+	require.Empty(t, e.fids)
+	_, ok = c.checkExpired(key(recent, "b"), large, cutoff)
+	require.False(t, ok)
+
+	// records that failed to decode
+	_, ok = c.checkExpired(key(old, "b"), &ydmeta.ObjectInfo{}, cutoff)
+	require.False(t, ok)
+
+	c.SetDeletedObjectRetention(0)
+	_, ok = c.checkExpired(key(old, "b"), ob, cutoff)
+	require.False(t, ok)
+}
+
+func TestFidRefs(t *testing.T) {
+	object := func(bucket string, fids ...string) *ydmeta.ObjectInfo {
+		ob := &ydmeta.ObjectInfo{Name: "o", Bucket: bucket}
+		infos := make([]ydmeta.FileIdInfo, 0, len(fids))
+		for _, fid := range fids {
+			infos = append(infos, ydmeta.FileIdInfo{FileId: fid, FileSize: 10})
+			ob.Size += 10
+		}
+		ob.SetFids(infos)
+		return ob
+	}
+	fidsOf := func(ob *ydmeta.ObjectInfo) []ydmeta.FileIdInfo {
+		fids, err := ob.Fids()
+		require.Nil(t, err)
+		return fids
+	}
+
+	overwritten := object("b", "1,01")    // replaced by a metadata-only update
+	replaced := object("b", "1,02")       // replaced by new data
+	copied := object("b", "1,03", "1,04") // copied to another bucket, then deleted
+	superseded := object("b", "1,05")     // a later version, still retained, shares its data
+	refs := newFidRefs()
+	for _, ob := range []*ydmeta.ObjectInfo{overwritten, replaced, copied, superseded} {
+		refs.addExpired(fidsOf(ob))
+	}
+
+	for _, ob := range []*ydmeta.ObjectInfo{
+		object("b", "1,01"), object("b", "1,06"), object("c", "1,04"), object("b", "1,05"),
+	} {
+		require.Nil(t, refs.addObject(ob))
+	}
+	large := object("b", "1,02")
+	large.Type = ydmeta.ObjectLargeType
+	require.Nil(t, refs.addObject(large))
+	// the fids of a record that cannot be read may be any of them
+	broken := &ydmeta.ObjectInfo{Name: "o", Bucket: "b", Size: 10}
+	broken.ExtFields = map[string]interface{}{ydmeta.ExtFids: "not fids"}
+	require.Error(t, refs.addObject(broken))
+
+	require.Empty(t, refs.unreferenced(fidsOf(overwritten)))
+	require.Equal(t, fidsOf(replaced), refs.unreferenced(fidsOf(replaced)))
+	require.Equal(t, fidsOf(copied)[:1], refs.unreferenced(fidsOf(copied)))
+	require.Empty(t, refs.unreferenced(fidsOf(superseded)))
+	// only the fids of expired records are tracked
+	require.Len(t, refs.referenced, 3)
+
+	c := NewCleaner(nil, nil)
+	report := &Report{}
+	expired := []expiredObject{
+		{key: "overwritten", fids: fidsOf(overwritten)},
+		{key: "replaced", fids: fidsOf(replaced)},
+		{key: "copied", fids: fidsOf(copied)},
+	}
+	require.Nil(t, c.reclaimExpired(context.Background(), nil, expired, refs, report))
+	require.Equal(t, int64(2), report.SharedFidCount)
+}
+
+func TestWithoutFids(t *testing.T) {
+	fids := []ydmeta.FileIdInfo{{FileId: "1,01"}, {FileId: "1,02"}, {FileId: "1,03"}}
+	require.Equal(t, fids, withoutFids(fids, nil))
+	// a part saved again with the same data
+	require.Equal(t, []ydmeta.FileIdInfo{fids[1]},
+		withoutFids(fids, []ydmeta.FileIdInfo{{FileId: "1,01"}, {FileId: "1,03"}, {FileId: "1,04"}}))
+	require.Empty(t, withoutFids(fids, fids))
+}
@@ -0,0 +1,32 @@
+package cleaner
+
+import (
+	"clean_sw_dirty/ydmeta"
+	"context"
+	"time"
+)
+
+// SetLeaseOwner names this process in the cleaner lease when it runs
+// migrations without execute mode.
+func (c *Cleaner) SetLeaseOwner(owner string) {
+	c.owner = owner
+}
+
+// Migrate runs mig to completion from its checkpoint like
+// ydmeta.MetaManager.Migrate, under the cleaner lease, so that it never
+// rewrites records while a cleaner run deletes them. The records it
+// rewrites or removes are recorded in the audit trail as one run.
+func (c *Cleaner) Migrate(ctx context.Context, mig *ydmeta.Migration, limit int,
+	progress func(*ydmeta.MigrationStatus)) (status *ydmeta.MigrationStatus, err error) {
+	lease, ctx, done, err := c.holdLease(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if leaseErr := done(); leaseErr != nil {
+			err = leaseErr
+		}
+	}()
+	runID := c.newRun(time.Now())
+	return c.om.Migrate(ctx, lease, runID, mig, limit, progress)
+}
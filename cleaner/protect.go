@@ -0,0 +1,39 @@
+package cleaner
+
+import (
+	"clean_sw_dirty/ydmeta"
+)
+
+// SetProtectedBuckets makes the cleaner never clean the buckets in names,
+// besides the buckets flagged with ydmeta.ExtProtected. It still reads them
+// to find the data they reference.
+func (c *Cleaner) SetProtectedBuckets(names []string) {
+	c.protectedBuckets = make(map[string]struct{}, len(names))
+	for _, b := range names {
+		c.protectedBuckets[b] = struct{}{}
+	}
+}
+
+func protectedBuckets(names map[string]struct{}, buckets []*ydmeta.BucketInfo) map[string]struct{} {
+	protected := make(map[string]struct{}, len(names))
+	for b := range names {
+		protected[b] = struct{}{}
+	}
+	for _, b := range buckets {
+		if b.Protected() {
+			protected[b.Name] = struct{}{}
+		}
+	}
+	return protected
+}
+
+func (c *Cleaner) isProtected(bucket string) bool {
+	_, ok := c.protected[bucket]
+	return ok
+}
+
+// keepsObject tells whether the data of the deleted object ob must be kept
+// regardless of its age.
+func (c *Cleaner) keepsObject(ob *ydmeta.ObjectInfo) bool {
+	return c.isProtected(ob.Bucket) || ob.LegalHold()
+}
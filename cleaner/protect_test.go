@@ -0,0 +1,28 @@
+package cleaner
+
+import (
+	"clean_sw_dirty/ydmeta"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProtection(t *testing.T) {
+	c := NewCleaner(nil, nil)
+	c.SetProtectedBuckets([]string{"denied"})
+	c.protected = protectedBuckets(c.protectedBuckets, []*ydmeta.BucketInfo{
+		{Name: "archive", ExtFields: map[string]interface{}{ydmeta.ExtProtected: true}},
+		{Name: "open", ExtFields: map[string]interface{}{ydmeta.ExtProtected: false}},
+		{Name: "plain"},
+	})
+
+	require.True(t, c.isProtected("denied"))
+	require.True(t, c.isProtected("archive"))
+	require.False(t, c.isProtected("open"))
+	require.False(t, c.isProtected("plain"))
+
+	require.True(t, c.keepsObject(&ydmeta.ObjectInfo{Bucket: "archive"}))
+	require.False(t, c.keepsObject(&ydmeta.ObjectInfo{Bucket: "plain"}))
+	held := &ydmeta.ObjectInfo{Bucket: "plain", ExtFields: map[string]interface{}{ydmeta.ExtLegalHold: "ON"}}
+	require.True(t, c.keepsObject(held))
+}
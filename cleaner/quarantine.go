@@ -0,0 +1,300 @@
+package cleaner
+
+import (
+	"clean_sw_dirty/ydmeta"
+	"context"
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	PhaseQuarantine = "quarantine"
+
+	// DefaultQuarantineWindow is how long reclaimed parts stay in the
+	// quarantine before their data is deleted.
+	DefaultQuarantineWindow = 3 * 24 * time.Hour
+
+	reasonOrphanedPart  = "orphaned part"
+	reasonAbortedUpload = "part of aborted upload"
+)
+
+var ErrNotExecute = errors.New("not in execute mode")
+
+// SetQuarantineWindow makes execute mode move the parts it reclaims to the
+// quarantine instead of deleting them, and delete their data only once they
+// have been there for d. Zero deletes them at once.
+func (c *Cleaner) SetQuarantineWindow(d time.Duration) {
+	c.quarantineWindow = d
+}
+
+// QuarantineFilter selects quarantined parts. The zero value selects all.
+type QuarantineFilter struct {
+	Bucket   string
+	UploadID string
+	// Before selects the parts quarantined before it.
+	Before time.Time
+}
+
+func (f QuarantineFilter) match(qkey string, pk ydmeta.PartKey) bool {
+	if f.Bucket != "" && pk.Bucket != f.Bucket {
+		return false
+	}
+	if f.UploadID != "" && pk.UploadID != f.UploadID {
+		return false
+	}
+	if f.Before.IsZero() {
+		return true
+	}
+	tsp, _, ok := ydmeta.ParseQuarantineKey(qkey)
+	return ok && time.Unix(0, tsp).Before(f.Before)
+}
+
+// QuarantinedPart is a part in the quarantine.
+type QuarantinedPart struct {
+	Key    string
+	Part   ydmeta.PartKey
+	Meta   *ydmeta.MultipartPartMetaV1
+	Reason string
+	Time   time.Time
+
+	// the original key and value of the part
+	origKey string
+	value   []byte
+}
+
+// ListQuarantine calls fn for each quarantined part f selects, oldest first.
+func (c *Cleaner) ListQuarantine(ctx context.Context, f QuarantineFilter, fn func(QuarantinedPart) error) error {
+	iter, err := c.om.ListQuarantineByIter()
+	if err != nil {
+		return err
+	}
+	cur := iter.Cursor()
+	defer cur.Close()
+	for c.throttle.scanRead(cur.Next) {
+		if err = c.throttle.scanKey(ctx); err != nil {
+			return err
+		}
+		item := cur.Item()
+		if item.Err != nil {
+			log.Printf("skip quarantine entry: %s", item.Err.Error())
+			continue
+		}
+		p, ok := quarantinedPart(item.Key, item.Entry)
+		if !ok || !f.match(p.Key, p.Part) {
+			continue
+		}
+		if err = fn(p); err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+func quarantinedPart(qkey string, entry *ydmeta.QuarantineEntry) (QuarantinedPart, bool) {
+	if entry == nil {
+		log.Printf("skip quarantine entry %q: cannot decode it", qkey)
+		return QuarantinedPart{}, false
+	}
+	pk, ok := ydmeta.ParsePartKey(entry.Key)
+	if !ok {
+		log.Printf("skip quarantine entry %q: not a part", qkey)
+		return QuarantinedPart{}, false
+	}
+	meta := &ydmeta.MultipartPartMetaV1{}
+	if err := ydmeta.DecodeValue(entry.Value, meta); err != nil {
+		log.Printf("skip quarantine entry %q: %s", qkey, err.Error())
+		return QuarantinedPart{}, false
+	}
+	return QuarantinedPart{
+		Key:     qkey,
+		Part:    pk,
+		Meta:    meta,
+		Reason:  entry.Reason,
+		Time:    entry.Time,
+		origKey: entry.Key,
+		value:   entry.Value,
+	}, true
+}
+
+// quarantineOrphans moves the orphans to the quarantine, keeping their data.
+func (c *Cleaner) quarantineOrphans(ctx context.Context, lease *ydmeta.Lease, batch []orphan, reason string,
+	report *Report) error {
+	keys := make([]string, 0, len(batch))
+	entries := make([]*ydmeta.AuditEntry, 0, len(batch))
+	var size int64
+	for _, o := range batch {
+		keys = append(keys, o.key)
+		entries = append(entries, partAuditEntry(AuditQuarantine, reason, o.key, o.value, nil))
+		size += o.meta.Size
+	}
+	if err := c.audit(ctx, entries...); err != nil {
+		return err
+	}
+	err := c.throttle.tikvTxn(ctx, func() error {
+		return c.om.QuarantineKeys(lease, reason, keys...)
+	})
+	if err != nil {
+		return err
+	}
+	report.QuarantinedCount += int64(len(keys))
+	report.QuarantinedSize += size
+	return nil
+}
+
+// Purge deletes the data of the quarantined parts f selects in the buckets
+// in scope, and then their entries. It holds the cleaner lease meanwhile.
+func (c *Cleaner) Purge(ctx context.Context, f QuarantineFilter) (report *Report, err error) {
+	if !c.execute {
+		return nil, ErrNotExecute
+	}
+	report = &Report{StartTime: time.Now(), Execute: true}
+	defer func() {
+		report.finish(err)
+	}()
+	if err = c.loadBuckets(); err != nil {
+		return report, err
+	}
+	lease, ctx, done, err := c.holdLease(ctx)
+	if err != nil {
+		return report, err
+	}
+	report.LeaseToken = lease.Token()
+	report.RunID = c.newRun(report.StartTime)
+	defer func() {
+		if leaseErr := done(); leaseErr != nil {
+			err = leaseErr
+		}
+	}()
+	return report, c.purgeQuarantine(ctx, lease, f, report)
+}
+
+func (c *Cleaner) purgeQuarantine(ctx context.Context, lease *ydmeta.Lease, f QuarantineFilter, report *Report) error {
+	var batch []QuarantinedPart
+	err := c.ListQuarantine(ctx, f, func(p QuarantinedPart) error {
+		if !c.inScope(p.Part.Bucket) {
+			return nil
+		}
+		if c.isProtected(p.Part.Bucket) {
+			report.ProtectedSkipped++
+			return nil
+		}
+		batch = append(batch, p)
+		if len(batch) < c.batchSize {
+			return nil
+		}
+		err := c.deleteQuarantined(ctx, lease, batch, report)
+		batch = batch[:0]
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if len(batch) > 0 {
+		return c.deleteQuarantined(ctx, lease, batch, report)
+	}
+	return nil
+}
+
+// deleteQuarantined removes the SeaweedFS data of each part and then its
+// quarantine entry, like deleteOrphans.
+func (c *Cleaner) deleteQuarantined(ctx context.Context, lease *ydmeta.Lease, batch []QuarantinedPart,
+	report *Report) error {
+	err := c.throttle.tikvTxn(ctx, func() error {
+		return c.om.CheckLease(lease)
+	})
+	if err != nil {
+		return err
+	}
+	entries := make([]*ydmeta.AuditEntry, len(batch))
+	for i, p := range batch {
+		entries[i] = partAuditEntry(AuditPurge, p.Reason, p.origKey, p.value, p.Meta.FidInfos)
+	}
+	if err = c.audit(ctx, entries...); err != nil {
+		return err
+	}
+
+	fids := make([][]ydmeta.FileIdInfo, len(batch))
+	for i, p := range batch {
+		fids[i] = p.Meta.FidInfos
+	}
+	errs := c.deleteFidLists(ctx, fids)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	keys := make([]string, 0, len(batch))
+	var size int64
+	for i, p := range batch {
+		if errs[i] != nil {
+			log.Printf("delete data of quarantined %s failed: %s", p.Part.String(), errs[i].Error())
+			report.FailedCount++
+			continue
+		}
+		keys = append(keys, p.Key)
+		size += p.Meta.Size
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	err = c.throttle.tikvTxn(ctx, func() error {
+		return c.om.DeleteQuarantineKeys(lease, keys...)
+	})
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&c.progress.reclaimedCount, int64(len(keys)))
+	atomic.AddInt64(&c.progress.reclaimedSize, size)
+	report.ReclaimedCount += int64(len(keys))
+	report.ReclaimedSize += size
+	return nil
+}
+
+// Release puts the quarantined parts f selects back in the multipart space
+// and returns how many it released. It holds the cleaner lease meanwhile.
+// A released part is an orphan again unless whatever made it look like one
+// has been fixed.
+func (c *Cleaner) Release(ctx context.Context, f QuarantineFilter) (released int64, err error) {
+	if !c.execute {
+		return 0, ErrNotExecute
+	}
+	lease, ctx, done, err := c.holdLease(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if leaseErr := done(); leaseErr != nil {
+			err = leaseErr
+		}
+	}()
+	c.newRun(time.Now())
+
+	var keys []string
+	var entries []*ydmeta.AuditEntry
+	release := func() error {
+		if err := c.audit(ctx, entries...); err != nil {
+			return err
+		}
+		return c.throttle.tikvTxn(ctx, func() error {
+			n, err := c.om.ReleaseQuarantined(lease, keys...)
+			released += int64(n)
+			return err
+		})
+	}
+	err = c.ListQuarantine(ctx, f, func(p QuarantinedPart) error {
+		keys = append(keys, p.Key)
+		entries = append(entries, partAuditEntry(AuditRelease, p.Reason, p.origKey, p.value, nil))
+		if len(keys) < c.batchSize {
+			return nil
+		}
+		err := release()
+		keys, entries = keys[:0], entries[:0]
+		return err
+	})
+	if err == nil && len(keys) > 0 {
+		err = release()
+	}
+	return released, err
+}
@@ -0,0 +1,42 @@
+package cleaner
+
+import (
+	"clean_sw_dirty/ydmeta"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuarantineFilter(t *testing.T) {
+	now := time.Now()
+	part := ydmeta.PartKey{Bucket: "b", UploadID: "u", PartNumber: 1}
+	qkey := string(ydmeta.Pack(ydmeta.QUARANTINE_PREFIX, now.Add(-time.Hour).UnixNano(), part.String()))
+
+	require.True(t, QuarantineFilter{}.match(qkey, part))
+	require.True(t, QuarantineFilter{Bucket: "b", UploadID: "u"}.match(qkey, part))
+	require.False(t, QuarantineFilter{Bucket: "c"}.match(qkey, part))
+	require.False(t, QuarantineFilter{UploadID: "v"}.match(qkey, part))
+	require.True(t, QuarantineFilter{Before: now}.match(qkey, part))
+	require.False(t, QuarantineFilter{Before: now.Add(-2 * time.Hour)}.match(qkey, part))
+}
+
+func TestQuarantinedPart(t *testing.T) {
+	part := ydmeta.PartKey{Bucket: "b", UploadID: "u", PartNumber: 1}
+	entry := &ydmeta.QuarantineEntry{
+		Key:    part.String(),
+		Value:  []byte(`{"Size":10,"FidInfos":[{"FileId":"3,01637037d6","FileSize":10}]}`),
+		Reason: reasonOrphanedPart,
+	}
+	p, ok := quarantinedPart("q", entry)
+	require.True(t, ok)
+	require.Equal(t, part, p.Part)
+	require.Equal(t, int64(10), p.Meta.Size)
+	require.Equal(t, "3,01637037d6", p.Meta.FidInfos[0].FileId)
+
+	_, ok = quarantinedPart("q", nil)
+	require.False(t, ok)
+	entry.Key = ydmeta.GenMultipartKey("b", "u")
+	_, ok = quarantinedPart("q", entry)
+	require.False(t, ok)
+}
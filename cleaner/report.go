@@ -0,0 +1,84 @@
+package cleaner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrScanRunning = errors.New("a scan is already running")
+	ErrNoScan      = errors.New("no scan is running")
+)
+
+// Report is the outcome of a single scan.
+type Report struct {
+	StartTime            time.Time     `json:"startTime"`
+	EndTime              time.Time     `json:"endTime"`
+	MultipartsScanned    int64         `json:"multipartsScanned"`
+	OrphanCount          int64         `json:"orphanCount"`
+	OrphanSize           int64         `json:"orphanSize"`
+	InProgressParts      int64         `json:"inProgressParts"`
+	QuarantinedCount     int64         `json:"quarantinedCount"`
+	QuarantinedSize      int64         `json:"quarantinedSize"`
+	StaleUploadCount     int64         `json:"staleUploadCount"`
+	StaleUploadSize      int64         `json:"staleUploadSize"`
+	StaleUploads         []StaleUpload `json:"staleUploads,omitempty"`
+	ExpiredUploadCount   int64         `json:"expiredUploadCount"`
+	ExpiredUploadSize    int64         `json:"expiredUploadSize"`
+	AbortedUploadCount   int64         `json:"abortedUploadCount"`
+	ExpiredObjectCount   int64         `json:"expiredObjectCount"`
+	ExpiredObjectSize    int64         `json:"expiredObjectSize"`
+	ExpiredLargeCount    int64         `json:"expiredLargeCount"`
+	ReclaimedObjectCount int64         `json:"reclaimedObjectCount"`
+	ReclaimedObjectSize  int64         `json:"reclaimedObjectSize"`
+	ExpiredPartCount     int64         `json:"expiredPartCount"`
+	ExpiredPartSize      int64         `json:"expiredPartSize"`
+	SharedFidCount       int64         `json:"sharedFidCount"`
+	ProtectedSkipped     int64         `json:"protectedSkipped"`
+	UndecodableSkipped   int64         `json:"undecodableSkipped"`
+	Execute              bool          `json:"execute"`
+	LeaseToken           uint64        `json:"leaseToken,omitempty"`
+	RunID                string        `json:"runID,omitempty"`
+	ReclaimedCount       int64         `json:"reclaimedCount"`
+	ReclaimedSize        int64         `json:"reclaimedSize"`
+	FailedCount          int64         `json:"failedCount"`
+	Canceled             bool          `json:"canceled"`
+	Error                string        `json:"error,omitempty"`
+}
+
+func (r *Report) finish(err error) {
+	r.EndTime = time.Now()
+	if err == nil {
+		return
+	}
+	if errors.Is(err, context.Canceled) {
+		r.Canceled = true
+		return
+	}
+	r.Error = err.Error()
+}
+
+func (r *Report) String() string {
+	if !r.Execute {
+		return fmt.Sprintf("clean finished, multiparts count is %d, multiparts size is %.2fGB, "+
+			"expired objects count is %d, expired objects size is %.2fGB, expired large objects %d, "+
+			"expired parts %d (%.2fGB), shared fids %d, skipped: protected %d, undecodable %d",
+			r.OrphanCount, float64(r.OrphanSize)/1024/1024/1024,
+			r.ExpiredObjectCount, float64(r.ExpiredObjectSize)/1024/1024/1024, r.ExpiredLargeCount,
+			r.ExpiredPartCount, float64(r.ExpiredPartSize)/1024/1024/1024, r.SharedFidCount,
+			r.ProtectedSkipped, r.UndecodableSkipped)
+	}
+	return fmt.Sprintf("clean finished, multiparts count is %d, multiparts size is %.2fGB, "+
+		"quarantined %d (%.2fGB), reclaimed %d (%.2fGB), expired objects count is %d, "+
+		"expired objects size is %.2fGB, reclaimed %d (%.2fGB), expired large objects %d, "+
+		"expired parts %d (%.2fGB), shared fids %d, skipped: protected %d, undecodable %d, failed %d",
+		r.OrphanCount, float64(r.OrphanSize)/1024/1024/1024,
+		r.QuarantinedCount, float64(r.QuarantinedSize)/1024/1024/1024,
+		r.ReclaimedCount, float64(r.ReclaimedSize)/1024/1024/1024,
+		r.ExpiredObjectCount, float64(r.ExpiredObjectSize)/1024/1024/1024,
+		r.ReclaimedObjectCount, float64(r.ReclaimedObjectSize)/1024/1024/1024, r.ExpiredLargeCount,
+		r.ExpiredPartCount, float64(r.ExpiredPartSize)/1024/1024/1024, r.SharedFidCount,
+		r.ProtectedSkipped, r.UndecodableSkipped, r.FailedCount)
+}
@@ -0,0 +1,72 @@
+package cleaner
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSchedule(t *testing.T) {
+	base := time.Date(2022, 11, 30, 10, 17, 42, 0, time.UTC)
+
+	cases := []struct {
+		spec string
+		next time.Time
+	}{
+		{"@every 90m", base.Add(90 * time.Minute)},
+		{"* * * * *", time.Date(2022, 11, 30, 10, 18, 0, 0, time.UTC)},
+		{"30 3 * * *", time.Date(2022, 12, 1, 3, 30, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2022, 11, 30, 10, 30, 0, 0, time.UTC)},
+		{"0 9-17/4 * * *", time.Date(2022, 11, 30, 13, 0, 0, 0, time.UTC)},
+		{"0 0 * * 0", time.Date(2022, 12, 4, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2022, 12, 4, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2022, 11, 30, 11, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2022, 12, 1, 0, 0, 0, 0, time.UTC)},
+		// day-of-month OR day-of-week when both are restricted
+		{"0 0 15 * 5", time.Date(2022, 12, 2, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, c := range cases {
+		s, err := ParseSchedule(c.spec)
+		require.Nil(t, err, c.spec)
+		require.Equal(t, c.next, s.Next(base), c.spec)
+	}
+}
+
+func TestScheduleOffHourZone(t *testing.T) {
+	for _, offset := range []int{5*3600 + 1800, 5*3600 + 2700, -(3*3600 + 1800)} {
+		zone := time.FixedZone("off-hour", offset)
+		base := time.Date(2022, 11, 30, 10, 17, 42, 0, zone)
+		s, err := ParseSchedule("0 3 * * *")
+		require.Nil(t, err)
+		require.Equal(t, time.Date(2022, 12, 1, 3, 0, 0, 0, zone), s.Next(base), offset)
+		s, err = ParseSchedule("30 11 * * *")
+		require.Nil(t, err)
+		require.Equal(t, time.Date(2022, 11, 30, 11, 30, 0, 0, zone), s.Next(base))
+	}
+	if loc, err := time.LoadLocation("Asia/Kathmandu"); err == nil {
+		s, err := ParseSchedule("0 3 * * *")
+		require.Nil(t, err)
+		base := time.Date(2022, 11, 30, 10, 17, 42, 0, loc)
+		require.Equal(t, time.Date(2022, 12, 1, 3, 0, 0, 0, loc), s.Next(base))
+	}
+}
+
+func TestParseScheduleInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"@every 1ms",
+		"@every soon",
+		"@sometimes",
+	} {
+		_, err := ParseSchedule(spec)
+		require.NotNil(t, err, spec)
+	}
+}
@@ -0,0 +1,44 @@
+package cleaner
+
+import (
+	"clean_sw_dirty/ydmeta"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScope(t *testing.T) {
+	buckets := []*ydmeta.BucketInfo{
+		{Name: "logs-a", Type: "seaweedfs"},
+		{Name: "logs-b", Type: "other"},
+		{Name: "logs-tmp", Type: "seaweedfs"},
+		{Name: "media", Type: "seaweedfs"},
+	}
+
+	c := NewCleaner(nil, nil)
+	c.SetScope(nil, []string{"*-tmp"})
+	c.setBuckets(buckets)
+	require.False(t, c.scope.restricted())
+	require.True(t, c.inScope("logs-a"))
+	require.False(t, c.inScope("logs-tmp"))
+	// an unrestricted scan also cleans the buckets deleted since it started
+	require.True(t, c.inScope("gone"))
+
+	c.SetScope([]string{"logs-*"}, []string{"*-tmp"})
+	c.setBuckets(buckets)
+	require.True(t, c.scope.restricted())
+	require.Equal(t, []string{"logs-a", "logs-b"}, c.scopedBuckets())
+	require.False(t, c.inScope("logs-gone"))
+
+	c.SetBucketTypes([]string{"seaweedfs"})
+	c.setBuckets(buckets)
+	require.Equal(t, []string{"logs-a"}, c.scopedBuckets())
+
+	c.SetScope(nil, nil)
+	c.setBuckets(buckets)
+	require.Equal(t, []string{"logs-a", "logs-tmp", "media"}, c.scopedBuckets())
+
+	c.SetBucketTypes(nil)
+	c.setBuckets(buckets)
+	require.False(t, c.scope.restricted())
+}
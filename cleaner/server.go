@@ -0,0 +1,96 @@
+package cleaner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// NewAdminHandler exposes the daemon over HTTP:
+//
+//	POST /scan          start a scan
+//	POST /scan/cancel   cancel the running scan
+//	GET  /report        report of the last finished scan
+//	GET  /progress      counters of the running scan
+//	GET  /limits        current rate limits
+//	PUT  /limits        replace the rate limits, effective immediately
+//
+// Scans started through the API are bound to ctx, which should be the
+// daemon lifetime rather than the request's. throttle may be nil, in which
+// case /limits is not served.
+func NewAdminHandler(ctx context.Context, d *Daemon, throttle *Throttle) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/scan", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		if err := d.Trigger(ctx); err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, d.Progress())
+	})
+
+	mux.HandleFunc("/scan/cancel", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		if err := d.Cancel(); err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, d.Progress())
+	})
+
+	mux.HandleFunc("/report", func(w http.ResponseWriter, r *http.Request) {
+		report := d.LatestReport()
+		if report == nil {
+			writeError(w, http.StatusNotFound, errors.New("no scan has finished yet"))
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	})
+
+	mux.HandleFunc("/progress", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, d.Progress())
+	})
+
+	if throttle != nil {
+		mux.HandleFunc("/limits", func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodGet:
+			case http.MethodPut:
+				limits := Limits{}
+				if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+					writeError(w, http.StatusBadRequest, err)
+					return
+				}
+				if err := limits.Validate(); err != nil {
+					writeError(w, http.StatusBadRequest, err)
+					return
+				}
+				throttle.SetLimits(limits)
+			default:
+				writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+				return
+			}
+			writeJSON(w, http.StatusOK, throttle.Limits())
+		})
+	}
+
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
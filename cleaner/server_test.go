@@ -0,0 +1,128 @@
+package cleaner
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// blockingScanner runs until its context is canceled or release is closed.
+type blockingScanner struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingScanner) Scan(ctx context.Context) (*Report, error) {
+	r := &Report{StartTime: time.Now()}
+	s.started <- struct{}{}
+	var err error
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-s.release:
+		r.OrphanCount = 3
+	}
+	r.finish(err)
+	return r, err
+}
+
+func (s *blockingScanner) Progress() Progress {
+	return Progress{Phase: PhaseMultiparts}
+}
+
+func doRequest(t *testing.T, h http.Handler, method, path string) *httptest.ResponseRecorder {
+	return doRequestWithBody(t, h, method, path, "")
+}
+
+func doRequestWithBody(t *testing.T, h http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return rec
+}
+
+func TestAdminHandler(t *testing.T) {
+	s := &blockingScanner{started: make(chan struct{}, 1), release: make(chan struct{})}
+	d := NewDaemon(s, nil)
+	h := NewAdminHandler(context.Background(), d, nil)
+
+	require.Equal(t, http.StatusNotFound, doRequest(t, h, http.MethodGet, "/report").Code)
+	require.Equal(t, http.StatusConflict, doRequest(t, h, http.MethodPost, "/scan/cancel").Code)
+	require.Equal(t, http.StatusMethodNotAllowed, doRequest(t, h, http.MethodGet, "/scan").Code)
+
+	// a canceled scan still produces a report
+	require.Equal(t, http.StatusAccepted, doRequest(t, h, http.MethodPost, "/scan").Code)
+	<-s.started
+	require.Equal(t, http.StatusConflict, doRequest(t, h, http.MethodPost, "/scan").Code)
+	require.Equal(t, http.StatusAccepted, doRequest(t, h, http.MethodPost, "/scan/cancel").Code)
+	d.Wait()
+
+	rec := doRequest(t, h, http.MethodGet, "/report")
+	require.Equal(t, http.StatusOK, rec.Code)
+	report := &Report{}
+	require.Nil(t, json.Unmarshal(rec.Body.Bytes(), report))
+	require.True(t, report.Canceled)
+
+	// a finished scan replaces it
+	require.Equal(t, http.StatusAccepted, doRequest(t, h, http.MethodPost, "/scan").Code)
+	<-s.started
+	close(s.release)
+	d.Wait()
+
+	rec = doRequest(t, h, http.MethodGet, "/report")
+	require.Equal(t, http.StatusOK, rec.Code)
+	report = &Report{}
+	require.Nil(t, json.Unmarshal(rec.Body.Bytes(), report))
+	require.False(t, report.Canceled)
+	require.Equal(t, int64(3), report.OrphanCount)
+
+	rec = doRequest(t, h, http.MethodGet, "/progress")
+	require.Equal(t, http.StatusOK, rec.Code)
+	progress := Progress{}
+	require.Nil(t, json.Unmarshal(rec.Body.Bytes(), &progress))
+	require.Equal(t, PhaseMultiparts, progress.Phase)
+}
+
+func TestDaemonRunStopsScan(t *testing.T) {
+	s := &blockingScanner{started: make(chan struct{}, 1), release: make(chan struct{})}
+	d := NewDaemon(s, everySchedule{interval: 10 * time.Millisecond})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		d.Run(ctx)
+		close(done)
+	}()
+
+	<-s.started
+	cancel()
+	<-done
+	require.NotNil(t, d.LatestReport())
+	require.True(t, d.LatestReport().Canceled)
+}
+
+func TestAdminLimits(t *testing.T) {
+	throttle := NewThrottle(Limits{ScanKeysPerSecond: 100})
+	h := NewAdminHandler(context.Background(), NewDaemon(&blockingScanner{}, nil), throttle)
+
+	rec := doRequest(t, h, http.MethodGet, "/limits")
+	require.Equal(t, http.StatusOK, rec.Code)
+	limits := Limits{}
+	require.Nil(t, json.Unmarshal(rec.Body.Bytes(), &limits))
+	require.Equal(t, float64(100), limits.ScanKeysPerSecond)
+
+	rec = doRequestWithBody(t, h, http.MethodPut, "/limits", `{"swfsDeletesPerSecond":5,"autoBackoff":true}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, Limits{SwfsDeletesPerSecond: 5, AutoBackoff: true}, throttle.Limits())
+	require.Equal(t, float64(5), throttle.swfsDeletes.Rate())
+	require.Equal(t, float64(0), throttle.scanKeys.Rate())
+
+	rec = doRequestWithBody(t, h, http.MethodPut, "/limits", `{"tikvTxnsPerSecond":-1}`)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Equal(t, http.StatusMethodNotAllowed, doRequest(t, h, http.MethodPost, "/limits").Code)
+}
@@ -0,0 +1,282 @@
+package cleaner
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	minBackoff = 100 * time.Millisecond
+	maxBackoff = 30 * time.Second
+)
+
+// Limiter is a token bucket whose rate can be changed while it is in use.
+// A rate of zero or less means unlimited. Requests larger than the bucket
+// are admitted by going into debt, which later callers pay off.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func NewLimiter(rate float64) *Limiter {
+	l := &Limiter{}
+	l.SetRate(rate)
+	return l
+}
+
+func (l *Limiter) SetRate(rate float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = rate
+	l.tokens = l.burst()
+	l.last = time.Now()
+}
+
+func (l *Limiter) Rate() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// burst is one second worth of tokens.
+func (l *Limiter) burst() float64 {
+	if l.rate < 1 {
+		return 1
+	}
+	return l.rate
+}
+
+// reserve takes n tokens and returns how long the caller must wait for them.
+func (l *Limiter) reserve(n float64) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if b := l.burst(); l.tokens > b {
+		l.tokens = b
+	}
+	l.last = now
+	l.tokens -= n
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// WaitN blocks until n tokens are available or ctx is done.
+func (l *Limiter) WaitN(ctx context.Context, n int64) error {
+	if l == nil {
+		return nil
+	}
+	wait := l.reserve(float64(n))
+	if wait <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Limits bounds the load a scan puts on TiKV and SeaweedFS. Zero means
+// unlimited.
+type Limits struct {
+	ScanKeysPerSecond    float64 `json:"scanKeysPerSecond" yaml:"scanKeysPerSecond"`
+	TikvTxnsPerSecond    float64 `json:"tikvTxnsPerSecond" yaml:"tikvTxnsPerSecond"`
+	SwfsDeletesPerSecond float64 `json:"swfsDeletesPerSecond" yaml:"swfsDeletesPerSecond"`
+	SwfsBytesPerSecond   float64 `json:"swfsBytesPerSecond" yaml:"swfsBytesPerSecond"`
+	// AutoBackoff pauses the scan, for exponentially longer periods, while
+	// SeaweedFS deletes fail, TiKV transactions fail or take longer than
+	// SlowTxnMs, or scan reads take longer than SlowTxnMs.
+	AutoBackoff bool  `json:"autoBackoff" yaml:"autoBackoff"`
+	SlowTxnMs   int64 `json:"slowTxnMs" yaml:"slowTxnMs"`
+}
+
+func (l Limits) Validate() error {
+	if l.ScanKeysPerSecond < 0 || l.TikvTxnsPerSecond < 0 ||
+		l.SwfsDeletesPerSecond < 0 || l.SwfsBytesPerSecond < 0 {
+		return errors.New("rate limits must not be negative")
+	}
+	if l.SlowTxnMs < 0 {
+		return errors.New("slowTxnMs must not be negative")
+	}
+	return nil
+}
+
+// Throttle applies Limits to a scan. The limits may be changed at any time
+// and take effect for the next request.
+type Throttle struct {
+	scanKeys    *Limiter
+	tikvTxns    *Limiter
+	swfsDeletes *Limiter
+	swfsBytes   *Limiter
+
+	mu       sync.Mutex
+	limits   Limits
+	failures int
+	// slowReads counts the slow scan reads since lastSlowRead was less than
+	// maxBackoff before the next one.
+	slowReads    int
+	lastSlowRead time.Time
+}
+
+func NewThrottle(limits Limits) *Throttle {
+	t := &Throttle{
+		scanKeys:    NewLimiter(0),
+		tikvTxns:    NewLimiter(0),
+		swfsDeletes: NewLimiter(0),
+		swfsBytes:   NewLimiter(0),
+	}
+	t.SetLimits(limits)
+	return t
+}
+
+func (t *Throttle) SetLimits(limits Limits) {
+	t.mu.Lock()
+	t.limits = limits
+	if !limits.AutoBackoff {
+		t.failures = 0
+		t.slowReads = 0
+	}
+	t.mu.Unlock()
+	t.scanKeys.SetRate(limits.ScanKeysPerSecond)
+	t.tikvTxns.SetRate(limits.TikvTxnsPerSecond)
+	t.swfsDeletes.SetRate(limits.SwfsDeletesPerSecond)
+	t.swfsBytes.SetRate(limits.SwfsBytesPerSecond)
+}
+
+func (t *Throttle) Limits() Limits {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.limits
+}
+
+func (t *Throttle) scanKey(ctx context.Context) error {
+	if t == nil {
+		return ctx.Err()
+	}
+	if err := t.backoff(ctx); err != nil {
+		return err
+	}
+	return t.scanKeys.WaitN(ctx, 1)
+}
+
+// scanRead runs next, which moves a scan to its next key, and feeds its
+// latency to the backoff, so that scans that only read back off as well.
+func (t *Throttle) scanRead(next func() bool) bool {
+	if t == nil {
+		return next()
+	}
+	start := time.Now()
+	ok := next()
+	t.observeRead(start)
+	return ok
+}
+
+// observeRead counts the TiKV read started at start as slow when it took
+// longer than SlowTxnMs. Most reads of an iterator are served from the batch
+// it holds, so a fast read does not end the backoff the way a fast
+// transaction does: slow reads are only forgotten once none has been seen
+// for maxBackoff.
+func (t *Throttle) observeRead(start time.Time) {
+	if t == nil {
+		return
+	}
+	elapsed := time.Since(start)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	slow := time.Duration(t.limits.SlowTxnMs) * time.Millisecond
+	if !t.limits.AutoBackoff || slow == 0 || elapsed <= slow {
+		return
+	}
+	if time.Since(t.lastSlowRead) > maxBackoff {
+		t.slowReads = 0
+	}
+	t.slowReads++
+	t.lastSlowRead = time.Now()
+}
+
+// tikvTxn runs fn as one rate limited TiKV transaction.
+func (t *Throttle) tikvTxn(ctx context.Context, fn func() error) error {
+	if t == nil {
+		return fn()
+	}
+	if err := t.backoff(ctx); err != nil {
+		return err
+	}
+	if err := t.tikvTxns.WaitN(ctx, 1); err != nil {
+		return err
+	}
+	start := time.Now()
+	err := fn()
+	slow := time.Duration(t.Limits().SlowTxnMs) * time.Millisecond
+	t.observe(err == nil && (slow == 0 || time.Since(start) <= slow))
+	return err
+}
+
+// swfsDelete runs fn as one rate limited SeaweedFS delete of size bytes.
+func (t *Throttle) swfsDelete(ctx context.Context, size int64, fn func() error) error {
+	if t == nil {
+		return fn()
+	}
+	if err := t.backoff(ctx); err != nil {
+		return err
+	}
+	if err := t.swfsDeletes.WaitN(ctx, 1); err != nil {
+		return err
+	}
+	if err := t.swfsBytes.WaitN(ctx, size); err != nil {
+		return err
+	}
+	err := fn()
+	t.observe(err == nil)
+	return err
+}
+
+func (t *Throttle) observe(ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if ok {
+		t.failures = 0
+	} else if t.limits.AutoBackoff {
+		t.failures++
+	}
+}
+
+func (t *Throttle) backoff(ctx context.Context) error {
+	t.mu.Lock()
+	failures := t.failures
+	if t.slowReads > failures && time.Since(t.lastSlowRead) <= maxBackoff {
+		failures = t.slowReads
+	}
+	t.mu.Unlock()
+	if failures == 0 {
+		return nil
+	}
+	wait := minBackoff
+	for i := 1; i < failures && wait < maxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxBackoff {
+		wait = maxBackoff
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,90 @@
+package cleaner
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiter(t *testing.T) {
+	ctx := context.Background()
+
+	// unlimited never waits
+	l := NewLimiter(0)
+	start := time.Now()
+	for i := 0; i < 10000; i++ {
+		require.Nil(t, l.WaitN(ctx, 1))
+	}
+	require.Less(t, int64(time.Since(start)), int64(100*time.Millisecond))
+
+	// 50/s: one second of burst, then 10 more tokens take ~200ms
+	l.SetRate(50)
+	start = time.Now()
+	for i := 0; i < 60; i++ {
+		require.Nil(t, l.WaitN(ctx, 1))
+	}
+	elapsed := time.Since(start)
+	require.Greater(t, int64(elapsed), int64(150*time.Millisecond))
+	require.Less(t, int64(elapsed), int64(time.Second))
+
+	// a request larger than the bucket goes into debt and honours ctx
+	l.SetRate(10)
+	require.Nil(t, l.WaitN(ctx, 10))
+	cctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	require.True(t, errors.Is(l.WaitN(cctx, 100), context.DeadlineExceeded))
+}
+
+func TestThrottleBackoff(t *testing.T) {
+	ctx := context.Background()
+	fail := errors.New("fail")
+
+	th := NewThrottle(Limits{})
+	require.Equal(t, fail, th.swfsDelete(ctx, 1, func() error { return fail }))
+	require.Equal(t, 0, th.failures)
+
+	th.SetLimits(Limits{AutoBackoff: true})
+	require.Equal(t, fail, th.swfsDelete(ctx, 1, func() error { return fail }))
+	require.Equal(t, fail, th.tikvTxn(ctx, func() error { return fail }))
+	require.Equal(t, 2, th.failures)
+
+	start := time.Now()
+	require.Nil(t, th.scanKey(ctx))
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(2*minBackoff))
+
+	require.Nil(t, th.swfsDelete(ctx, 1, func() error { return nil }))
+	require.Equal(t, 0, th.failures)
+}
+
+func TestThrottleReadBackoff(t *testing.T) {
+	ctx := context.Background()
+	slowRead := func() bool {
+		time.Sleep(2 * time.Millisecond)
+		return true
+	}
+
+	th := NewThrottle(Limits{AutoBackoff: true, SlowTxnMs: 1})
+	require.True(t, th.scanRead(slowRead))
+	require.True(t, th.scanRead(slowRead))
+	require.Equal(t, 2, th.slowReads)
+	// a read served from the batch of an iterator does not end the backoff
+	require.False(t, th.scanRead(func() bool { return false }))
+	require.Equal(t, 2, th.slowReads)
+
+	start := time.Now()
+	require.Nil(t, th.scanKey(ctx))
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(2*minBackoff))
+
+	// slow reads are forgotten once none has been seen for maxBackoff
+	th.lastSlowRead = time.Now().Add(-2 * maxBackoff)
+	start = time.Now()
+	require.Nil(t, th.scanKey(ctx))
+	require.Less(t, int64(time.Since(start)), int64(minBackoff))
+
+	th.SetLimits(Limits{SlowTxnMs: 1})
+	require.True(t, th.scanRead(slowRead))
+	require.Equal(t, 0, th.slowReads)
+}
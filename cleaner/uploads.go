@@ -0,0 +1,192 @@
+package cleaner
+
+import (
+	"clean_sw_dirty/ydmeta"
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	PhaseUploads = "uploads"
+
+	// DefaultStaleUploadAge is the age from which an upload in progress is
+	// reported as stale.
+	DefaultStaleUploadAge = 7 * 24 * time.Hour
+
+	// maxReportedStaleUploads bounds StaleUploads in the report; the counts
+	// cover every stale upload.
+	maxReportedStaleUploads = 100
+)
+
+// StaleUpload is an upload that has been in progress for too long.
+type StaleUpload struct {
+	Bucket       string    `json:"bucket"`
+	Object       string    `json:"object"`
+	UploadID     string    `json:"uploadID"`
+	Initiated    time.Time `json:"initiated"`
+	LastModified time.Time `json:"lastModified"`
+	PartCount    int       `json:"partCount"`
+	Size         int64     `json:"size"`
+	Aborted      bool      `json:"aborted"`
+}
+
+// SetStaleUploadAge sets the age from which uploads in progress are reported
+// as stale. Zero disables the report.
+func (c *Cleaner) SetStaleUploadAge(d time.Duration) {
+	c.staleUploadAge = d
+}
+
+// SetAbortIncompleteUploadsAfter makes execute mode abort the uploads whose
+// newest part is older than d, like S3's AbortIncompleteMultipartUpload
+// rule. A bucket overrides d with its own rule in days, see
+// ydmeta.BucketInfo.AbortIncompleteUploadDays. Zero disables the rule.
+func (c *Cleaner) SetAbortIncompleteUploadsAfter(d time.Duration) {
+	c.abortAfter = d
+}
+
+func (c *Cleaner) bucketAbortAfter(b *ydmeta.BucketInfo) time.Duration {
+	if days, ok := b.AbortIncompleteUploadDays(); ok {
+		if days <= 0 {
+			return 0
+		}
+		return time.Duration(days) * 24 * time.Hour
+	}
+	return c.abortAfter
+}
+
+// scanUploads goes through the uploads in progress of the buckets in scope.
+// It reports the ones initiated at least staleUploadAge before the scan
+// started, oldest first, and aborts the ones idle for longer than the abort
+// rule of their bucket, unless it is protected.
+func (c *Cleaner) scanUploads(ctx context.Context, lease *ydmeta.Lease, report *Report) error {
+	c.progress.phase.Store(PhaseUploads)
+	buckets, err := c.bm.ListBuckets()
+	if err != nil {
+		return err
+	}
+	for _, b := range buckets {
+		if !c.inScope(b.Name) {
+			continue
+		}
+		abortAfter := c.bucketAbortAfter(b)
+		if c.staleUploadAge <= 0 && abortAfter <= 0 {
+			continue
+		}
+		// the uploads are read from their records rather than the upload
+		// index, which misses the ones written by older versions
+		start := time.Now()
+		uploads, err := c.om.ListBucketUploads(b.Name)
+		c.throttle.observeRead(start)
+		if err != nil {
+			return err
+		}
+		for _, u := range uploads {
+			if err = c.throttle.scanKey(ctx); err != nil {
+				return err
+			}
+			atomic.AddInt64(&c.progress.uploadsScanned, 1)
+
+			stale := StaleUpload{
+				Bucket:       u.Bucket,
+				Object:       u.Object,
+				UploadID:     u.UploadID,
+				Initiated:    u.Initiated,
+				LastModified: u.LastModified,
+				PartCount:    u.PartCount,
+				Size:         u.Size,
+			}
+			expired := abortAfter > 0 && report.StartTime.Sub(u.LastModified) >= abortAfter
+			if expired && c.isProtected(u.Bucket) {
+				report.ProtectedSkipped++
+			} else if expired {
+				report.ExpiredUploadCount++
+				report.ExpiredUploadSize += u.Size
+				if c.execute {
+					idleSince := report.StartTime.Add(-abortAfter)
+					if stale.Aborted, err = c.abortUpload(ctx, lease, u, idleSince, report); err != nil {
+						return err
+					}
+				}
+			}
+			if c.staleUploadAge > 0 && report.StartTime.Sub(u.Initiated) >= c.staleUploadAge {
+				report.addStaleUpload(stale)
+			}
+		}
+	}
+	return nil
+}
+
+// abortUpload aborts u unless it was modified after idleSince, then reclaims
+// its parts like orphans. Parts whose data could not be deleted are left
+// without an upload record, so the next scan reclaims them.
+func (c *Cleaner) abortUpload(ctx context.Context, lease *ydmeta.Lease, u ydmeta.MultipartUploadInfo,
+	idleSince time.Time, report *Report) (bool, error) {
+	// the abort is recorded before it commits, like every other action
+	record := func(value []byte) error {
+		return c.audit(ctx, &ydmeta.AuditEntry{
+			Action:   AuditAbort,
+			Bucket:   u.Bucket,
+			Object:   u.Object,
+			UploadID: u.UploadID,
+			Key:      []byte(ydmeta.GenMultipartKey(u.Bucket, u.UploadID)),
+			Value:    value,
+			Reason:   "incomplete upload idle since " + idleSince.Format(time.RFC3339),
+		})
+	}
+	var parts []ydmeta.MultipartPart
+	err := c.throttle.tikvTxn(ctx, func() (err error) {
+		parts, err = c.om.AbortIdleMultipartUpload(lease, u.Bucket, u.UploadID, idleSince, record)
+		return err
+	})
+	if errors.Is(err, ydmeta.ErrUploadActive) || errors.Is(err, ydmeta.ErrNoSuchUpload) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	log.Printf("aborted incomplete upload %s of %s/%s, initiated %s, last modified %s, %d parts",
+		u.UploadID, u.Bucket, u.Object, u.Initiated.Format(time.RFC3339),
+		u.LastModified.Format(time.RFC3339), len(parts))
+	report.AbortedUploadCount++
+
+	batch := make([]orphan, 0, len(parts))
+	for _, p := range parts {
+		meta := p.MultipartPartMetaV1
+		batch = append(batch, orphan{
+			key:   p.Key,
+			value: p.Value,
+			meta:  &meta,
+		})
+	}
+	for len(batch) > 0 {
+		n := len(batch)
+		if n > c.batchSize {
+			n = c.batchSize
+		}
+		if err = c.reclaimOrphans(ctx, lease, batch[:n], reasonAbortedUpload, report); err != nil {
+			return true, err
+		}
+		batch = batch[n:]
+	}
+	return true, nil
+}
+
+func (r *Report) addStaleUpload(u StaleUpload) {
+	r.StaleUploadCount++
+	r.StaleUploadSize += u.Size
+	i := sort.Search(len(r.StaleUploads), func(i int) bool {
+		return r.StaleUploads[i].Initiated.After(u.Initiated)
+	})
+	if i == maxReportedStaleUploads {
+		return
+	}
+	if len(r.StaleUploads) < maxReportedStaleUploads {
+		r.StaleUploads = append(r.StaleUploads, StaleUpload{})
+	}
+	copy(r.StaleUploads[i+1:], r.StaleUploads[i:])
+	r.StaleUploads[i] = u
+}
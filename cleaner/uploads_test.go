@@ -0,0 +1,64 @@
+package cleaner
+
+import (
+	"clean_sw_dirty/ydmeta"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddStaleUpload(t *testing.T) {
+	start := time.Now()
+	r := &Report{}
+	for i := 0; i < maxReportedStaleUploads+10; i++ {
+		r.addStaleUpload(StaleUpload{
+			UploadID:  string(rune('a' + i%26)),
+			Initiated: start.Add(-time.Duration(i%37) * time.Hour),
+			Size:      1,
+		})
+	}
+	require.Equal(t, int64(maxReportedStaleUploads+10), r.StaleUploadCount)
+	require.Equal(t, int64(maxReportedStaleUploads+10), r.StaleUploadSize)
+	require.Equal(t, maxReportedStaleUploads, len(r.StaleUploads))
+	require.Equal(t, start.Add(-36*time.Hour), r.StaleUploads[0].Initiated)
+	for i := 1; i < len(r.StaleUploads); i++ {
+		require.False(t, r.StaleUploads[i].Initiated.Before(r.StaleUploads[i-1].Initiated))
+	}
+}
+
+func TestBucketAbortAfter(t *testing.T) {
+	c := NewCleaner(nil, nil)
+	c.SetAbortIncompleteUploadsAfter(48 * time.Hour)
+
+	b := &ydmeta.BucketInfo{Name: "a"}
+	require.Equal(t, 48*time.Hour, c.bucketAbortAfter(b))
+
+	b.ExtFields = map[string]interface{}{ydmeta.ExtAbortIncompleteUploadDays: float64(7)}
+	require.Equal(t, 7*24*time.Hour, c.bucketAbortAfter(b))
+
+	b.ExtFields[ydmeta.ExtAbortIncompleteUploadDays] = float64(0)
+	require.Equal(t, time.Duration(0), c.bucketAbortAfter(b))
+}
+
+func TestInProgress(t *testing.T) {
+	c := NewCleaner(nil, nil)
+	start := time.Now()
+	uploads := map[ydmeta.PartKey]struct{}{{Bucket: "b", UploadID: "u1"}: {}}
+	old := &ydmeta.MultipartPartMetaV1{ModTime: start.Add(-2 * DefaultGracePeriod)}
+	recent := &ydmeta.MultipartPartMetaV1{ModTime: start.Add(-time.Minute)}
+
+	// a part of an upload whose record is seen
+	require.True(t, c.inProgress(ydmeta.PartKey{Bucket: "b", UploadID: "u1", PartNumber: 1}, old, uploads, start))
+	// a part written within the grace period, record or not
+	require.True(t, c.inProgress(ydmeta.PartKey{Bucket: "b", UploadID: "u2", PartNumber: 1}, recent, uploads, start))
+	require.False(t, c.inProgress(ydmeta.PartKey{Bucket: "b", UploadID: "u2", PartNumber: 1}, old, uploads, start))
+	// a part of the same upload ID in another bucket
+	require.False(t, c.inProgress(ydmeta.PartKey{Bucket: "c", UploadID: "u1", PartNumber: 1}, old, uploads, start))
+
+	c.SetGracePeriod(0)
+	require.False(t, c.inProgress(ydmeta.PartKey{Bucket: "b", UploadID: "u2", PartNumber: 1}, recent, uploads, start))
+	// a part written since the scan started, even without a grace period
+	later := &ydmeta.MultipartPartMetaV1{ModTime: start.Add(time.Second)}
+	require.True(t, c.inProgress(ydmeta.PartKey{Bucket: "b", UploadID: "u2", PartNumber: 1}, later, uploads, start))
+}
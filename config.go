@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"clean_sw_dirty/cleaner"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the cleaner configuration, read from a YAML file and overridden
+// by command line flags.
+type Config struct {
+	PD                          []string       `yaml:"pd"`
+	Master                      string         `yaml:"master"`
+	TLS                         TLSConfig      `yaml:"tls"`
+	Buckets                     BucketsConfig  `yaml:"buckets"`
+	Execute                     bool           `yaml:"execute"`
+	Concurrency                 int            `yaml:"concurrency"`
+	GracePeriod                 time.Duration  `yaml:"gracePeriod"`
+	StaleUploadAge              time.Duration  `yaml:"staleUploadAge"`
+	AbortIncompleteUploadsAfter time.Duration  `yaml:"abortIncompleteUploadsAfter"`
+	DeletedObjectRetention      time.Duration  `yaml:"deletedObjectRetention"`
+	QuarantineWindow            time.Duration  `yaml:"quarantineWindow"`
+	Limits                      cleaner.Limits `yaml:"limits"`
+	Serve                       ServeConfig    `yaml:"serve"`
+	Output                      OutputConfig   `yaml:"output"`
+}
+
+// TLSConfig secures the connections to PD and TiKV.
+type TLSConfig struct {
+	CA   string `yaml:"ca"`
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// VerifyCN is only checked on the etcd connection of PD.
+	VerifyCN []string `yaml:"verifyCN"`
+}
+
+type BucketsConfig struct {
+	// Include and Exclude hold bucket names or path.Match patterns.
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+	// Types limits the scans to the buckets of these types.
+	Types []string `yaml:"types"`
+	// Protected buckets are scanned but never cleaned, like the buckets
+	// flagged protected in their extFields.
+	Protected []string `yaml:"protected"`
+}
+
+type ServeConfig struct {
+	Listen   string `yaml:"listen"`
+	Schedule string `yaml:"schedule"`
+}
+
+type OutputConfig struct {
+	// Report is a file the JSON report of every scan is written to.
+	Report string `yaml:"report"`
+	// Log is a file the log is appended to instead of stderr.
+	Log string `yaml:"log"`
+	// Audit is a file every destructive action is appended to, one JSON
+	// object per line, besides the audit trail kept in TiKV.
+	Audit string `yaml:"audit"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Concurrency:            4,
+		GracePeriod:            cleaner.DefaultGracePeriod,
+		StaleUploadAge:         cleaner.DefaultStaleUploadAge,
+		DeletedObjectRetention: cleaner.DefaultDeletedObjectRetention,
+		QuarantineWindow:       cleaner.DefaultQuarantineWindow,
+		Serve: ServeConfig{
+			Listen:   defaultListen,
+			Schedule: defaultSchedule,
+		},
+	}
+}
+
+// loadConfig reads path over the defaults. An empty path yields the
+// defaults.
+func loadConfig(path string) (*Config, error) {
+	cfg := defaultConfig()
+	if path == "" {
+		return cfg, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err = dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("parse config %s: %s", path, err.Error())
+	}
+	return cfg, nil
+}
+
+// Validate reports every problem of the configuration at once.
+func (cfg *Config) Validate() error {
+	var errs []string
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+
+	if len(cfg.PD) == 0 {
+		fail("pd: at least one PD endpoint is required")
+	}
+	for _, addr := range cfg.PD {
+		if strings.TrimSpace(addr) == "" {
+			fail("pd: empty endpoint")
+		}
+	}
+	if cfg.Execute && cfg.Master == "" {
+		fail("master: the SeaweedFS master is required in execute mode")
+	}
+
+	if (cfg.TLS.Cert == "") != (cfg.TLS.Key == "") {
+		fail("tls: cert and key must be set together")
+	}
+	if cfg.TLS.Cert != "" && cfg.TLS.CA == "" {
+		fail("tls: ca is required when cert is set")
+	}
+	if len(cfg.TLS.VerifyCN) > 0 && cfg.TLS.CA == "" {
+		fail("tls: ca is required when verifyCN is set")
+	}
+	for _, f := range []struct{ name, path string }{
+		{"ca", cfg.TLS.CA}, {"cert", cfg.TLS.Cert}, {"key", cfg.TLS.Key},
+	} {
+		if f.path == "" {
+			continue
+		}
+		if _, err := os.Stat(f.path); err != nil {
+			fail("tls.%s: %s", f.name, err.Error())
+		}
+	}
+
+	exclude := make(map[string]struct{}, len(cfg.Buckets.Exclude))
+	for _, b := range cfg.Buckets.Exclude {
+		exclude[b] = struct{}{}
+	}
+	for _, b := range append(append([]string(nil), cfg.Buckets.Include...), cfg.Buckets.Exclude...) {
+		if _, err := path.Match(b, ""); err != nil {
+			fail("buckets: bad pattern %q", b)
+		}
+	}
+	for _, b := range cfg.Buckets.Include {
+		if _, ok := exclude[b]; ok {
+			fail("buckets: %q is both included and excluded", b)
+		}
+	}
+
+	if cfg.Concurrency < 1 {
+		fail("concurrency: must be at least 1")
+	}
+	if cfg.GracePeriod < 0 {
+		fail("gracePeriod: must not be negative")
+	}
+	if cfg.StaleUploadAge < 0 {
+		fail("staleUploadAge: must not be negative")
+	}
+	if cfg.AbortIncompleteUploadsAfter < 0 {
+		fail("abortIncompleteUploadsAfter: must not be negative")
+	}
+	if cfg.DeletedObjectRetention < 0 {
+		fail("deletedObjectRetention: must not be negative")
+	}
+	if cfg.QuarantineWindow < 0 {
+		fail("quarantineWindow: must not be negative")
+	}
+	if err := cfg.Limits.Validate(); err != nil {
+		fail("limits: %s", err.Error())
+	}
+	if _, err := cleaner.ParseSchedule(cfg.Serve.Schedule); err != nil {
+		fail("serve.schedule: %s", err.Error())
+	}
+	if cfg.Serve.Listen == "" {
+		fail("serve.listen: must not be empty")
+	}
+
+	if len(errs) > 0 {
+		return errors.New("invalid configuration:\n  " + strings.Join(errs, "\n  "))
+	}
+	return nil
+}
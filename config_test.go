@@ -0,0 +1,133 @@
+package main
+
+import (
+	"clean_sw_dirty/cleaner"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "cleaner.yaml")
+	require.Nil(t, ioutil.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	cfg, err := loadConfig("config.example.yaml")
+	require.Nil(t, err)
+	require.Nil(t, cfg.Validate())
+	require.Equal(t, []string{"127.0.0.1:2379"}, cfg.PD)
+
+	path := writeTestConfig(t, `
+pd: [pd-0:2379, pd-1:2379]
+master: master:9333
+execute: true
+buckets:
+  exclude: [archive, "tmp-*"]
+  types: [seaweedfs]
+  protected: [compliance]
+limits:
+  swfsDeletesPerSecond: 200
+staleUploadAge: 72h
+deletedObjectRetention: 720h
+quarantineWindow: 24h
+serve:
+  schedule: "30 3 * * *"
+`)
+	cfg, err = loadConfig(path)
+	require.Nil(t, err)
+	require.Nil(t, cfg.Validate())
+	require.Equal(t, []string{"archive", "tmp-*"}, cfg.Buckets.Exclude)
+	require.Equal(t, []string{"seaweedfs"}, cfg.Buckets.Types)
+	require.Equal(t, []string{"compliance"}, cfg.Buckets.Protected)
+	require.Equal(t, float64(200), cfg.Limits.SwfsDeletesPerSecond)
+	require.Equal(t, defaultListen, cfg.Serve.Listen)
+	require.Equal(t, 4, cfg.Concurrency)
+	require.Equal(t, 24*time.Hour, cfg.GracePeriod)
+	require.Equal(t, 72*time.Hour, cfg.StaleUploadAge)
+	require.Equal(t, 720*time.Hour, cfg.DeletedObjectRetention)
+	require.Equal(t, 24*time.Hour, cfg.QuarantineWindow)
+
+	_, err = loadConfig(writeTestConfig(t, "pd: [a]\nunknown: 1\n"))
+	require.NotNil(t, err)
+}
+
+func TestValidateConfig(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Execute = true
+	cfg.TLS.Cert = "/nonexistent/cert.pem"
+	cfg.Buckets.Include = []string{"a"}
+	cfg.Buckets.Exclude = []string{"a", "logs-["}
+	cfg.Concurrency = 0
+	cfg.GracePeriod = -time.Hour
+	cfg.StaleUploadAge = -time.Hour
+	cfg.AbortIncompleteUploadsAfter = -time.Hour
+	cfg.DeletedObjectRetention = -time.Hour
+	cfg.QuarantineWindow = -time.Hour
+	cfg.Limits.ScanKeysPerSecond = -1
+	cfg.Serve.Schedule = "every day"
+
+	err := cfg.Validate()
+	require.NotNil(t, err)
+	for _, msg := range []string{
+		"pd: at least one PD endpoint is required",
+		"master: the SeaweedFS master is required in execute mode",
+		"tls: cert and key must be set together",
+		"tls: ca is required when cert is set",
+		"tls.cert:",
+		`buckets: "a" is both included and excluded`,
+		`buckets: bad pattern "logs-["`,
+		"concurrency: must be at least 1",
+		"gracePeriod: must not be negative",
+		"staleUploadAge: must not be negative",
+		"abortIncompleteUploadsAfter: must not be negative",
+		"deletedObjectRetention: must not be negative",
+		"quarantineWindow: must not be negative",
+		"limits: rate limits must not be negative",
+		"serve.schedule:",
+	} {
+		require.Contains(t, err.Error(), msg)
+	}
+}
+
+func TestCommonFlagsOverrideConfig(t *testing.T) {
+	path := writeTestConfig(t, "pd: [pd-0:2379]\nconcurrency: 2\nbuckets:\n  include: [a]\n")
+
+	var common commonFlags
+	fs := newTestFlagSet(&common)
+	require.Nil(t, fs.Parse([]string{"-config", path, "-pd", "x:1, y:2", "-exclude", "b", "-type", "seaweedfs"}))
+	cfg, err := common.load(fs)
+	require.Nil(t, err)
+	require.Equal(t, []string{"x:1", "y:2"}, cfg.PD)
+	require.Equal(t, 2, cfg.Concurrency)
+	require.Equal(t, []string{"a"}, cfg.Buckets.Include)
+	require.Equal(t, []string{"b"}, cfg.Buckets.Exclude)
+	require.Equal(t, []string{"seaweedfs"}, cfg.Buckets.Types)
+	require.Equal(t, cleaner.DefaultGracePeriod, cfg.GracePeriod)
+
+	path = writeTestConfig(t, "pd: [pd-0:2379]\ngracePeriod: 36h\n")
+	common = commonFlags{}
+	fs = newTestFlagSet(&common)
+	require.Nil(t, fs.Parse([]string{"-config", path, "-grace-period", "2h"}))
+	cfg, err = common.load(fs)
+	require.Nil(t, err)
+	require.Equal(t, 2*time.Hour, cfg.GracePeriod)
+
+	common = commonFlags{}
+	fs = newTestFlagSet(&common)
+	require.Nil(t, fs.Parse([]string{"-config", path}))
+	cfg, err = common.load(fs)
+	require.Nil(t, err)
+	require.Equal(t, 36*time.Hour, cfg.GracePeriod)
+}
+
+func newTestFlagSet(common *commonFlags) *flag.FlagSet {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	common.register(fs)
+	return fs
+}
@@ -1,95 +1,624 @@
 package main
 
 import (
+	"clean_sw_dirty/cleaner"
+	"clean_sw_dirty/swfsclient"
 	"clean_sw_dirty/ydmeta"
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
+const (
+	defaultSchedule = "@daily"
+	defaultListen   = ":8080"
+)
+
+const usage = `usage: yds3-sw-manager <command> [flags]
+
+commands:
+  scan    scan once and print the report (default)
+  serve   scan on a schedule and serve the admin API until SIGTERM
+  migrate run the metadata migrations, all of them unless some are named
+  release put quarantined parts back
+  purge   delete the data of quarantined parts past the quarantine window
+  audit   show the destructive actions taken on a bucket, object or upload
+
+Run "yds3-sw-manager <command> -h" for the flags of a command.
+`
+
 func main() {
-	pd := os.Getenv("CLEANER_PD")
-	//master := os.Getenv("CLEANER_MASTER")
+	args := os.Args[1:]
+	command := "scan"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	var err error
+	switch command {
+	case "scan":
+		err = runScan(args)
+	case "serve":
+		err = runServe(args)
+	case "migrate":
+		err = runMigrate(args)
+	case "release":
+		err = runRelease(args)
+	case "purge":
+		err = runPurge(args)
+	case "audit":
+		err = runAudit(args)
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// stringList is a comma separated flag value.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = nil
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			*l = append(*l, s)
+		}
+	}
+	return nil
+}
+
+// commonFlags are shared by every command and override the config file.
+type commonFlags struct {
+	config      string
+	pd          stringList
+	master      string
+	execute     bool
+	include     stringList
+	exclude     stringList
+	types       stringList
+	gracePeriod time.Duration
+	concurrency int
+	report      string
+}
+
+func (f *commonFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.config, "config", "", "YAML config file")
+	fs.Var(&f.pd, "pd", "comma separated PD endpoints")
+	fs.StringVar(&f.master, "master", "", "SeaweedFS master address")
+	fs.BoolVar(&f.execute, "execute", false, "delete the orphans instead of only reporting them")
+	fs.Var(&f.include, "include", "comma separated buckets or bucket patterns to scan, all by default")
+	fs.Var(&f.exclude, "exclude", "comma separated buckets or bucket patterns to skip")
+	fs.Var(&f.types, "type", "comma separated bucket types to scan, such as seaweedfs, all by default")
+	fs.DurationVar(&f.gracePeriod, "grace-period", 0, "never delete parts written within this period")
+	fs.IntVar(&f.concurrency, "concurrency", 0, "parallel SeaweedFS deletions")
+	fs.StringVar(&f.report, "report", "", "file to write the JSON report to")
+}
 
-	bm, err := ydmeta.NewBucketMetaManager(pd)
+// load reads the config file and applies the flags that were set.
+func (f *commonFlags) load(fs *flag.FlagSet) (*Config, error) {
+	cfg, err := loadConfig(f.config)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	om, err := ydmeta.NewObjectMetaManager(pd)
+	fs.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "pd":
+			cfg.PD = f.pd
+		case "master":
+			cfg.Master = f.master
+		case "execute":
+			cfg.Execute = f.execute
+		case "include":
+			cfg.Buckets.Include = f.include
+		case "exclude":
+			cfg.Buckets.Exclude = f.exclude
+		case "type":
+			cfg.Buckets.Types = f.types
+		case "grace-period":
+			cfg.GracePeriod = f.gracePeriod
+		case "concurrency":
+			cfg.Concurrency = f.concurrency
+		case "report":
+			cfg.Output.Report = f.report
+		}
+	})
+	return cfg, nil
+}
+
+func runScan(args []string) error {
+	fs := flag.NewFlagSet("scan", flag.ExitOnError)
+	var common commonFlags
+	common.register(fs)
+	fs.Parse(args)
+
+	cfg, err := common.load(fs)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if err = cfg.Validate(); err != nil {
+		return err
 	}
-	//sc, err := swfsclient.NewSwfsClient(master,
-	//	&http.Client{Timeout: 5 * time.Minute}, 1024)
-	//if err != nil {
-	//	panic(err)
-	//}
 
-	buckets, err := bm.ListBuckets()
+	c, _, closeFn, err := setup(cfg)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	defer closeFn()
 
-	validMultipart := make(map[string]struct{})
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	for _, b := range buckets {
-		iter, err := om.ListBucketObjectsByIter(b.Name)
-		if err != nil {
-			panic(err)
+	report, scanErr := c.Scan(ctx)
+	if report != nil {
+		fmt.Println(report.String())
+		if err = writeReport(cfg.Output.Report, report); err != nil {
+			return err
+		}
+	}
+	return scanErr
+}
+
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	var common commonFlags
+	common.register(fs)
+	listen := fs.String("listen", "", "admin API address (default "+defaultListen+")")
+	schedule := fs.String("schedule", "", "cron expression or @every <duration> (default "+defaultSchedule+")")
+	fs.Parse(args)
+
+	cfg, err := common.load(fs)
+	if err != nil {
+		return err
+	}
+	if *listen != "" {
+		cfg.Serve.Listen = *listen
+	}
+	if *schedule != "" {
+		cfg.Serve.Schedule = *schedule
+	}
+	if err = cfg.Validate(); err != nil {
+		return err
+	}
+
+	c, throttle, closeFn, err := setup(cfg)
+	if err != nil {
+		return err
+	}
+	defer closeFn()
+
+	return serve(c, cfg, throttle, common.config)
+}
+
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	var common commonFlags
+	common.register(fs)
+	list := fs.Bool("list", false, "list the migrations and their progress")
+	batch := fs.Int("batch", ydmeta.DefaultMigrateBatch, "records migrated per transaction")
+	restart := fs.Bool("restart", false, "run the migrations again from the start")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: yds3-sw-manager migrate [flags] [migration...]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	cfg, err := common.load(fs)
+	if err != nil {
+		return err
+	}
+	if err = cfg.Validate(); err != nil {
+		return err
+	}
+	if *batch <= 0 {
+		return fmt.Errorf("batch must be positive")
+	}
+
+	var migrations []*ydmeta.Migration
+	for _, name := range fs.Args() {
+		mig, ok := ydmeta.LookupMigration(name)
+		if !ok {
+			return fmt.Errorf("unknown migration %q", name)
+		}
+		migrations = append(migrations, mig)
+	}
+	if len(migrations) == 0 {
+		migrations = ydmeta.Migrations()
+	}
+
+	store, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	om := store.Objects()
+
+	if *list {
+		for _, mig := range migrations {
+			status, err := om.MigrationStatus(mig.Name)
+			if err != nil {
+				return err
+			}
+			state := "pending"
+			if status.Done {
+				state = "done"
+			} else if !status.Updated.IsZero() {
+				state = "in progress"
+			}
+			fmt.Printf("%-24s %-11s scanned %d, migrated %d\n    %s\n",
+				mig.Name, state, status.Scanned, status.Migrated, mig.Description)
 		}
-		for iter.Valid() {
-			ob := iter.Value()
+		return nil
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-			if ob.Type == ydmeta.ObjectLargeType {
-				for i := 0; i < int(ob.PartTotal); i++ {
-					multiKey := ydmeta.GenMultipartKey(ob.Bucket, swfsMultipartDataName(ob.UploadID, i))
-					validMultipart[multiKey] = struct{}{}
-				}
+	// migrations move records, so they take the lease cleaner runs take
+	c := cleaner.NewCleaner(store.Buckets(), om)
+	c.SetLeaseOwner(leaseOwner())
+	for _, mig := range migrations {
+		if *restart {
+			if err = om.ResetMigration(mig.Name); err != nil {
+				return err
 			}
+		}
+		var lastLog time.Time
+		status, err := c.Migrate(ctx, mig, *batch, func(status *ydmeta.MigrationStatus) {
+			if time.Since(lastLog) >= 10*time.Second {
+				lastLog = time.Now()
+				log.Printf("migration %s: scanned %d, migrated %d", mig.Name, status.Scanned, status.Migrated)
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("migration %s: %w", mig.Name, err)
+		}
+		log.Printf("migration %s done: scanned %d, migrated %d", mig.Name, status.Scanned, status.Migrated)
+	}
+	return nil
+}
+
+// quarantineFlags select quarantined parts.
+type quarantineFlags struct {
+	bucket   string
+	uploadID string
+	list     bool
+}
+
+func (f *quarantineFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.bucket, "bucket", "", "only the parts of this bucket")
+	fs.StringVar(&f.uploadID, "upload", "", "only the parts of this upload")
+	fs.BoolVar(&f.list, "list", false, "list the selected parts")
+}
+
+func (f *quarantineFlags) filter() cleaner.QuarantineFilter {
+	return cleaner.QuarantineFilter{Bucket: f.bucket, UploadID: f.uploadID}
+}
+
+// listQuarantine prints the parts f selects, each one when list is set.
+func listQuarantine(ctx context.Context, c *cleaner.Cleaner, f cleaner.QuarantineFilter, list bool) error {
+	var count, size int64
+	err := c.ListQuarantine(ctx, f, func(p cleaner.QuarantinedPart) error {
+		count++
+		size += p.Meta.Size
+		if list {
+			fmt.Printf("%s %s/%s part %d, %d bytes, %s\n", p.Time.Format(time.RFC3339),
+				p.Part.Bucket, p.Part.UploadID, p.Part.PartNumber, p.Meta.Size, p.Reason)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d quarantined parts selected, %.2fGB\n", count, float64(size)/1024/1024/1024)
+	return nil
+}
+
+func runRelease(args []string) error {
+	fs := flag.NewFlagSet("release", flag.ExitOnError)
+	var common commonFlags
+	common.register(fs)
+	var qf quarantineFlags
+	qf.register(fs)
+	fs.Parse(args)
+
+	cfg, err := common.load(fs)
+	if err != nil {
+		return err
+	}
+	if err = cfg.Validate(); err != nil {
+		return err
+	}
+
+	c, _, closeFn, err := setup(cfg)
+	if err != nil {
+		return err
+	}
+	defer closeFn()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if qf.list || !cfg.Execute {
+		return listQuarantine(ctx, c, qf.filter(), qf.list)
+	}
+	released, err := c.Release(ctx, qf.filter())
+	fmt.Printf("released %d parts\n", released)
+	return err
+}
+
+func runPurge(args []string) error {
+	fs := flag.NewFlagSet("purge", flag.ExitOnError)
+	var common commonFlags
+	common.register(fs)
+	var qf quarantineFlags
+	qf.register(fs)
+	all := fs.Bool("all", false, "also purge the parts still within the quarantine window")
+	fs.Parse(args)
+
+	cfg, err := common.load(fs)
+	if err != nil {
+		return err
+	}
+	if err = cfg.Validate(); err != nil {
+		return err
+	}
+
+	c, _, closeFn, err := setup(cfg)
+	if err != nil {
+		return err
+	}
+	defer closeFn()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	f := qf.filter()
+	if !*all {
+		f.Before = time.Now().Add(-cfg.QuarantineWindow)
+	}
+	if qf.list || !cfg.Execute {
+		return listQuarantine(ctx, c, f, qf.list)
+	}
+	report, err := c.Purge(ctx, f)
+	if report != nil {
+		fmt.Printf("purged %d parts (%.2fGB), failed %d\n",
+			report.ReclaimedCount, float64(report.ReclaimedSize)/1024/1024/1024, report.FailedCount)
+	}
+	return err
+}
+
+func runAudit(args []string) error {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	var common commonFlags
+	common.register(fs)
+	var q cleaner.AuditQuery
+	fs.StringVar(&q.Bucket, "bucket", "", "only the actions on this bucket")
+	fs.StringVar(&q.Object, "object", "", "only the actions on this object and the uploads it was made of")
+	fs.StringVar(&q.UploadID, "upload", "", "only the actions on this upload")
+	fs.StringVar(&q.RunID, "run", "", "only the actions of this run")
+	since := fs.Duration("since", 0, "only the actions of this last period, all by default")
+	asJSON := fs.Bool("json", false, "print the entries as JSON lines")
+	fs.Parse(args)
+
+	cfg, err := common.load(fs)
+	if err != nil {
+		return err
+	}
+	cfg.Execute = false
+	if err = cfg.Validate(); err != nil {
+		return err
+	}
+	if q.Object != "" && q.Bucket == "" {
+		return fmt.Errorf("-object requires -bucket")
+	}
+	if *since > 0 {
+		q.Since = time.Now().Add(-*since)
+	}
+
+	c, _, closeFn, err := setup(cfg)
+	if err != nil {
+		return err
+	}
+	defer closeFn()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-			iter.Next()
+	enc := json.NewEncoder(os.Stdout)
+	return c.QueryAudit(ctx, q, func(e *ydmeta.AuditEntry) error {
+		if *asJSON {
+			return enc.Encode(e)
+		}
+		target := e.Bucket + "/" + e.Object
+		if pk, ok := ydmeta.ParsePartKey(string(e.Key)); ok {
+			target = fmt.Sprintf("%s/%s part %d", pk.Bucket, pk.UploadID, pk.PartNumber)
+		} else if e.UploadID != "" {
+			target += " upload " + e.UploadID
 		}
-		iter.Close()
+		fmt.Printf("%s %-10s %s, %d fids, %s (run %s)\n", e.Time.Format(time.RFC3339), e.Action,
+			target, len(e.Fids), e.Reason, e.RunID)
+		return nil
+	})
+}
+
+// openStore connects to TiKV.
+func openStore(cfg *Config) (*ydmeta.Store, error) {
+	sec := ydmeta.Security{
+		CAPath:   cfg.TLS.CA,
+		CertPath: cfg.TLS.Cert,
+		KeyPath:  cfg.TLS.Key,
+		VerifyCN: cfg.TLS.VerifyCN,
+	}
+	return ydmeta.NewStoreWithSecurity(strings.Join(cfg.PD, ","), sec)
+}
 
-		delIter, err := om.ListDeletedObjectsByIter()
+// setup connects to TiKV and SeaweedFS and builds the cleaner for cfg.
+func setup(cfg *Config) (*cleaner.Cleaner, *cleaner.Throttle, func(), error) {
+	if cfg.Output.Log != "" {
+		f, err := os.OpenFile(cfg.Output.Log, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 		if err != nil {
-			panic(err)
+			return nil, nil, nil, err
 		}
-		for delIter.Valid() {
-			ob := delIter.Value()
+		log.SetOutput(f)
+	}
 
-			if ob.Type == ydmeta.ObjectLargeType {
-				for i := 0; i < int(ob.PartTotal); i++ {
-					multiKey := ydmeta.GenMultipartKey(ob.Bucket, swfsMultipartDataName(ob.UploadID, i))
-					validMultipart[multiKey] = struct{}{}
-				}
-			}
+	store, err := openStore(cfg)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	closeFn := store.Close
 
-			delIter.Next()
+	throttle := cleaner.NewThrottle(cfg.Limits)
+	c := cleaner.NewCleaner(store.Buckets(), store.Objects())
+	c.SetScope(cfg.Buckets.Include, cfg.Buckets.Exclude)
+	c.SetBucketTypes(cfg.Buckets.Types)
+	c.SetProtectedBuckets(cfg.Buckets.Protected)
+	c.SetConcurrency(cfg.Concurrency)
+	c.SetGracePeriod(cfg.GracePeriod)
+	c.SetStaleUploadAge(cfg.StaleUploadAge)
+	c.SetAbortIncompleteUploadsAfter(cfg.AbortIncompleteUploadsAfter)
+	c.SetDeletedObjectRetention(cfg.DeletedObjectRetention)
+	c.SetQuarantineWindow(cfg.QuarantineWindow)
+	c.SetThrottle(throttle)
+	if cfg.Execute {
+		sc, err := swfsclient.NewSwfsClient(cfg.Master,
+			&http.Client{Timeout: 5 * time.Minute}, 1024)
+		if err != nil {
+			closeFn()
+			return nil, nil, nil, err
+		}
+		c.EnableExecute(sc, leaseOwner())
+		if cfg.Output.Audit != "" {
+			f, err := os.OpenFile(cfg.Output.Audit, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				closeFn()
+				return nil, nil, nil, err
+			}
+			c.SetAuditLog(f)
+			closeStore := closeFn
+			closeFn = func() {
+				f.Close()
+				closeStore()
+			}
 		}
-		delIter.Close()
+	}
+	return c, throttle, closeFn, nil
+}
+
+// serve runs scans on the configured schedule and exposes the admin API
+// until SIGINT or SIGTERM. SIGHUP re-reads the limits from configPath.
+func serve(c *cleaner.Cleaner, cfg *Config, throttle *cleaner.Throttle, configPath string) error {
+	schedule, err := cleaner.ParseSchedule(cfg.Serve.Schedule)
+	if err != nil {
+		return err
 	}
 
-	var totalSize int64
-	needDelCounts := 0
-	mpIter, err := om.ListMultipartByIter()
-	for mpIter.Valid() {
-		mp := mpIter.Value()
-		if mp == nil {
-			continue
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	d := cleaner.NewDaemon(c, schedule)
+	d.OnReport(func(report *cleaner.Report) {
+		if err := writeReport(cfg.Output.Report, report); err != nil {
+			log.Printf("write report failed: %s", err.Error())
 		}
+	})
+	srv := &http.Server{Addr: cfg.Serve.Listen, Handler: cleaner.NewAdminHandler(ctx, d, throttle)}
+
+	if configPath != "" {
+		go reloadLimitsOnHUP(ctx, throttle, configPath)
+	}
 
-		if _, ok := validMultipart[mpIter.Key()]; ok {
-			continue
+	errCh := make(chan error, 1)
+	go func() {
+		log.Printf("admin api listening on %s, schedule %q", cfg.Serve.Listen, cfg.Serve.Schedule)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			errCh <- err
 		}
+	}()
 
-		totalSize += mp.Size
-		needDelCounts++
+	daemonDone := make(chan struct{})
+	go func() {
+		defer close(daemonDone)
+		d.Run(ctx)
+	}()
+
+	select {
+	case <-ctx.Done():
+	case err = <-errCh:
+		stop()
 	}
 
-	fmt.Println(fmt.Sprintf("clean finished, multiparts count is %d, multiparts size is %.2fGB",
-		needDelCounts, float64(totalSize)/1024/1024))
+	log.Println("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if shutdownErr := srv.Shutdown(shutdownCtx); shutdownErr != nil && err == nil {
+		err = shutdownErr
+	}
+	<-daemonDone
+	return err
 }
 
-func swfsMultipartDataName(uploadID string, partNumber int) string {
-	return fmt.Sprintf("%s#%05d", uploadID, partNumber)
+func reloadLimitsOnHUP(ctx context.Context, throttle *cleaner.Throttle, configPath string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			cfg, err := loadConfig(configPath)
+			if err == nil {
+				err = cfg.Limits.Validate()
+			}
+			if err != nil {
+				log.Printf("reload limits failed: %s", err.Error())
+				continue
+			}
+			throttle.SetLimits(cfg.Limits)
+			log.Printf("limits reloaded from %s", configPath)
+		}
+	}
+}
+
+func writeReport(path string, report *cleaner.Report) error {
+	if path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// leaseOwner identifies this process in the cleaner lease.
+func leaseOwner() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
 }
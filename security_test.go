@@ -0,0 +1,131 @@
+package main
+
+import (
+	"clean_sw_dirty/ydmeta"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func newTestCert(t *testing.T, cn string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	require.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func writeTestFile(t *testing.T, dir string, name string, data []byte) string {
+	path := filepath.Join(dir, name)
+	require.Nil(t, ioutil.WriteFile(path, data, 0600))
+	return path
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "test-ca", nil)
+	server := newTestCert(t, "tikv-server", ca)
+	client := newTestCert(t, "cleaner", ca)
+
+	sec := ydmeta.Security{
+		CAPath:   writeTestFile(t, dir, "ca.pem", ca.certPEM),
+		CertPath: writeTestFile(t, dir, "client.pem", client.certPEM),
+		KeyPath:  writeTestFile(t, dir, "client-key.pem", client.keyPEM),
+	}
+
+	serverPair, err := tls.X509KeyPair(server.certPEM, server.keyPEM)
+	require.Nil(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverPair},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	require.Nil(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_ = conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+
+	dial := func(sec ydmeta.Security) error {
+		tlsConfig, err := sec.ToTLSConfig()
+		require.Nil(t, err)
+		conn, err := tls.Dial("tcp", ln.Addr().String(), tlsConfig)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		return conn.Handshake()
+	}
+
+	require.Nil(t, dial(sec))
+
+	sec.VerifyCN = []string{"pd-server", "tikv-server"}
+	require.Nil(t, dial(sec))
+
+	sec.VerifyCN = []string{"pd-server"}
+	require.NotNil(t, dial(sec))
+
+	cfg, err := ydmeta.Security{}.ToTLSConfig()
+	require.Nil(t, err)
+	require.Nil(t, cfg)
+
+	_, err = ydmeta.Security{CAPath: sec.CAPath, CertPath: sec.CertPath}.ToTLSConfig()
+	require.NotNil(t, err)
+	_, err = ydmeta.Security{CAPath: filepath.Join(dir, "missing.pem")}.ToTLSConfig()
+	require.NotNil(t, err)
+}
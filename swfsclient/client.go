@@ -0,0 +1,155 @@
+package swfsclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+var ErrInvalidFid = errors.New("invalid fid")
+
+type location struct {
+	Url       string `json:"url"`
+	PublicUrl string `json:"publicUrl"`
+}
+
+type lookupResult struct {
+	VolumeId  string     `json:"volumeId"`
+	Locations []location `json:"locations"`
+	Error     string     `json:"error"`
+}
+
+// SwfsClient talks to a SeaweedFS master and its volume servers.
+type SwfsClient struct {
+	master string
+	hc     *http.Client
+
+	mu        sync.Mutex
+	cacheSize int
+	volumes   map[string][]string
+}
+
+// NewSwfsClient creates a client for master, caching up to cacheSize volume
+// locations.
+func NewSwfsClient(master string, hc *http.Client, cacheSize int) (*SwfsClient, error) {
+	master = strings.TrimSpace(master)
+	if master == "" {
+		return nil, errors.New("invalid master address")
+	}
+	if !strings.HasPrefix(master, "http://") && !strings.HasPrefix(master, "https://") {
+		master = "http://" + master
+	}
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	return &SwfsClient{
+		master:    strings.TrimRight(master, "/"),
+		hc:        hc,
+		cacheSize: cacheSize,
+		volumes:   make(map[string][]string),
+	}, nil
+}
+
+func parseFid(fid string) (volumeId string, err error) {
+	i := strings.Index(fid, ",")
+	if i <= 0 || i == len(fid)-1 {
+		return "", fmt.Errorf("%w: %q", ErrInvalidFid, fid)
+	}
+	return fid[:i], nil
+}
+
+func (c *SwfsClient) lookup(ctx context.Context, volumeId string) ([]string, error) {
+	c.mu.Lock()
+	urls, ok := c.volumes[volumeId]
+	c.mu.Unlock()
+	if ok {
+		return urls, nil
+	}
+
+	u := fmt.Sprintf("%s/dir/lookup?volumeId=%s", c.master, url.QueryEscape(volumeId))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result := &lookupResult{}
+	if err = json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, fmt.Errorf("lookup volume %s: %s", volumeId, err.Error())
+	}
+	if result.Error != "" {
+		return nil, fmt.Errorf("lookup volume %s: %s", volumeId, result.Error)
+	}
+	if len(result.Locations) == 0 {
+		return nil, fmt.Errorf("lookup volume %s: no locations", volumeId)
+	}
+	for _, loc := range result.Locations {
+		urls = append(urls, loc.Url)
+	}
+
+	c.mu.Lock()
+	if c.cacheSize > 0 {
+		if len(c.volumes) >= c.cacheSize {
+			c.volumes = make(map[string][]string)
+		}
+		c.volumes[volumeId] = urls
+	}
+	c.mu.Unlock()
+	return urls, nil
+}
+
+func (c *SwfsClient) invalidate(volumeId string) {
+	c.mu.Lock()
+	delete(c.volumes, volumeId)
+	c.mu.Unlock()
+}
+
+// DeleteFid deletes fid from its volume. A fid that is already gone is not an
+// error.
+func (c *SwfsClient) DeleteFid(ctx context.Context, fid string) error {
+	volumeId, err := parseFid(fid)
+	if err != nil {
+		return err
+	}
+	urls, err := c.lookup(ctx, volumeId)
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	for _, u := range urls {
+		if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+			u = "http://" + u
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodDelete, u+"/"+fid, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := c.hc.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		switch {
+		case resp.StatusCode < 300 || resp.StatusCode == http.StatusNotFound:
+			return nil
+		default:
+			lastErr = fmt.Errorf("delete %s: %s %s", fid, resp.Status, strings.TrimSpace(string(body)))
+		}
+	}
+	c.invalidate(volumeId)
+	return lastErr
+}
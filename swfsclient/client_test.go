@@ -0,0 +1,57 @@
+package swfsclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeleteFid(t *testing.T) {
+	var deletes, lookups int32
+	volume := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodDelete, r.Method)
+		atomic.AddInt32(&deletes, 1)
+		switch r.URL.Path {
+		case "/3,01637037d6":
+			w.WriteHeader(http.StatusAccepted)
+		case "/3,missing":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer volume.Close()
+
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&lookups, 1)
+		assert.Equal(t, "/dir/lookup", r.URL.Path)
+		if r.URL.Query().Get("volumeId") != "3" {
+			fmt.Fprint(w, `{"error":"volume not found"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"volumeId":"3","locations":[{"url":"%s"}]}`,
+			strings.TrimPrefix(volume.URL, "http://"))
+	}))
+	defer master.Close()
+
+	c, err := NewSwfsClient(master.URL, nil, 16)
+	require.Nil(t, err)
+	ctx := context.Background()
+
+	require.Nil(t, c.DeleteFid(ctx, "3,01637037d6"))
+	require.Nil(t, c.DeleteFid(ctx, "3,missing"))
+	require.Equal(t, int32(1), atomic.LoadInt32(&lookups))
+
+	require.NotNil(t, c.DeleteFid(ctx, "3,broken"))
+	require.NotNil(t, c.DeleteFid(ctx, "4,01637037d6"))
+	require.True(t, errors.Is(c.DeleteFid(ctx, "nocomma"), ErrInvalidFid))
+	require.Equal(t, int32(3), atomic.LoadInt32(&deletes))
+}
@@ -0,0 +1,103 @@
+package ydmeta
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// AuditEntry records a destructive action on one record: the deletion of
+// its data or of its key, its move into or out of the quarantine, or its
+// rewrite by a migration.
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	RunID    string    `json:"runID"`
+	Seq      int64     `json:"seq"`
+	Action   string    `json:"action"`
+	Bucket   string    `json:"bucket,omitempty"`
+	Object   string    `json:"object,omitempty"`
+	UploadID string    `json:"uploadID,omitempty"`
+	// Key is the key of the record and Value its value before the action.
+	Key   []byte `json:"key"`
+	Value []byte `json:"value,omitempty"`
+	// Fids are the fids of the record whose data the action deletes.
+	Fids   []string `json:"fids,omitempty"`
+	Reason string   `json:"reason"`
+}
+
+// AuditMigrate is the action of the entries migrations write for the records
+// they rewrite or remove.
+const AuditMigrate = "migrate"
+
+// AppendAudit stores entries under the audit prefix. Entries are never
+// changed once stored.
+func (m *MetaManager) AppendAudit(entries ...*AuditEntry) error {
+	tx, err := m.client.Begin()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		val, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if err = tx.Set([]byte(genAuditKey(e.Time.UnixNano(), e.RunID, e.Seq)), val); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(context.Background())
+}
+
+// ListAuditByIter iterates the audit entries stored at or after since,
+// oldest first.
+func (m *MetaManager) ListAuditByIter(since time.Time) (*AuditIter, error) {
+	tx, err := m.client.Begin()
+	if err != nil {
+		return nil, err
+	}
+	prefix := Pack(AUDIT_PREFIX)
+	it, err := tx.Iter(Pack(AUDIT_PREFIX, since.UnixNano()), prefixEnd(prefix))
+	if err != nil {
+		return nil, err
+	}
+	return &AuditIter{
+		interClose: it.Close,
+		interValid: it.Valid,
+		interNext:  it.Next,
+		interKey:   it.Key,
+		interValue: it.Value,
+	}, nil
+}
+
+type AuditIter struct {
+	interClose func()
+	interValid func() bool
+	interNext  func() error
+	interKey   func() []byte
+	interValue func() []byte
+}
+
+func (i *AuditIter) Next() error {
+	return i.interNext()
+}
+
+// Value decodes the current entry.
+func (i *AuditIter) Value() (*AuditEntry, error) {
+	e := &AuditEntry{}
+	if err := json.Unmarshal(i.interValue(), e); err != nil {
+		return nil, &DecodeError{Key: i.Key(), Err: err}
+	}
+	return e, nil
+}
+
+func (i *AuditIter) Key() string {
+	return string(i.interKey())
+}
+
+func (i *AuditIter) Valid() bool {
+	return i.interValid()
+}
+
+func (i *AuditIter) Close() {
+	i.interClose()
+}
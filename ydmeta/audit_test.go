@@ -0,0 +1,49 @@
+package ydmeta
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAudit(t *testing.T) {
+	start := time.Now()
+	entries := []*AuditEntry{
+		{Time: start, RunID: "audit-test", Seq: 1, Action: "delete", Bucket: testBucketName,
+			Object: "o", Key: []byte(GenObjectKey(testBucketName, "o")), Value: []byte(`{}`),
+			Fids: []string{"3,01637037d6"}, Reason: "test"},
+		{Time: start, RunID: "audit-test", Seq: 2, Action: "purge", Bucket: testBucketName,
+			UploadID: "up", Reason: "test"},
+	}
+	require.Nil(t, om.AppendAudit(entries...))
+
+	iter, err := om.ListAuditByIter(start)
+	require.Nil(t, err)
+	var got []*AuditEntry
+	for ; iter.Valid(); iter.Next() {
+		e, err := iter.Value()
+		require.Nil(t, err)
+		if e.RunID == "audit-test" {
+			got = append(got, e)
+		}
+	}
+	iter.Close()
+	require.Equal(t, 2, len(got))
+	require.Equal(t, entries[0].Key, got[0].Key)
+	require.Equal(t, entries[0].Fids, got[0].Fids)
+	require.Equal(t, "purge", got[1].Action)
+
+	iter, err = om.ListAuditByIter(start.Add(time.Second))
+	require.Nil(t, err)
+	defer iter.Close()
+	for ; iter.Valid(); iter.Next() {
+		e, err := iter.Value()
+		require.Nil(t, err)
+		require.NotEqual(t, "audit-test", e.RunID)
+	}
+
+	for _, e := range entries {
+		require.Nil(t, om.dels([]byte(genAuditKey(e.Time.UnixNano(), e.RunID, e.Seq))))
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"errors"
 	"github.com/tikv/client-go/v2/txnkv"
+	"strconv"
+	"strings"
 	"time"
 
 	tikverr "github.com/tikv/client-go/v2/error"
@@ -20,6 +22,51 @@ func (b *BucketInfo) Encode() ([]byte, error) {
 	return json.Marshal(b)
 }
 
+// ExtAbortIncompleteUploadDays is the BucketInfo.ExtFields entry holding
+// the bucket's AbortIncompleteMultipartUpload rule, in days.
+const ExtAbortIncompleteUploadDays = "abortIncompleteMultipartUploadDays"
+
+// AbortIncompleteUploadDays returns the number of days after which the
+// incomplete uploads of the bucket are aborted, if the bucket sets it.
+func (b *BucketInfo) AbortIncompleteUploadDays() (days int, ok bool) {
+	switch v := b.ExtFields[ExtAbortIncompleteUploadDays].(type) {
+	case float64:
+		return int(v), true
+	case int:
+		return v, true
+	case string:
+		if n, err := strconv.Atoi(v); err == nil {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+// ExtProtected is the BucketInfo.ExtFields flag of buckets that must never
+// be cleaned automatically, such as compliance archives.
+const ExtProtected = "protected"
+
+// Protected tells whether the bucket must never be cleaned automatically.
+func (b *BucketInfo) Protected() bool {
+	return extFlag(b.ExtFields, ExtProtected)
+}
+
+// extFlag tells whether the ExtFields entry key is set to true, or to "ON"
+// as S3 writes it.
+func extFlag(ext map[string]interface{}, key string) bool {
+	switch v := ext[key].(type) {
+	case bool:
+		return v
+	case string:
+		if strings.EqualFold(v, "ON") {
+			return true
+		}
+		on, err := strconv.ParseBool(v)
+		return err == nil && on
+	}
+	return false
+}
+
 type BucketMetaManager struct {
 	MetaManager
 }
@@ -32,25 +79,30 @@ func NewBucketMetaManager(addr string) (*BucketMetaManager, error) {
 	return &BucketMetaManager{MetaManager{client: client}}, nil
 }
 
+// NewBucketMetaManagerWithSecurity connects to the PD endpoints in addr over TLS.
+func NewBucketMetaManagerWithSecurity(addr string, sec Security) (*BucketMetaManager, error) {
+	client, err := newTikvClientWithSecurity(addr, sec)
+	if err != nil {
+		return nil, err
+	}
+	return &BucketMetaManager{MetaManager{client: client}}, nil
+}
+
 func NewBucketMetaManagerByClient(client *txnkv.Client) *BucketMetaManager {
 	return &BucketMetaManager{MetaManager{client: client}}
 }
 
 func (bm *BucketMetaManager) CreateBucket(bucket string, info *BucketInfo) error {
-	val, err := info.Encode()
+	val, err := bm.Encode(info)
 	if err != nil {
 		return err
 	}
 
-	bucketKey := GenBucketKey(bucket)
-
-	return bm.setIfAbsent([]byte(bucketKey), val)
+	return bm.setIfAbsentDual(GenBucketKey(bucket), legacyBucketKey(bucket), val)
 }
 
 func (bm *BucketMetaManager) GetBucketInfo(bucket string) (bucketInfo *BucketInfo, err error) {
-	bucketKey := GenBucketKey(bucket)
-
-	val, err := bm.get([]byte(bucketKey))
+	val, err := bm.getDual(GenBucketKey(bucket), legacyBucketKey(bucket))
 	if err != nil {
 		if !errors.Is(err, tikverr.ErrNotExist) {
 			return nil, err
@@ -59,19 +111,18 @@ func (bm *BucketMetaManager) GetBucketInfo(bucket string) (bucketInfo *BucketInf
 	}
 
 	bucketInfo = &BucketInfo{}
-	if err = json.Unmarshal(val, bucketInfo); err != nil {
+	if err = DecodeValue(val, bucketInfo); err != nil {
 		return nil, err
 	}
 	return bucketInfo, nil
 }
 
 func (bm *BucketMetaManager) DeleteBucket(bucket string) error {
-	bucketKey := GenBucketKey(bucket)
-	return bm.dels([]byte(bucketKey))
+	return bm.delsDual(GenBucketKey(bucket), legacyBucketKey(bucket))
 }
 
 func (bm *BucketMetaManager) ListBuckets() (buckets []*BucketInfo, err error) {
-	kvs, err := bm.list([]byte(BUCKET_PREFIX), -1)
+	kvs, err := bm.listDual(Pack(BUCKET_PREFIX), nil, []byte(BUCKET_PREFIX+KEY_SEPARATOR), nil, -1)
 	if err != nil {
 		return nil, err
 	}
@@ -79,7 +130,7 @@ func (bm *BucketMetaManager) ListBuckets() (buckets []*BucketInfo, err error) {
 	buckets = make([]*BucketInfo, 0, len(kvs))
 	for i := 0; i < len(kvs); i++ {
 		bucketInfo := &BucketInfo{}
-		if err = json.Unmarshal(kvs[i].V, bucketInfo); err != nil {
+		if err = DecodeValue(kvs[i].V, bucketInfo); err != nil {
 			return nil, err
 		}
 		buckets = append(buckets, bucketInfo)
@@ -88,7 +139,7 @@ func (bm *BucketMetaManager) ListBuckets() (buckets []*BucketInfo, err error) {
 }
 
 func (bm *BucketMetaManager) ListBucketsByType(t string) (buckets []*BucketInfo, err error) {
-	kvs, err := bm.list([]byte(BUCKET_PREFIX), -1)
+	kvs, err := bm.listDual(Pack(BUCKET_PREFIX), nil, []byte(BUCKET_PREFIX+KEY_SEPARATOR), nil, -1)
 	if err != nil {
 		return nil, err
 	}
@@ -96,7 +147,7 @@ func (bm *BucketMetaManager) ListBucketsByType(t string) (buckets []*BucketInfo,
 	buckets = make([]*BucketInfo, 0, len(kvs))
 	for i := 0; i < len(kvs); i++ {
 		bucketInfo := &BucketInfo{}
-		if err = json.Unmarshal(kvs[i].V, bucketInfo); err != nil {
+		if err = DecodeValue(kvs[i].V, bucketInfo); err != nil {
 			return nil, err
 		}
 		if bucketInfo.Type == t {
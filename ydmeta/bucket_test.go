@@ -18,7 +18,7 @@ func TestCreateDeleteBucket(t *testing.T) {
 	bm, err := NewBucketMetaManager(metaAddr)
 	require.Nil(t, err)
 
-	bucketKey := []byte("YDS3_BUCKET#abc")
+	bucketKey := []byte(GenBucketKey("abc"))
 	bm.dels([]byte(bucketKey))
 	bucketName := "abc"
 
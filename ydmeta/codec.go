@@ -0,0 +1,115 @@
+package ydmeta
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// Codec encodes the values of metadata records.
+type Codec interface {
+	// ID names the codec in the envelope of the values it encodes.
+	ID() byte
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// A value is stored in an envelope naming the codec that encoded it:
+//
+//	envelopeV1 codecID payload
+//
+// Values that do not start with envelopeV1 are bare JSON. Older versions
+// wrote nothing else, and JSONCodec still writes bare JSON, so that readers
+// which predate the envelope keep working while JSON is the default.
+const envelopeV1 byte = 0x01
+
+const (
+	codecJSON  byte = 'j'
+	codecProto byte = 'p'
+)
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[byte]Codec{codecJSON: JSONCodec, codecProto: ProtoCodec}
+)
+
+// RegisterCodec makes values encoded by c decodable. It panics when another
+// codec has the same ID.
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	if _, ok := codecs[c.ID()]; ok {
+		panic(fmt.Sprintf("ydmeta: codec %q registered twice", c.ID()))
+	}
+	codecs[c.ID()] = c
+}
+
+// CodecByName returns the built in codec called name, "json" or "proto".
+func CodecByName(name string) (Codec, error) {
+	switch name {
+	case "", "json":
+		return JSONCodec, nil
+	case "proto":
+		return ProtoCodec, nil
+	}
+	return nil, fmt.Errorf("unknown value codec %q", name)
+}
+
+// EncodeValue encodes v with c, in its envelope.
+func EncodeValue(c Codec, v interface{}) ([]byte, error) {
+	payload, err := c.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if c.ID() == codecJSON {
+		return payload, nil
+	}
+	return append([]byte{envelopeV1, c.ID()}, payload...), nil
+}
+
+// DecodeValue decodes a value written by any registered codec into v.
+func DecodeValue(data []byte, v interface{}) error {
+	if len(data) == 0 || data[0] != envelopeV1 {
+		return json.Unmarshal(data, v)
+	}
+	if len(data) < 2 {
+		return fmt.Errorf("truncated value envelope")
+	}
+	codecsMu.RLock()
+	c, ok := codecs[data[1]]
+	codecsMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("unknown value codec %q", data[1])
+	}
+	return c.Unmarshal(data[2:], v)
+}
+
+// valueCodec returns the codec data was encoded with.
+func valueCodec(data []byte) Codec {
+	if len(data) < 2 || data[0] != envelopeV1 {
+		return JSONCodec
+	}
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	if c, ok := codecs[data[1]]; ok {
+		return c
+	}
+	return JSONCodec
+}
+
+type jsonCodec struct{}
+
+// JSONCodec encodes values as JSON. It is the default codec.
+var JSONCodec Codec = jsonCodec{}
+
+func (jsonCodec) ID() byte {
+	return codecJSON
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
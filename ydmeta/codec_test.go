@@ -0,0 +1,156 @@
+package ydmeta
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func testValues() []interface{} {
+	now := time.Unix(0, time.Now().UnixNano())
+	small := &ObjectInfo{Name: "small", Size: 42, Bucket: "b", ModTime: now,
+		ExtFields: map[string]interface{}{"owner": "o"}}
+	small.SetFids([]FileIdInfo{{FileId: "3,01637037d6", FileSize: 40}, {FileId: "4,0260375a1f", Offset: 40, FileSize: 2}})
+	return []interface{}{
+		small,
+		&BucketInfo{Name: "b", Type: "t", CreateTime: now,
+			ExtFields: map[string]interface{}{ExtAbortIncompleteUploadDays: 3.0}},
+		&ObjectInfo{Name: "dir/o", Size: 1 << 40, Bucket: "b", Etag: "e", ModTime: now,
+			ContentType: "text/plain", Type: ObjectLargeType, UploadID: "u", PartSize: 5 << 20,
+			PartTotal: 3, Version: "1"},
+		&MultipartMetaV1{Version: "1", Bucket: "b", Object: "o", ModTime: now, UploadID: "u",
+			InitiateTime: now},
+		&MultipartPartMetaV1{Size: 42, Etag: "e", ModTime: now, FidInfos: []FileIdInfo{
+			{FileId: "3,01637037d6", FileSize: 40},
+			{FileId: "4,0260375a1f", Offset: 40, FileSize: 2},
+		}},
+	}
+}
+
+// zero returns a new zero value of the type v points to.
+func zero(v interface{}) interface{} {
+	switch v.(type) {
+	case *BucketInfo:
+		return &BucketInfo{}
+	case *ObjectInfo:
+		return &ObjectInfo{}
+	case *MultipartMetaV1:
+		return &MultipartMetaV1{}
+	case *MultipartPartMetaV1:
+		return &MultipartPartMetaV1{}
+	}
+	panic(v)
+}
+
+// sameValue compares values after a JSON round trip, which normalises the
+// locations of their times.
+func sameValue(t *testing.T, want interface{}, got interface{}) {
+	w, err := json.Marshal(want)
+	require.Nil(t, err)
+	g, err := json.Marshal(got)
+	require.Nil(t, err)
+	wv, gv := zero(want), zero(want)
+	require.Nil(t, json.Unmarshal(w, wv))
+	require.Nil(t, json.Unmarshal(g, gv))
+	require.Equal(t, wv, gv)
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, c := range []Codec{JSONCodec, ProtoCodec} {
+		for _, v := range testValues() {
+			val, err := EncodeValue(c, v)
+			require.Nil(t, err)
+			got := zero(v)
+			require.Nil(t, DecodeValue(val, got))
+			sameValue(t, v, got)
+		}
+	}
+}
+
+func TestDecodeValue(t *testing.T) {
+	// Values written before the envelope are bare JSON.
+	val, err := json.Marshal(&ObjectInfo{Name: "o", Size: 1})
+	require.Nil(t, err)
+	oi := &ObjectInfo{}
+	require.Nil(t, DecodeValue(val, oi))
+	require.Equal(t, "o", oi.Name)
+
+	val, err = EncodeValue(ProtoCodec, &ObjectInfo{Name: "o", Size: 1})
+	require.Nil(t, err)
+	require.Equal(t, []byte{envelopeV1, codecProto}, val[:2])
+
+	// Fields added by later versions are skipped.
+	val = protowire.AppendTag(val, 100, protowire.BytesType)
+	val = protowire.AppendString(val, "future")
+	val = protowire.AppendTag(val, 101, protowire.Fixed64Type)
+	val = protowire.AppendFixed64(val, 7)
+	oi = &ObjectInfo{}
+	require.Nil(t, DecodeValue(val, oi))
+	require.Equal(t, &ObjectInfo{Name: "o", Size: 1}, oi)
+
+	require.NotNil(t, DecodeValue([]byte{envelopeV1, 'x', 1}, oi))
+	require.NotNil(t, DecodeValue([]byte{envelopeV1}, oi))
+	require.NotNil(t, DecodeValue(val[:len(val)-3], oi))
+	_, err = EncodeValue(ProtoCodec, &KV{})
+	require.NotNil(t, err)
+}
+
+func TestObjectFids(t *testing.T) {
+	fids := []FileIdInfo{{FileId: "3,01637037d6", FileSize: 1 << 20}, {FileId: "4,0260375a1f", Offset: 1 << 20, FileSize: 2}}
+	oi := &ObjectInfo{Name: "o"}
+	got, err := oi.Fids()
+	require.Nil(t, err)
+	require.Nil(t, got)
+	oi.SetFids(fids)
+
+	for _, c := range []Codec{JSONCodec, ProtoCodec} {
+		val, err := EncodeValue(c, oi)
+		require.Nil(t, err)
+
+		// fids decoded from JSON are generic until typed by Fids
+		decoded := &ObjectInfo{}
+		require.Nil(t, DecodeValue(val, decoded))
+		got, err = decoded.Fids()
+		require.Nil(t, err)
+		require.Equal(t, fids, got)
+
+		// records read through the managers have typed fids
+		decoded, err = decodeObject(val)
+		require.Nil(t, err)
+		require.Equal(t, fids, decoded.ExtFields[ExtFids])
+	}
+
+	// the JSON form is the one older versions wrote
+	val, err := json.Marshal(oi)
+	require.Nil(t, err)
+	var raw struct {
+		ExtFields struct {
+			Fids []FileIdInfo `json:"fids"`
+		} `json:"extFields"`
+	}
+	require.Nil(t, json.Unmarshal(val, &raw))
+	require.Equal(t, fids, raw.ExtFields.Fids)
+
+	oi.ExtFields[ExtFids] = "not fids"
+	_, err = oi.Fids()
+	require.NotNil(t, err)
+	oi.SetFids(nil)
+	_, ok := oi.ExtFields[ExtFids]
+	require.False(t, ok)
+}
+
+func TestExtFlags(t *testing.T) {
+	for v, want := range map[interface{}]bool{
+		true: true, false: false, "true": true, "ON": true, "on": true, "OFF": false, "x": false, 1.0: false,
+	} {
+		b := &BucketInfo{ExtFields: map[string]interface{}{ExtProtected: v}}
+		require.Equal(t, want, b.Protected(), "%v", v)
+		o := &ObjectInfo{ExtFields: map[string]interface{}{ExtLegalHold: v}}
+		require.Equal(t, want, o.LegalHold(), "%v", v)
+	}
+	require.False(t, (&BucketInfo{}).Protected())
+	require.False(t, (&ObjectInfo{}).LegalHold())
+}
@@ -2,12 +2,22 @@ package ydmeta
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"strings"
+	"time"
 
+	"github.com/tikv/client-go/v2/config"
 	tikverr "github.com/tikv/client-go/v2/error"
+	"github.com/tikv/client-go/v2/tikv"
 	"github.com/tikv/client-go/v2/txnkv"
+	"github.com/tikv/client-go/v2/util"
+	pd "github.com/tikv/pd/client"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
 )
 
 type KV struct {
@@ -20,6 +30,25 @@ func (kv KV) String() string {
 
 type MetaManager struct {
 	client *txnkv.Client
+	// borrowed clients belong to a Store and are not closed here
+	borrowed bool
+	// codec encodes the values written by the manager, JSONCodec when nil
+	codec Codec
+}
+
+// SetCodec sets the codec of the values the manager writes. Values of every
+// codec are read regardless.
+func (m *MetaManager) SetCodec(c Codec) {
+	m.codec = c
+}
+
+// Encode encodes v with the codec of the manager, for the methods that take
+// encoded values.
+func (m *MetaManager) Encode(v interface{}) ([]byte, error) {
+	if m.codec == nil {
+		return EncodeValue(JSONCodec, v)
+	}
+	return EncodeValue(m.codec, v)
 }
 
 func (m *MetaManager) get(k []byte) ([]byte, error) {
@@ -141,25 +170,143 @@ func (m *MetaManager) scan(beginKey []byte, endKey []byte, limit int) ([]KV, err
 	for it.Valid() && limit > 0 {
 		ret = append(ret, KV{K: it.Key()[:], V: it.Value()[:]})
 		limit--
-		it.Next()
+		if err = it.Next(); err != nil {
+			return nil, err
+		}
 	}
 	return ret, nil
 }
 
 func (m *MetaManager) Close() {
-	if m.client != nil {
+	if m.client != nil && !m.borrowed {
 		m.client.Close()
 	}
 }
 
+// Security is the TLS setting of the PD and TiKV connections. The zero
+// value means plain connections.
+type Security struct {
+	CAPath   string
+	CertPath string
+	KeyPath  string
+	// VerifyCN, if not empty, only accepts server certificates whose common
+	// name is in the list. Only the etcd connection of the safepoint client
+	// checks it; neither the PD client nor client-go take a custom TLS
+	// config, so PD and TiKV are verified against the CA alone.
+	VerifyCN []string
+}
+
+func (s Security) Enabled() bool {
+	return s.CAPath != ""
+}
+
+// ToTLSConfig loads the CA and the client key pair.
+func (s Security) ToTLSConfig() (*tls.Config, error) {
+	if !s.Enabled() {
+		return nil, nil
+	}
+	ca, err := ioutil.ReadFile(s.CAPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not read ca certificate: %s", err.Error())
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("failed to append ca certs")
+	}
+	tlsConfig := &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+
+	if (s.CertPath == "") != (s.KeyPath == "") {
+		return nil, errors.New("cert and key must be set together")
+	}
+	if s.CertPath != "" {
+		cert, err := tls.LoadX509KeyPair(s.CertPath, s.KeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client key pair: %s", err.Error())
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(s.VerifyCN) > 0 {
+		allowed := make(map[string]struct{}, len(s.VerifyCN))
+		for _, cn := range s.VerifyCN {
+			allowed[cn] = struct{}{}
+		}
+		tlsConfig.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+			for _, chain := range chains {
+				if len(chain) == 0 {
+					continue
+				}
+				if _, ok := allowed[chain[0].Subject.CommonName]; ok {
+					return nil
+				}
+			}
+			return errors.New("peer certificate common name is not allowed")
+		}
+	}
+	return tlsConfig, nil
+}
+
 func newTikvClient(addrStr string) (*txnkv.Client, error) {
+	return newTikvClientWithSecurity(addrStr, Security{})
+}
+
+// newTikvClientWithSecurity builds the client the way txnkv.NewClient does,
+// but with sec instead of the process wide client-go security config.
+// VerifyCN is enforced on the etcd connection only.
+func newTikvClientWithSecurity(addrStr string, sec Security) (*txnkv.Client, error) {
 	var addrs []string
 	for _, addr := range strings.Split(addrStr, ",") {
-		addrs = append(addrs, strings.TrimSpace(addr))
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
 	}
 
 	if len(addrs) <= 0 {
 		return nil, errors.New("invalid address")
 	}
-	return txnkv.NewClient(addrs)
+	if !sec.Enabled() {
+		return txnkv.NewClient(addrs)
+	}
+
+	tlsConfig, err := sec.ToTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	cfg := config.GetGlobalConfig()
+	pdCli, err := pd.NewClient(addrs, pd.SecurityOption{
+		CAPath:   sec.CAPath,
+		CertPath: sec.CertPath,
+		KeyPath:  sec.KeyPath,
+	},
+		pd.WithGRPCDialOptions(
+			grpc.WithKeepaliveParams(keepalive.ClientParameters{
+				Time:    time.Duration(cfg.TiKVClient.GrpcKeepAliveTime) * time.Second,
+				Timeout: time.Duration(cfg.TiKVClient.GrpcKeepAliveTimeout) * time.Second,
+			}),
+		),
+		pd.WithCustomTimeoutOption(time.Duration(cfg.PDClient.PDServerTimeout)*time.Second))
+	if err != nil {
+		return nil, err
+	}
+	pdClient := &tikv.CodecPDClient{Client: util.InterceptedPDClient{Client: pdCli}}
+	uuid := fmt.Sprintf("tikv-%v", pdClient.GetClusterID(context.TODO()))
+
+	spkv, err := tikv.NewEtcdSafePointKV(addrs, tlsConfig)
+	if err != nil {
+		pdClient.Close()
+		return nil, err
+	}
+	rpcClient := tikv.NewRPCClient(tikv.WithSecurity(
+		config.NewSecurity(sec.CAPath, sec.CertPath, sec.KeyPath, nil)))
+	s, err := tikv.NewKVStore(uuid, pdClient, spkv, rpcClient)
+	if err != nil {
+		rpcClient.Close()
+		spkv.Close()
+		pdClient.Close()
+		return nil, err
+	}
+	if cfg.TxnLocalLatches.Enabled {
+		s.EnableTxnLocalLatches(cfg.TxnLocalLatches.Capacity)
+	}
+	return &txnkv.Client{KVStore: s}, nil
 }
@@ -0,0 +1,227 @@
+package ydmeta
+
+import "fmt"
+
+// The cursors walk the record iterators in the style of bufio.Scanner:
+//
+//	cur := iter.Cursor()
+//	defer cur.Close()
+//	for cur.Next() {
+//		item := cur.Item()
+//		if item.Err != nil {
+//			// skip the record, or give up
+//		}
+//	}
+//	if err := cur.Err(); err != nil {
+//		...
+//	}
+//
+// A record whose value cannot be decoded is still returned, with a
+// *DecodeError in its item, so that the caller decides whether to skip it or
+// abort; the Value methods of the iterators cannot tell such a record from
+// an empty one. An error of the iterator itself ends the walk and is
+// returned by Err.
+
+// DecodeError reports a record whose value cannot be decoded.
+type DecodeError struct {
+	Key string
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("decode %q: %s", e.Key, e.Err.Error())
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// cursor is the walk shared by the typed cursors.
+type cursor struct {
+	valid   func() bool
+	next    func() error
+	close   func()
+	started bool
+	err     error
+}
+
+// advance moves to the next record, the first one on the first call, and
+// tells whether there is one.
+func (c *cursor) advance() bool {
+	if c.err != nil {
+		return false
+	}
+	if c.started {
+		if err := c.next(); err != nil {
+			c.err = err
+			return false
+		}
+	}
+	c.started = true
+	return c.valid()
+}
+
+// Err returns the error that ended the walk, if any.
+func (c *cursor) Err() error {
+	return c.err
+}
+
+func (c *cursor) Close() {
+	c.close()
+}
+
+// ObjectItem is a record of an ObjectCursor.
+type ObjectItem struct {
+	Key    string
+	Object *ObjectInfo
+	Err    error
+}
+
+type ObjectCursor struct {
+	cursor
+	it   *ObjectMetaIter
+	item ObjectItem
+}
+
+// Cursor walks the iterator from its current record. The cursor owns the
+// iterator: closing one closes the other.
+func (i *ObjectMetaIter) Cursor() *ObjectCursor {
+	return &ObjectCursor{cursor: cursor{valid: i.Valid, next: i.Next, close: i.Close}, it: i}
+}
+
+func (c *ObjectCursor) Next() bool {
+	c.item = ObjectItem{}
+	if !c.advance() {
+		return false
+	}
+	c.item.Key = c.it.Key()
+	c.item.Object, c.item.Err = c.it.decode()
+	return true
+}
+
+func (c *ObjectCursor) Item() ObjectItem {
+	return c.item
+}
+
+// RawValue returns a copy of the value of the current record as stored.
+func (c *ObjectCursor) RawValue() []byte {
+	return c.it.RawValue()
+}
+
+// MultipartItem is a record of a MultipartCursor: a part, deleted or not, or
+// the record of an upload.
+type MultipartItem struct {
+	Key    string
+	Part   *MultipartPartMetaV1
+	Upload *MultipartMetaV1
+	Err    error
+}
+
+type MultipartCursor struct {
+	cursor
+	it   *MultipartMetaIter
+	item MultipartItem
+}
+
+// Cursor walks the iterator from its current record, as
+// ObjectMetaIter.Cursor.
+func (i *MultipartMetaIter) Cursor() *MultipartCursor {
+	return &MultipartCursor{cursor: cursor{valid: i.Valid, next: i.Next, close: i.Close}, it: i}
+}
+
+func (c *MultipartCursor) Next() bool {
+	c.item = MultipartItem{}
+	if !c.advance() {
+		return false
+	}
+	c.item.Key = c.it.Key()
+	if isPartKey(c.item.Key) {
+		c.item.Part, c.item.Err = c.it.decodePart()
+	} else {
+		c.item.Upload, c.item.Err = c.it.decodeUpload()
+	}
+	return true
+}
+
+func (c *MultipartCursor) Item() MultipartItem {
+	return c.item
+}
+
+// RawValue returns a copy of the value of the current record as stored.
+func (c *MultipartCursor) RawValue() []byte {
+	return c.it.RawValue()
+}
+
+func isPartKey(key string) bool {
+	if _, ok := ParsePartKey(key); ok {
+		return true
+	}
+	_, _, ok := ParseDeletedPartKey(key)
+	return ok
+}
+
+// QuarantineItem is an entry of a QuarantineCursor.
+type QuarantineItem struct {
+	Key   string
+	Entry *QuarantineEntry
+	Err   error
+}
+
+type QuarantineCursor struct {
+	cursor
+	it   *QuarantineIter
+	item QuarantineItem
+}
+
+// Cursor walks the iterator from its current entry, as
+// ObjectMetaIter.Cursor.
+func (i *QuarantineIter) Cursor() *QuarantineCursor {
+	return &QuarantineCursor{cursor: cursor{valid: i.Valid, next: i.Next, close: i.Close}, it: i}
+}
+
+func (c *QuarantineCursor) Next() bool {
+	c.item = QuarantineItem{}
+	if !c.advance() {
+		return false
+	}
+	c.item.Key = c.it.Key()
+	c.item.Entry, c.item.Err = c.it.decode()
+	return true
+}
+
+func (c *QuarantineCursor) Item() QuarantineItem {
+	return c.item
+}
+
+// AuditItem is an entry of an AuditCursor.
+type AuditItem struct {
+	Key   string
+	Entry *AuditEntry
+	Err   error
+}
+
+type AuditCursor struct {
+	cursor
+	it   *AuditIter
+	item AuditItem
+}
+
+// Cursor walks the iterator from its current entry, as
+// ObjectMetaIter.Cursor.
+func (i *AuditIter) Cursor() *AuditCursor {
+	return &AuditCursor{cursor: cursor{valid: i.Valid, next: i.Next, close: i.Close}, it: i}
+}
+
+func (c *AuditCursor) Next() bool {
+	c.item = AuditItem{}
+	if !c.advance() {
+		return false
+	}
+	c.item.Key = c.it.Key()
+	c.item.Entry, c.item.Err = c.it.Value()
+	return true
+}
+
+func (c *AuditCursor) Item() AuditItem {
+	return c.item
+}
@@ -0,0 +1,85 @@
+package ydmeta
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// failingIter is a kvIter over kvs whose Next fails after the last one.
+type failingIter struct {
+	kvs []KV
+	err error
+}
+
+func (f *failingIter) Valid() bool   { return len(f.kvs) > 0 }
+func (f *failingIter) Key() []byte   { return f.kvs[0].K }
+func (f *failingIter) Value() []byte { return f.kvs[0].V }
+func (f *failingIter) Close()        {}
+
+func (f *failingIter) Next() error {
+	if len(f.kvs) == 1 && f.err != nil {
+		return f.err
+	}
+	f.kvs = f.kvs[1:]
+	return nil
+}
+
+func TestObjectCursor(t *testing.T) {
+	errRead := errors.New("read failed")
+	it := objectMetaIter(&failingIter{kvs: []KV{
+		{K: []byte(GenObjectKey("b", "o1")), V: []byte(`{"Size":1}`)},
+		{K: []byte(GenObjectKey("b", "o2")), V: []byte(`not json`)},
+		{K: []byte(GenObjectKey("b", "o3")), V: []byte(`{"Size":3}`)},
+	}, err: errRead})
+	cur := it.Cursor()
+	defer cur.Close()
+
+	require.True(t, cur.Next())
+	require.Nil(t, cur.Item().Err)
+	require.Equal(t, int64(1), cur.Item().Object.Size)
+
+	// a record that cannot be decoded is returned with its key
+	require.True(t, cur.Next())
+	item := cur.Item()
+	require.Nil(t, item.Object)
+	var decodeErr *DecodeError
+	require.True(t, errors.As(item.Err, &decodeErr))
+	require.Equal(t, GenObjectKey("b", "o2"), decodeErr.Key)
+
+	require.True(t, cur.Next())
+	require.Equal(t, int64(3), cur.Item().Object.Size)
+
+	// an error of the iterator ends the walk
+	require.False(t, cur.Next())
+	require.Equal(t, errRead, cur.Err())
+	require.False(t, cur.Next())
+}
+
+func TestMultipartCursor(t *testing.T) {
+	it := multipartMetaIter(&failingIter{kvs: []KV{
+		{K: []byte(GenMultipartKey("b", "u")), V: []byte(`{}`)},
+		{K: []byte(PartKey{Bucket: "b", UploadID: "u", PartNumber: 1}.String()), V: []byte(`{"Size":5}`)},
+		{K: []byte(PartKey{Bucket: "b", UploadID: "u", PartNumber: 2}.String()), V: []byte(`{`)},
+	}})
+	cur := it.Cursor()
+	defer cur.Close()
+
+	require.True(t, cur.Next())
+	require.Nil(t, cur.Item().Err)
+	require.NotNil(t, cur.Item().Upload)
+	require.Nil(t, cur.Item().Part)
+
+	require.True(t, cur.Next())
+	require.Nil(t, cur.Item().Err)
+	require.Equal(t, int64(5), cur.Item().Part.Size)
+
+	// a part that cannot be decoded is not mistaken for a missing one
+	require.True(t, cur.Next())
+	require.Nil(t, cur.Item().Part)
+	require.Error(t, cur.Item().Err)
+
+	require.False(t, cur.Next())
+	require.Nil(t, cur.Err())
+}
@@ -0,0 +1,262 @@
+package ydmeta
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/tikv/client-go/v2/txnkv"
+	"github.com/tikv/client-go/v2/txnkv/transaction"
+)
+
+// Deleted object records sort by deletion time, across buckets. The deleted
+// index lists them by bucket as well, so that the ones of a few buckets are
+// read without going through the others. An index entry holds the packed
+// key of its record; it is written and deleted together with the record,
+// and entries of records written by older versions are added by the
+// deleted-object-index migration. An entry may outlive its record when an
+// older version deletes it, so readers skip entries without a record. The
+// gateway writes legacy records without an entry, so readers of the index
+// also read the legacy records, and take the ones without an entry.
+
+// DeletedIndexMigration is the migration that indexes the deleted object
+// records written before the index was maintained.
+const DeletedIndexMigration = "deleted-object-index"
+
+// setDeletedObject records value as a version of bucket/object deleted now.
+func setDeletedObject(tx *transaction.KVTxn, bucket string, object string, value []byte) error {
+	tsp := time.Now().UnixNano()
+	key := Pack(DELETED_OBJECT_PREFIX, tsp, bucket, object)
+	if err := tx.Set(key, value); err != nil {
+		return err
+	}
+	return tx.Set([]byte(genDeletedIndexKey(bucket, tsp, object)), key)
+}
+
+// withDeletedIndex returns the deleted object keys with the keys of their
+// index entries.
+func withDeletedIndex(keys ...[]byte) [][]byte {
+	ret := make([][]byte, 0, 2*len(keys))
+	for _, key := range keys {
+		ret = append(ret, key)
+		if tsp, bucket, object, ok := parseDeletedObjectKey(key); ok {
+			ret = append(ret, []byte(genDeletedIndexKey(bucket, tsp, object)))
+		}
+	}
+	return ret
+}
+
+// ListBucketsDeletedObjectsByIter iterates the deleted objects of buckets,
+// bucket by bucket, and by deletion time within a bucket, and then the
+// legacy records of buckets that have no index entry, which the gateway
+// writes. It relies on the deleted index, which misses older packed records
+// until DeletedIndexMigration is done. The index and the records are read
+// from fresh snapshots as the iteration goes, see renewingIter.
+//
+// The legacy records are not indexed by bucket, so finding the unindexed
+// ones reads the legacy records of all buckets. Once DeletedIndexMigration
+// is done, the records it indexed are skipped: only the ones deleted since,
+// less legacyIndexMargin, are read. Running the migration again moves that
+// bound forward.
+func (o *ObjectMetaManager) ListBucketsDeletedObjectsByIter(buckets []string) (*ObjectMetaIter, error) {
+	status, err := o.MigrationStatus(DeletedIndexMigration)
+	if err != nil {
+		return nil, err
+	}
+	legacyPrefix := []byte(DELETED_OBJECT_PREFIX + KEY_SEPARATOR)
+	legacyStart := legacyPrefix
+	if status.Done {
+		since := GenDeletedObjectTimeKey(status.Updated.Add(-legacyIndexMargin))
+		if legacyStart, err = legacyPosition([]byte(since)); err != nil {
+			return nil, err
+		}
+	}
+
+	buckets = append([]string(nil), buckets...)
+	sort.Strings(buckets)
+	get := clientBatchGet(o.client)
+	open := make([]func() (kvIter, error), 0, len(buckets)+1)
+	for _, b := range buckets {
+		prefix := []byte(genBucketDeletedIndexKey(b))
+		open = append(open, func() (kvIter, error) {
+			it, err := newRenewingRangeIter(o.client, prefix, prefixEnd(prefix))
+			if err != nil {
+				return nil, err
+			}
+			return newBatchIter(it, resolveIndexed(get))
+		})
+	}
+	open = append(open, func() (kvIter, error) {
+		it, err := newRenewingRangeIter(o.client, legacyStart, prefixEnd(legacyPrefix))
+		if err != nil {
+			return nil, err
+		}
+		return newBatchIter(it, unindexedLegacy(get, buckets))
+	})
+	it, err := newChainIter(open...)
+	if err != nil {
+		return nil, err
+	}
+	return objectMetaIter(it), nil
+}
+
+// legacyIndexMargin is how long before DeletedIndexMigration was done the
+// unindexed legacy records are read from, for the records committed while
+// its last batch was read and the clock skew of the gateways.
+const legacyIndexMargin = time.Hour
+
+// deletedResolveBatch is the number of index entries or records whose keys
+// are read with one BatchGet.
+const deletedResolveBatch = 256
+
+// batchGetter reads the values of the keys that exist.
+type batchGetter func(keys [][]byte) (map[string][]byte, error)
+
+// clientBatchGet reads each batch from a fresh snapshot of tc.
+func clientBatchGet(tc *txnkv.Client) batchGetter {
+	return func(keys [][]byte) (map[string][]byte, error) {
+		tx, err := tc.Begin()
+		if err != nil {
+			return nil, err
+		}
+		return tx.BatchGet(context.TODO(), keys)
+	}
+}
+
+// newRenewingRangeIter iterates the keys from start to end from fresh
+// snapshots of tc.
+func newRenewingRangeIter(tc *txnkv.Client, start []byte, end []byte) (*renewingIter, error) {
+	return newRenewingIter(func(from []byte) (kvIter, error) {
+		tx, err := tc.Begin()
+		if err != nil {
+			return nil, err
+		}
+		if from == nil {
+			from = start
+		}
+		return tx.Iter(from, end)
+	})
+}
+
+// batchIter returns the records load reads for the keys of it, a batch of
+// keys at a time.
+type batchIter struct {
+	it   kvIter
+	buf  []KV
+	load func(it kvIter) ([]KV, error)
+}
+
+func newBatchIter(it kvIter, load func(it kvIter) ([]KV, error)) (*batchIter, error) {
+	b := &batchIter{it: it, load: load}
+	if err := b.fill(); err != nil {
+		it.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// fill loads batches until one has records or the keys run out.
+func (b *batchIter) fill() error {
+	for len(b.buf) == 0 && b.it.Valid() {
+		kvs, err := b.load(b.it)
+		if err != nil {
+			return err
+		}
+		b.buf = kvs
+	}
+	return nil
+}
+
+func (b *batchIter) Valid() bool {
+	return len(b.buf) > 0
+}
+
+func (b *batchIter) Key() []byte {
+	return b.buf[0].K
+}
+
+func (b *batchIter) Value() []byte {
+	return b.buf[0].V
+}
+
+func (b *batchIter) Next() error {
+	b.buf = b.buf[1:]
+	return b.fill()
+}
+
+func (b *batchIter) Close() {
+	b.it.Close()
+}
+
+// resolveIndexed reads the records of the next index entries, skipping the
+// entries without one.
+func resolveIndexed(get batchGetter) func(it kvIter) ([]KV, error) {
+	return func(it kvIter) ([]KV, error) {
+		var keys [][]byte
+		for it.Valid() && len(keys) < 2*deletedResolveBatch {
+			if key, legacy, ok := parseDeletedIndexKey(it.Key()); ok {
+				keys = append(keys, []byte(key), []byte(legacy))
+			}
+			if err := it.Next(); err != nil {
+				return nil, err
+			}
+		}
+		if len(keys) == 0 {
+			return nil, nil
+		}
+		vals, err := get(keys)
+		if err != nil {
+			return nil, err
+		}
+		var kvs []KV
+		for i := 0; i < len(keys); i += 2 {
+			// the packed record first, like getDual
+			for _, key := range keys[i : i+2] {
+				if val, ok := vals[string(key)]; ok {
+					kvs = append(kvs, KV{K: key, V: val})
+					break
+				}
+			}
+		}
+		return kvs, nil
+	}
+}
+
+// unindexedLegacy reads the next legacy deleted object records of buckets
+// that have no index entry.
+func unindexedLegacy(get batchGetter, buckets []string) func(it kvIter) ([]KV, error) {
+	scoped := make(map[string]struct{}, len(buckets))
+	for _, b := range buckets {
+		scoped[b] = struct{}{}
+	}
+	return func(it kvIter) ([]KV, error) {
+		var kvs []KV
+		var index [][]byte
+		for it.Valid() && len(kvs) < deletedResolveBatch {
+			if tk, ok := legacyToTupleKey(it.Key()); ok {
+				tsp, bucket, object, ok := parseDeletedObjectKey(tk)
+				if _, in := scoped[bucket]; ok && in {
+					kvs = append(kvs, KV{K: append([]byte(nil), it.Key()...), V: append([]byte(nil), it.Value()...)})
+					index = append(index, []byte(genDeletedIndexKey(bucket, tsp, object)))
+				}
+			}
+			if err := it.Next(); err != nil {
+				return nil, err
+			}
+		}
+		if len(kvs) == 0 {
+			return nil, nil
+		}
+		indexed, err := get(index)
+		if err != nil {
+			return nil, err
+		}
+		ret := kvs[:0]
+		for i, kv := range kvs {
+			if _, ok := indexed[string(index[i])]; !ok {
+				ret = append(ret, kv)
+			}
+		}
+		return ret, nil
+	}
+}
@@ -0,0 +1,298 @@
+package ydmeta
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	tikverr "github.com/tikv/client-go/v2/error"
+	"github.com/tikv/client-go/v2/txnkv/transaction"
+)
+
+// Until every record has been rewritten, a record may live under its packed
+// key or its legacy key. Point reads try the packed key first, writes go to
+// the packed key and delete the legacy one, and scans merge both ranges.
+
+// getDual reads key, or legacy when key does not exist, and returns the key
+// it found. It returns tikverr.ErrNotExist when neither exists.
+func getDual(tx *transaction.KVTxn, key string, legacy string) ([]byte, string, error) {
+	val, err := tx.Get(context.TODO(), []byte(key))
+	if err == nil {
+		return val, key, nil
+	}
+	if !errors.Is(err, tikverr.ErrNotExist) {
+		return nil, "", err
+	}
+	val, err = tx.Get(context.TODO(), []byte(legacy))
+	if err != nil {
+		return nil, "", err
+	}
+	return val, legacy, nil
+}
+
+func (m *MetaManager) getDual(key string, legacy string) ([]byte, error) {
+	tx, err := m.client.Begin()
+	if err != nil {
+		return nil, err
+	}
+	val, _, err := getDual(tx, key, legacy)
+	return val, err
+}
+
+// setDual writes key and removes the legacy copy of the record.
+func setDual(tx *transaction.KVTxn, key string, legacy string, value []byte) error {
+	if err := tx.Set([]byte(key), value); err != nil {
+		return err
+	}
+	return tx.Delete([]byte(legacy))
+}
+
+// deleteDual deletes the record under both keys.
+func deleteDual(tx *transaction.KVTxn, key string, legacy string) error {
+	if err := tx.Delete([]byte(key)); err != nil {
+		return err
+	}
+	return tx.Delete([]byte(legacy))
+}
+
+// kvIter is the iterator returned by KVTxn.Iter.
+type kvIter interface {
+	Valid() bool
+	Key() []byte
+	Value() []byte
+	Next() error
+	Close()
+}
+
+// mergedIter merges iterators over the packed and the legacy ranges of the
+// same records in the order of their packed keys. Each iterator must return
+// its keys in that order, which legacy iterators only do through
+// sortedLegacyIter or checkedLegacyIter. When a record exists under both
+// keys, only the first iterator's copy is returned.
+type mergedIter struct {
+	iters   []kvIter
+	cur     int
+	order   []byte
+	reverse bool
+}
+
+func newMergedIter(iters ...kvIter) *mergedIter {
+	m := &mergedIter{iters: iters}
+	m.pick()
+	return m
+}
+
+// newReverseMergedIter merges reverse iterators, in descending order.
+func newReverseMergedIter(iters ...kvIter) *mergedIter {
+	m := &mergedIter{iters: iters, reverse: true}
+	m.pick()
+	return m
+}
+
+func (m *mergedIter) pick() {
+	m.cur, m.order = -1, nil
+	for i, it := range m.iters {
+		if !it.Valid() {
+			continue
+		}
+		k := orderKey(it.Key())
+		c := bytes.Compare(k, m.order)
+		if m.cur < 0 || (!m.reverse && c < 0) || (m.reverse && c > 0) {
+			m.cur, m.order = i, k
+		}
+	}
+}
+
+func (m *mergedIter) Valid() bool {
+	return m.cur >= 0
+}
+
+func (m *mergedIter) Key() []byte {
+	return m.iters[m.cur].Key()
+}
+
+func (m *mergedIter) Value() []byte {
+	return m.iters[m.cur].Value()
+}
+
+func (m *mergedIter) Next() error {
+	order := m.order
+	for _, it := range m.iters {
+		for it.Valid() && bytes.Equal(orderKey(it.Key()), order) {
+			if err := it.Next(); err != nil {
+				m.cur = -1
+				return err
+			}
+		}
+	}
+	m.pick()
+	return nil
+}
+
+func (m *mergedIter) Close() {
+	for _, it := range m.iters {
+		it.Close()
+	}
+}
+
+// chainIter iterates ranges one after the other. Each range is opened when
+// the previous one is exhausted, from the same transaction, so that all of
+// them are read from one snapshot.
+type chainIter struct {
+	open []func() (kvIter, error)
+	cur  kvIter
+}
+
+func newChainIter(open ...func() (kvIter, error)) (*chainIter, error) {
+	c := &chainIter{open: open}
+	if err := c.advance(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// advance opens ranges until one has keys left or none is left.
+func (c *chainIter) advance() error {
+	for (c.cur == nil || !c.cur.Valid()) && len(c.open) > 0 {
+		if c.cur != nil {
+			c.cur.Close()
+			c.cur = nil
+		}
+		it, err := c.open[0]()
+		if err != nil {
+			return err
+		}
+		c.cur, c.open = it, c.open[1:]
+	}
+	return nil
+}
+
+func (c *chainIter) Valid() bool {
+	return c.cur != nil && c.cur.Valid()
+}
+
+func (c *chainIter) Key() []byte {
+	return c.cur.Key()
+}
+
+func (c *chainIter) Value() []byte {
+	return c.cur.Value()
+}
+
+func (c *chainIter) Next() error {
+	if err := c.cur.Next(); err != nil {
+		return err
+	}
+	return c.advance()
+}
+
+func (c *chainIter) Close() {
+	if c.cur != nil {
+		c.cur.Close()
+	}
+}
+
+// iterDual iterates over the packed keys with prefix and the legacy keys
+// with legacyPrefix, starting at start and legacyStart when they are set.
+// A legacy prefix of the keys below a name must end with KEY_SEPARATOR, or
+// it also covers the names it prefixes.
+func iterDual(tx *transaction.KVTxn, prefix []byte, start []byte, legacyPrefix []byte,
+	legacyStart []byte) (*mergedIter, error) {
+	return iterDualWith(txnIter(tx), prefix, start, legacyPrefix, legacyStart)
+}
+
+// rangeIter opens an iterator over the keys from start to end.
+type rangeIter func(start []byte, end []byte) (kvIter, error)
+
+func txnIter(tx *transaction.KVTxn) rangeIter {
+	return func(start []byte, end []byte) (kvIter, error) {
+		it, err := tx.Iter(start, end)
+		if err != nil {
+			return nil, err
+		}
+		return it, nil
+	}
+}
+
+// iterDualWith is iterDual over the ranges iter opens.
+func iterDualWith(iter rangeIter, prefix []byte, start []byte, legacyPrefix []byte,
+	legacyStart []byte) (*mergedIter, error) {
+	if start == nil {
+		start = prefix
+	}
+	if legacyStart == nil {
+		legacyStart = legacyPrefix
+	}
+	it, err := iter(start, prefixEnd(prefix))
+	if err != nil {
+		return nil, err
+	}
+	legacyStart, legacyEnd := legacyRange(legacyPrefix, legacyStart, prefixEnd(legacyPrefix))
+	rawIt, err := iter(legacyStart, legacyEnd)
+	if err != nil {
+		it.Close()
+		return nil, err
+	}
+	legacyIt, err := newSortedLegacyIter(rawIt, start, prefixEnd(prefix))
+	if err != nil {
+		it.Close()
+		rawIt.Close()
+		return nil, err
+	}
+	return newMergedIter(it, legacyIt), nil
+}
+
+// listDual lists up to limit records of both formats, -1 for all.
+func (m *MetaManager) listDual(prefix []byte, start []byte, legacyPrefix []byte, legacyStart []byte,
+	limit int) ([]KV, error) {
+	tx, err := m.client.Begin()
+	if err != nil {
+		return nil, err
+	}
+	it, err := iterDual(tx, prefix, start, legacyPrefix, legacyStart)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	var ret []KV
+	for it.Valid() && limit != 0 {
+		limit--
+		ret = append(ret, KV{K: it.Key()[:], V: it.Value()[:]})
+		if err = it.Next(); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// setIfAbsentDual writes key unless the record exists in either format.
+func (m *MetaManager) setIfAbsentDual(key string, legacy string, value []byte) error {
+	tx, err := m.client.Begin()
+	if err != nil {
+		return err
+	}
+	_, _, err = getDual(tx, key, legacy)
+	if err == nil {
+		return fmt.Errorf("key %q has existed", key)
+	}
+	if !errors.Is(err, tikverr.ErrNotExist) {
+		return err
+	}
+	if err = tx.Set([]byte(key), value); err != nil {
+		return err
+	}
+	return tx.Commit(context.Background())
+}
+
+func (m *MetaManager) delsDual(key string, legacy string) error {
+	tx, err := m.client.Begin()
+	if err != nil {
+		return err
+	}
+	if err = deleteDual(tx, key, legacy); err != nil {
+		return err
+	}
+	return tx.Commit(context.Background())
+}
@@ -0,0 +1,344 @@
+package ydmeta
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tikv/client-go/v2/txnkv"
+	"github.com/tikv/client-go/v2/txnkv/transaction"
+)
+
+// ErrNotSeekable is returned by Seek on the iterators that read several
+// ranges one after the other.
+var ErrNotSeekable = errors.New("iterator does not support Seek")
+
+// IterOptions bound an iteration and set its direction. Start and End are
+// packed keys, or packed prefixes of keys, of the space iterated, such as
+// GenObjectKey(bucket, name); the legacy keys of the records between them are
+// iterated as well. Start is inclusive and End exclusive, and nil leaves a
+// side unbounded.
+type IterOptions struct {
+	Start []byte
+	End   []byte
+	// Reverse iterates from End down to Start.
+	Reverse bool
+}
+
+// GenDeletedObjectTimeKey is the position of the objects deleted at t among
+// the deleted object records, to bound iterations with.
+func GenDeletedObjectTimeKey(t time.Time) string {
+	return string(Pack(DELETED_OBJECT_PREFIX, t.UnixNano()))
+}
+
+// legacyPosition returns the legacy key at the position of packed among the
+// legacy keys, packed being a key or a prefix of keys.
+func legacyPosition(packed []byte) ([]byte, error) {
+	e, err := Unpack(packed)
+	if err != nil || len(e) == 0 {
+		return nil, fmt.Errorf("%q is not a packed key", packed)
+	}
+	parts := make([]string, 0, len(e))
+	for i, x := range e {
+		switch v := x.(type) {
+		case string:
+			parts = append(parts, v)
+		case int64:
+			if i == 3 && e[0] == MULTIPART_PREFIX {
+				parts = append(parts, EncodePartNumber(int(v)))
+			} else {
+				parts = append(parts, strconv.FormatInt(v, 10))
+			}
+		}
+	}
+	return []byte(strings.Join(parts, KEY_SEPARATOR)), nil
+}
+
+// minKey returns the smaller of two end keys, nil being the greatest.
+func minKey(a []byte, b []byte) []byte {
+	if a == nil || (b != nil && bytes.Compare(b, a) < 0) {
+		return b
+	}
+	return a
+}
+
+func txnReverseIter(tx *transaction.KVTxn) rangeIter {
+	return func(start []byte, end []byte) (kvIter, error) {
+		it, err := tx.IterReverse(end)
+		if err != nil {
+			return nil, err
+		}
+		return &lowerBoundIter{it: it, lower: start}, nil
+	}
+}
+
+// lowerBoundIter ends a reverse iterator, which has no lower bound, at lower.
+type lowerBoundIter struct {
+	it    kvIter
+	lower []byte
+}
+
+func (l *lowerBoundIter) Valid() bool {
+	return l.it.Valid() && bytes.Compare(l.it.Key(), l.lower) >= 0
+}
+
+func (l *lowerBoundIter) Key() []byte {
+	return l.it.Key()
+}
+
+func (l *lowerBoundIter) Value() []byte {
+	return l.it.Value()
+}
+
+func (l *lowerBoundIter) Next() error {
+	return l.it.Next()
+}
+
+func (l *lowerBoundIter) Close() {
+	l.it.Close()
+}
+
+// snapshotLifetime is how long a renewingIter reads from one snapshot. It
+// is well within the GC lifetime of TiKV, ten minutes by default, past which
+// a snapshot can no longer be read.
+const snapshotLifetime = time.Minute
+
+// renewingIter reads a range from fresh snapshots, for scans that may take
+// longer than a snapshot lives: once its snapshot is older than
+// snapshotLifetime, it reopens the range from the key it is at. The records
+// read are therefore not from a single point in time.
+type renewingIter struct {
+	// open opens the range in a new transaction, at start or, when start is
+	// nil, at the beginning of the range.
+	open   func(start []byte) (kvIter, error)
+	cur    kvIter
+	opened time.Time
+}
+
+func newRenewingIter(open func(start []byte) (kvIter, error)) (*renewingIter, error) {
+	r := &renewingIter{open: open}
+	if err := r.reopen(nil); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *renewingIter) reopen(start []byte) error {
+	it, err := r.open(start)
+	if err != nil {
+		return err
+	}
+	if r.cur != nil {
+		r.cur.Close()
+	}
+	r.cur, r.opened = it, time.Now()
+	return nil
+}
+
+// Seek reopens the range at key from a fresh snapshot.
+func (r *renewingIter) Seek(key []byte) error {
+	return r.reopen(key)
+}
+
+func (r *renewingIter) Valid() bool {
+	return r.cur.Valid()
+}
+
+func (r *renewingIter) Key() []byte {
+	return r.cur.Key()
+}
+
+func (r *renewingIter) Value() []byte {
+	return r.cur.Value()
+}
+
+func (r *renewingIter) Next() error {
+	if time.Since(r.opened) < snapshotLifetime {
+		return r.cur.Next()
+	}
+	// the fresh snapshot is opened at the current key, which is skipped
+	// unless it has been deleted since
+	key := append([]byte(nil), r.cur.Key()...)
+	if err := r.reopen(key); err != nil {
+		return err
+	}
+	if r.cur.Valid() && bytes.Equal(r.cur.Key(), key) {
+		return r.cur.Next()
+	}
+	return nil
+}
+
+func (r *renewingIter) Close() {
+	r.cur.Close()
+}
+
+// newRenewingDualIter is newDualIter over fresh snapshots of tc.
+func newRenewingDualIter(tc *txnkv.Client, prefix []byte, legacyPrefix []byte, opt IterOptions) (*renewingIter, error) {
+	return newRenewingIter(func(start []byte) (kvIter, error) {
+		tx, err := tc.Begin()
+		if err != nil {
+			return nil, err
+		}
+		d, err := newDualIter(txnIter(tx), txnReverseIter(tx), prefix, legacyPrefix, opt)
+		if err != nil {
+			return nil, err
+		}
+		if start != nil {
+			if err = d.Seek(start); err != nil {
+				d.Close()
+				return nil, err
+			}
+		}
+		return d, nil
+	})
+}
+
+// emptyIter is the iterator of an empty range.
+type emptyIter struct{}
+
+func (emptyIter) Valid() bool   { return false }
+func (emptyIter) Key() []byte   { return nil }
+func (emptyIter) Value() []byte { return nil }
+func (emptyIter) Next() error   { return nil }
+func (emptyIter) Close()        {}
+
+// dualIter iterates the records of both formats between two bounds, in
+// either direction, and seeks by reopening its ranges from the same
+// transaction.
+type dualIter struct {
+	iter                   rangeIter
+	reverse                bool
+	start, end             []byte
+	legacyPrefix           []byte
+	legacyStart, legacyEnd []byte
+	cur                    *mergedIter
+}
+
+// newDualIter iterates the packed keys with prefix and the legacy keys with
+// legacyPrefix within the bounds of opt. fwd and rev open forward and
+// reverse iterators over the same snapshot.
+func newDualIter(fwd rangeIter, rev rangeIter, prefix []byte, legacyPrefix []byte,
+	opt IterOptions) (*dualIter, error) {
+	d := &dualIter{
+		iter:         fwd,
+		reverse:      opt.Reverse,
+		start:        prefix,
+		end:          prefixEnd(prefix),
+		legacyPrefix: legacyPrefix,
+		legacyStart:  legacyPrefix,
+		legacyEnd:    prefixEnd(legacyPrefix),
+	}
+	if opt.Reverse {
+		d.iter = rev
+	}
+	if opt.Start != nil {
+		legacy, err := legacyPosition(opt.Start)
+		if err != nil {
+			return nil, err
+		}
+		d.start, d.legacyStart = maxKey(d.start, opt.Start), maxKey(d.legacyStart, legacy)
+	}
+	if opt.End != nil {
+		legacy, err := legacyPosition(opt.End)
+		if err != nil {
+			return nil, err
+		}
+		d.end, d.legacyEnd = minKey(d.end, opt.End), minKey(d.legacyEnd, legacy)
+	}
+	if err := d.open(d.start, d.end, d.legacyStart, d.legacyEnd); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *dualIter) open(start []byte, end []byte, legacyStart []byte, legacyEnd []byte) error {
+	it, err := d.openRange(start, end)
+	if err != nil {
+		return err
+	}
+	legacyIt, err := d.openLegacyRange(start, end, legacyStart, legacyEnd)
+	if err != nil {
+		it.Close()
+		return err
+	}
+	if d.cur != nil {
+		d.cur.Close()
+	}
+	if d.reverse {
+		d.cur = newReverseMergedIter(it, legacyIt)
+	} else {
+		d.cur = newMergedIter(it, legacyIt)
+	}
+	return nil
+}
+
+// openLegacyRange opens the legacy keys from legacyStart to legacyEnd whose
+// packed keys are from start to end, in the order of the packed keys.
+func (d *dualIter) openLegacyRange(start []byte, end []byte, legacyStart []byte, legacyEnd []byte) (kvIter, error) {
+	if legacyEnd != nil && bytes.Compare(legacyStart, legacyEnd) >= 0 {
+		return emptyIter{}, nil
+	}
+	legacyStart, legacyEnd = legacyRange(d.legacyPrefix, legacyStart, legacyEnd)
+	it, err := d.openRange(legacyStart, legacyEnd)
+	if err != nil {
+		return nil, err
+	}
+	var legacyIt kvIter
+	if d.reverse {
+		legacyIt, err = newCheckedLegacyIter(it, start, end)
+	} else {
+		legacyIt, err = newSortedLegacyIter(it, start, end)
+	}
+	if err != nil {
+		it.Close()
+		return nil, err
+	}
+	return legacyIt, nil
+}
+
+func (d *dualIter) openRange(start []byte, end []byte) (kvIter, error) {
+	if end != nil && bytes.Compare(start, end) >= 0 {
+		return emptyIter{}, nil
+	}
+	return d.iter(start, end)
+}
+
+// Seek moves to the first record at or after key, or at or before it in
+// reverse, within the bounds. key is a record key of either format, or a
+// packed prefix of keys.
+func (d *dualIter) Seek(key []byte) error {
+	packed := orderKey(key)
+	legacy, err := legacyPosition(packed)
+	if err != nil {
+		return err
+	}
+	if !d.reverse {
+		return d.open(maxKey(d.start, packed), d.end, maxKey(d.legacyStart, legacy), d.legacyEnd)
+	}
+	after := append(append([]byte(nil), packed...), 0x00)
+	legacyAfter := append(legacy, 0x00)
+	return d.open(d.start, minKey(d.end, after), d.legacyStart, minKey(d.legacyEnd, legacyAfter))
+}
+
+func (d *dualIter) Valid() bool {
+	return d.cur.Valid()
+}
+
+func (d *dualIter) Key() []byte {
+	return d.cur.Key()
+}
+
+func (d *dualIter) Value() []byte {
+	return d.cur.Value()
+}
+
+func (d *dualIter) Next() error {
+	return d.cur.Next()
+}
+
+func (d *dualIter) Close() {
+	d.cur.Close()
+}
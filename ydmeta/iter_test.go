@@ -0,0 +1,298 @@
+package ydmeta
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// deletedBase is a deletion time of the same width as the times of real
+// records, whose legacy keys sort by time only thanks to it.
+var deletedBase = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano()
+
+func deletedAt(i int64) time.Time {
+	return time.Unix(0, deletedBase+i)
+}
+
+// newDeletedStore stores deleted records of buckets a and b at times 1 to
+// n after deletedBase, the odd ones under their legacy key and every fifth
+// under both.
+func newDeletedStore(n int) (*memStore, []string) {
+	m := &memStore{}
+	var order []string
+	for i := int64(1); i <= int64(n); i++ {
+		tsp := deletedBase + i
+		for _, b := range []string{"a", "b"} {
+			packed := string(Pack(DELETED_OBJECT_PREFIX, tsp, b, "obj"))
+			legacy := legacyDeletedObjectKey(tsp, b, "obj")
+			switch {
+			case i%5 == 0:
+				m.keys = append(m.keys, packed, legacy)
+			case i%2 == 1:
+				m.keys = append(m.keys, legacy)
+			default:
+				m.keys = append(m.keys, packed)
+			}
+			order = append(order, packed)
+		}
+	}
+	sort.Strings(m.keys)
+	return m, order
+}
+
+func collectOrder(t *testing.T, it kvIter) []string {
+	var got []string
+	for it.Valid() {
+		got = append(got, string(orderKey(it.Key())))
+		require.NoError(t, it.Next())
+	}
+	return got
+}
+
+func reversed(keys []string) []string {
+	ret := make([]string, len(keys))
+	for i, k := range keys {
+		ret[len(keys)-1-i] = k
+	}
+	return ret
+}
+
+func TestDualIterRange(t *testing.T) {
+	m, order := newDeletedStore(20)
+	prefix, legacyPrefix := Pack(DELETED_OBJECT_PREFIX), []byte(DELETED_OBJECT_PREFIX+KEY_SEPARATOR)
+	open := func(opt IterOptions) *dualIter {
+		it, err := newDualIter(m.iter, m.reverseIter, prefix, legacyPrefix, opt)
+		require.NoError(t, err)
+		return it
+	}
+
+	require.Equal(t, order, collectOrder(t, open(IterOptions{})))
+	require.Equal(t, reversed(order), collectOrder(t, open(IterOptions{Reverse: true})))
+
+	// records deleted from time 5 to before time 15
+	opt := IterOptions{
+		Start: []byte(GenDeletedObjectTimeKey(deletedAt(5))),
+		End:   []byte(GenDeletedObjectTimeKey(deletedAt(15))),
+	}
+	require.Equal(t, order[8:28], collectOrder(t, open(opt)))
+	opt.Reverse = true
+	require.Equal(t, reversed(order[8:28]), collectOrder(t, open(opt)))
+
+	// resume from a key of either format
+	it := open(IterOptions{})
+	require.NoError(t, it.Seek([]byte(legacyDeletedObjectKey(deletedBase+7, "b", "obj"))))
+	require.Equal(t, order[13:], collectOrder(t, it))
+	it = open(IterOptions{Reverse: true})
+	require.NoError(t, it.Seek(Pack(DELETED_OBJECT_PREFIX, deletedBase+10, "a", "obj")))
+	require.Equal(t, reversed(order[:19]), collectOrder(t, it))
+
+	// seeks stay within the bounds
+	it = open(IterOptions{End: []byte(GenDeletedObjectTimeKey(deletedAt(4)))})
+	require.NoError(t, it.Seek([]byte(GenDeletedObjectTimeKey(deletedAt(2)))))
+	require.Equal(t, order[2:6], collectOrder(t, it))
+	require.NoError(t, it.Seek([]byte(GenDeletedObjectTimeKey(deletedAt(9)))))
+	require.False(t, it.Valid())
+
+	require.Error(t, it.Seek([]byte("not a key")))
+}
+
+func TestRenewingIter(t *testing.T) {
+	m, order := newDeletedStore(10)
+	prefix, legacyPrefix := Pack(DELETED_OBJECT_PREFIX), []byte(DELETED_OBJECT_PREFIX+KEY_SEPARATOR)
+	it, err := newRenewingIter(func(start []byte) (kvIter, error) {
+		d, err := newDualIter(m.iter, m.reverseIter, prefix, legacyPrefix, IterOptions{})
+		if err == nil && start != nil {
+			err = d.Seek(start)
+		}
+		return d, err
+	})
+	require.NoError(t, err)
+	// deleting copies the keys, so that open iterators keep theirs
+	remove := func(key string) {
+		var keys []string
+		for _, k := range m.keys {
+			if string(orderKey([]byte(k))) != key {
+				keys = append(keys, k)
+			}
+		}
+		m.keys = keys
+	}
+
+	var got []string
+	for it.Valid() {
+		got = append(got, string(orderKey(it.Key())))
+		if len(got) == 4 {
+			// the current record and a later one go away
+			remove(order[3])
+			remove(order[6])
+		}
+		// every key is read from a fresh snapshot
+		it.opened = it.opened.Add(-snapshotLifetime)
+		require.NoError(t, it.Next())
+	}
+	require.Equal(t, append(append([]string(nil), order[:6]...), order[7:]...), got)
+}
+
+func TestLegacyPosition(t *testing.T) {
+	cases := map[string]string{
+		string(Pack(DELETED_OBJECT_PREFIX, int64(12))):              DELETED_OBJECT_PREFIX + "#12",
+		GenObjectKey("b", "dir/o"):                                  legacyObjectKey("b", "dir/o"),
+		GenMultipartKey("b", "u"):                                   legacyMultipartKey("b", "u"),
+		PartKey{Bucket: "b", UploadID: "u", PartNumber: 3}.String(): PartKey{Bucket: "b", UploadID: "u", PartNumber: 3}.legacyString(),
+	}
+	for packed, legacy := range cases {
+		got, err := legacyPosition([]byte(packed))
+		require.NoError(t, err)
+		require.Equal(t, legacy, string(got))
+	}
+	_, err := legacyPosition([]byte(legacyObjectKey("b", "o")))
+	require.Error(t, err)
+}
+
+// newDeviantStore stores upload records and parts of buckets whose names
+// hold a byte below the separator, so that their legacy keys sort unlike
+// their packed keys, some under their legacy key and one under both.
+func newDeviantStore() (*memStore, []string) {
+	m := &memStore{}
+	var order []string
+	for i, b := range []string{"a", "a!b", "a!b!c", "a-b", "b"} {
+		for j, u := range []string{"u1", "u2"} {
+			pk := PartKey{Bucket: b, UploadID: u, PartNumber: 1}
+			packed := []string{GenMultipartKey(b, u), pk.String()}
+			legacy := []string{legacyMultipartKey(b, u), pk.legacyString()}
+			switch {
+			case i == 1 && j == 0:
+				m.keys = append(m.keys, packed...)
+				m.keys = append(m.keys, legacy...)
+			case (i+j)%2 == 0:
+				m.keys = append(m.keys, legacy...)
+			default:
+				m.keys = append(m.keys, packed...)
+			}
+			order = append(order, packed...)
+		}
+	}
+	sort.Strings(m.keys)
+	sort.Strings(order)
+	return m, order
+}
+
+func TestLegacyOrder(t *testing.T) {
+	m, order := newDeviantStore()
+	prefix, legacyPrefix := Pack(MULTIPART_PREFIX), []byte(MULTIPART_PREFIX+KEY_SEPARATOR)
+	require.True(t, legacyDeviant([]byte(legacyMultipartKey("a!b", "u1"))))
+	require.True(t, legacyDeviant([]byte(PartKey{Bucket: "a", UploadID: "u!1", PartNumber: 1}.legacyString())))
+	require.False(t, legacyDeviant([]byte(legacyMultipartKey("a", "u!1"))))
+	require.False(t, legacyDeviant([]byte(legacyObjectKey("a", "dir!/o"))))
+
+	it, err := iterDualWith(m.iter, prefix, nil, legacyPrefix, nil)
+	require.NoError(t, err)
+	require.Equal(t, order, collectOrder(t, it))
+
+	open := func(opt IterOptions) *dualIter {
+		it, err := newDualIter(m.iter, m.reverseIter, prefix, legacyPrefix, opt)
+		require.NoError(t, err)
+		return it
+	}
+	require.Equal(t, order, collectOrder(t, open(IterOptions{})))
+
+	// the records of bucket a!b and the ones after it
+	start := []byte(genBucketMultipartKey("a!b"))
+	from := sort.SearchStrings(order, string(start))
+	it, err = iterDualWith(m.iter, prefix, start, legacyPrefix, []byte(legacyMultipartKey("a!b", "")))
+	require.NoError(t, err)
+	require.Equal(t, order[from:], collectOrder(t, it))
+	require.Equal(t, order[from:], collectOrder(t, open(IterOptions{Start: start})))
+
+	// the records of bucket a!b only
+	end := []byte(genBucketMultipartKey("a!b!c"))
+	to := sort.SearchStrings(order, string(end))
+	require.Equal(t, order[from:to], collectOrder(t, open(IterOptions{Start: start, End: end})))
+
+	// reverse scans fail rather than return them out of order
+	rev := open(IterOptions{Reverse: true})
+	var err2 error
+	for rev.Valid() && err2 == nil {
+		err2 = rev.Next()
+	}
+	require.ErrorIs(t, err2, ErrLegacyOrder)
+}
+
+// mapGetter is a batchGetter over the keys of records, counting its calls.
+type mapGetter struct {
+	records map[string]bool
+	calls   int
+}
+
+func (m *mapGetter) get(keys [][]byte) (map[string][]byte, error) {
+	m.calls++
+	vals := make(map[string][]byte)
+	for _, k := range keys {
+		if m.records[string(k)] {
+			vals[string(k)] = []byte(`{"size":1}`)
+		}
+	}
+	return vals, nil
+}
+
+func collectKeys(t *testing.T, it kvIter) []string {
+	var got []string
+	for it.Valid() {
+		got = append(got, string(it.Key()))
+		require.NoError(t, it.Next())
+	}
+	return got
+}
+
+func TestDeletedIndexBatches(t *testing.T) {
+	// index entries of records under either key, or whose record is gone
+	m, g := &memStore{}, &mapGetter{records: make(map[string]bool)}
+	var want []string
+	n := 3 * deletedResolveBatch
+	for i := 0; i < n; i++ {
+		tsp := deletedBase + int64(i)
+		m.keys = append(m.keys, genDeletedIndexKey("b", tsp, "obj"))
+		switch i % 3 {
+		case 0:
+			key := string(Pack(DELETED_OBJECT_PREFIX, tsp, "b", "obj"))
+			g.records[key] = true
+			want = append(want, key)
+		case 1:
+			key := legacyDeletedObjectKey(tsp, "b", "obj")
+			g.records[key] = true
+			want = append(want, key)
+		}
+	}
+	sort.Strings(m.keys)
+	it, err := m.iter(nil, nil)
+	require.NoError(t, err)
+	b, err := newBatchIter(it, resolveIndexed(g.get))
+	require.NoError(t, err)
+	require.Equal(t, want, collectKeys(t, b))
+	require.Equal(t, n/deletedResolveBatch, g.calls)
+
+	// legacy records of the buckets asked for, without an index entry
+	m, g = &memStore{}, &mapGetter{records: make(map[string]bool)}
+	want = nil
+	for i := 0; i < 4; i++ {
+		tsp := deletedBase + int64(i)
+		for _, bucket := range []string{"b", "c"} {
+			key := legacyDeletedObjectKey(tsp, bucket, "obj")
+			m.keys = append(m.keys, key)
+			if i%2 == 0 {
+				g.records[genDeletedIndexKey(bucket, tsp, "obj")] = true
+			} else if bucket == "b" {
+				want = append(want, key)
+			}
+		}
+	}
+	m.keys = append(m.keys, string(Pack(DELETED_OBJECT_PREFIX, deletedBase, "b", "obj")))
+	sort.Strings(m.keys)
+	it, err = m.iter(nil, nil)
+	require.NoError(t, err)
+	b, err = newBatchIter(it, unindexedLegacy(g.get, []string{"b"}))
+	require.NoError(t, err)
+	require.Equal(t, want, collectKeys(t, b))
+}
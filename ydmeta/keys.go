@@ -14,50 +14,79 @@ const (
 	OBJECT_PREFIX         = "YDS3_OBJECT"
 	DELETED_OBJECT_PREFIX = "YDS3_DELETED_OBJECT"
 	DELETED_BUCKET_PREFIX = "YDS3_DELETED_BUCKET"
+	DELETED_INDEX_PREFIX  = "YDS3_DELETED_INDEX"
 
 	MULTIPART_PREFIX         = "YDS3_MULTIPART"
 	DELETED_MULTIPART_PREFIX = "YDS3_DELETED_MULTIPART"
+	UPLOAD_INDEX_PREFIX      = "YDS3_UPLOAD_INDEX"
+
+	LEASE_PREFIX = "YDS3_LEASE"
+
+	MIGRATION_PREFIX = "YDS3_MIGRATION"
+
+	QUARANTINE_PREFIX = "YDS3_QUARANTINE"
+	AUDIT_PREFIX      = "YDS3_AUDIT"
 
 	ObjectLargeType = "large"
 )
 
+// Keys are packed tuples, see Pack, whose first element is one of the
+// prefixes above. Older versions joined the same fields with KEY_SEPARATOR,
+// which breaks on names containing it; those legacy keys are still read,
+// and are replaced by packed keys whenever their record is written. The
+// legacy* functions at the end of this file build them.
+
 // GenObjectKey generate object key
 func GenObjectKey(bucket string, object string) string {
-	return fmt.Sprintf("%s#%s#%s", OBJECT_PREFIX, bucket, object)
+	return string(Pack(OBJECT_PREFIX, bucket, object))
 }
 
 // GenBucketObjectKey generate objects key of specific bucket
 func GenBucketObjectKey(bucket string) string {
-	return fmt.Sprintf("%s#%s", OBJECT_PREFIX, bucket)
+	return string(Pack(OBJECT_PREFIX, bucket))
 }
 
 // GenDeletedObjectKey generate deleted object key
 func GenDeletedObjectKey(bucket string, object string) string {
-	tsp := time.Now().UnixNano()
-	return fmt.Sprintf("%s#%d#%s#%s", DELETED_OBJECT_PREFIX, tsp, bucket, object)
+	return string(Pack(DELETED_OBJECT_PREFIX, time.Now().UnixNano(), bucket, object))
 }
 
 func GenBucketKey(bucket string) string {
-	return fmt.Sprintf("%s#%s", BUCKET_PREFIX, bucket)
+	return string(Pack(BUCKET_PREFIX, bucket))
 }
 
 func GetDeletedObjectKey() string {
-	return fmt.Sprintf("%s#", DELETED_OBJECT_PREFIX)
-}
-
-func GenDeletedObjectPrefix(prefix string) string {
-	return fmt.Sprintf("%s#%s", DELETED_OBJECT_PREFIX, prefix)
+	return string(Pack(DELETED_OBJECT_PREFIX))
 }
 
+// ParseObjectKey returns the object name of an object key.
 func ParseObjectKey(key string) (string, bool) {
-	seg := strings.Split(key, "#")
+	if isTupleKey([]byte(key)) {
+		e, err := Unpack([]byte(key))
+		if err != nil || len(e) != 3 || e[0] != OBJECT_PREFIX {
+			return "", false
+		}
+		object, ok := e[2].(string)
+		return object, ok
+	}
+	seg := strings.SplitN(key, KEY_SEPARATOR, 3)
 	if len(seg) < 3 {
 		return "", false
 	}
 	return seg[2], true
 }
 
+// ParseDeletedObjectKey returns the deletion time of a deleted object key,
+// in nanoseconds.
 func ParseDeletedObjectKey(key string) (int64, bool) {
+	if isTupleKey([]byte(key)) {
+		e, err := Unpack([]byte(key))
+		if err != nil || len(e) < 2 || e[0] != DELETED_OBJECT_PREFIX {
+			return 0, false
+		}
+		tsp, ok := e[1].(int64)
+		return tsp, ok
+	}
 	seg := strings.Split(key, "#")
 	if len(seg) < 2 {
 		return 0, false
@@ -69,13 +98,399 @@ func ParseDeletedObjectKey(key string) (int64, bool) {
 	return tsp, true
 }
 
-//GenMultipartKey generate multipart key
-func GenMultipartKey(bucket string, object string) string {
-	return fmt.Sprintf("%s#%s#%s", MULTIPART_PREFIX, bucket, object)
+// parseDeletedObjectKey returns the deletion time, the bucket and the object
+// name of a deleted object key of either format.
+func parseDeletedObjectKey(key []byte) (tsp int64, bucket string, object string, ok bool) {
+	if packed, isLegacy := legacyToTupleKey(key); isLegacy {
+		key = packed
+	}
+	e, err := Unpack(key)
+	if err != nil || len(e) != 4 || e[0] != DELETED_OBJECT_PREFIX {
+		return 0, "", "", false
+	}
+	tsp, ok1 := e[1].(int64)
+	bucket, ok2 := e[2].(string)
+	object, ok3 := e[3].(string)
+	return tsp, bucket, object, ok1 && ok2 && ok3
+}
+
+// genDeletedIndexKey is the key of the index entry of the object record
+// deleted at tsp. Index keys of a bucket sort together, by deletion time.
+func genDeletedIndexKey(bucket string, tsp int64, object string) string {
+	return string(Pack(DELETED_INDEX_PREFIX, bucket, tsp, object))
 }
 
-//generate deleted multipart key
+// genBucketDeletedIndexKey is the prefix of the index keys of a bucket.
+func genBucketDeletedIndexKey(bucket string) string {
+	return string(Pack(DELETED_INDEX_PREFIX, bucket))
+}
+
+// parseDeletedIndexKey returns the deleted object key, in both formats, an
+// index key points to.
+func parseDeletedIndexKey(key []byte) (deletedKey string, legacy string, ok bool) {
+	e, err := Unpack(key)
+	if err != nil || len(e) != 4 || e[0] != DELETED_INDEX_PREFIX {
+		return "", "", false
+	}
+	bucket, ok1 := e[1].(string)
+	tsp, ok2 := e[2].(int64)
+	object, ok3 := e[3].(string)
+	if !ok1 || !ok2 || !ok3 {
+		return "", "", false
+	}
+	return string(Pack(DELETED_OBJECT_PREFIX, tsp, bucket, object)), legacyDeletedObjectKey(tsp, bucket, object), true
+}
+
+// GenMultipartKey generate the key of the record of an upload
+func GenMultipartKey(bucket string, uploadID string) string {
+	return string(Pack(MULTIPART_PREFIX, bucket, uploadID))
+}
+
+// genBucketMultipartKey is the prefix of the multipart keys of a bucket.
+func genBucketMultipartKey(bucket string) string {
+	return string(Pack(MULTIPART_PREFIX, bucket))
+}
+
+// PartKey is the key of one part of a multipart upload. Keys of the same
+// upload follow its record and sort by part number, which must not be
+// negative.
+type PartKey struct {
+	Bucket     string
+	UploadID   string
+	PartNumber int
+}
+
+const (
+	partNumberDigits = 5
+	// largePartMark prefixes part numbers that do not fit partNumberDigits.
+	// It sorts after the digits, so large part numbers sort after the
+	// small ones, and after the legacy %05d encoding of large numbers.
+	largePartMark      = "~"
+	largePartDigits    = 19
+	maxSmallPartNumber = 99999
+)
+
+// EncodePartNumber encodes n for part names, so that encodings sort like
+// the numbers.
+func EncodePartNumber(n int) string {
+	if n <= maxSmallPartNumber {
+		return fmt.Sprintf("%0*d", partNumberDigits, n)
+	}
+	return fmt.Sprintf("%s%0*d", largePartMark, largePartDigits, n)
+}
+
+// ParsePartNumber decodes EncodePartNumber. It also accepts the wider
+// numbers older code wrote for parts above 99999.
+func ParsePartNumber(s string) (int, bool) {
+	digits := partNumberDigits
+	if strings.HasPrefix(s, largePartMark) {
+		s = s[len(largePartMark):]
+		if len(s) != largePartDigits {
+			return 0, false
+		}
+		digits = largePartDigits
+	}
+	if len(s) < digits {
+		return 0, false
+	}
+	for _, ch := range s {
+		if ch < '0' || ch > '9' {
+			return 0, false
+		}
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// splitPartName splits a part name, uploadID#number, parsing it from the
+// right so that the upload ID may contain KEY_SEPARATOR.
+func splitPartName(name string) (uploadID string, partNumber int, ok bool) {
+	i := strings.LastIndex(name, KEY_SEPARATOR)
+	if i <= 0 {
+		return "", 0, false
+	}
+	n, ok := ParsePartNumber(name[i+1:])
+	if !ok {
+		return "", 0, false
+	}
+	return name[:i], n, true
+}
+
+// Name is the name of the part below its bucket, uploadID#number, as taken
+// by the name based multipart functions.
+func (k PartKey) Name() string {
+	return k.UploadID + KEY_SEPARATOR + EncodePartNumber(k.PartNumber)
+}
+
+func (k PartKey) String() string {
+	return string(Pack(MULTIPART_PREFIX, k.Bucket, k.UploadID, k.PartNumber))
+}
+
+// ParsePartKey parses a part key in either format. Upload records and other
+// multipart keys are rejected.
+func ParsePartKey(key string) (PartKey, bool) {
+	if isTupleKey([]byte(key)) {
+		e, err := Unpack([]byte(key))
+		if err != nil || len(e) != 4 || e[0] != MULTIPART_PREFIX {
+			return PartKey{}, false
+		}
+		bucket, ok1 := e[1].(string)
+		uploadID, ok2 := e[2].(string)
+		n, ok3 := e[3].(int64)
+		if !ok1 || !ok2 || !ok3 {
+			return PartKey{}, false
+		}
+		return PartKey{Bucket: bucket, UploadID: uploadID, PartNumber: int(n)}, true
+	}
+	bucket, name, ok := parseLegacyMultipartKey(key)
+	if !ok {
+		return PartKey{}, false
+	}
+	uploadID, n, ok := splitPartName(name)
+	if !ok {
+		return PartKey{}, false
+	}
+	return PartKey{Bucket: bucket, UploadID: uploadID, PartNumber: n}, true
+}
+
+// multipartNameKey is the key of a name below a bucket in the multipart
+// space: the record of upload name, or a part when name is a part name.
+func multipartNameKey(bucket string, name string) string {
+	if uploadID, n, ok := splitPartName(name); ok {
+		return PartKey{Bucket: bucket, UploadID: uploadID, PartNumber: n}.String()
+	}
+	return GenMultipartKey(bucket, name)
+}
+
+// ParseMultipartKey split multipart key into bucket and the name below it,
+// the upload ID of a record or the Name of a part
+func ParseMultipartKey(key string) (bucket string, name string, ok bool) {
+	if isTupleKey([]byte(key)) {
+		if pk, ok := ParsePartKey(key); ok {
+			return pk.Bucket, pk.Name(), true
+		}
+		e, err := Unpack([]byte(key))
+		if err != nil || len(e) != 3 || e[0] != MULTIPART_PREFIX {
+			return "", "", false
+		}
+		bucket, ok1 := e[1].(string)
+		uploadID, ok2 := e[2].(string)
+		return bucket, uploadID, ok1 && ok2
+	}
+	return parseLegacyMultipartKey(key)
+}
+
+// generate deleted multipart key
 func genDeletedMultipartKey(bucket string, object string) string {
-	tsp := time.Now().UnixNano()
-	return fmt.Sprintf("%s#%d#%s#%s", MULTIPART_PREFIX, tsp, bucket, object)
+	return string(Pack(DELETED_MULTIPART_PREFIX, time.Now().UnixNano(), bucket, object))
+}
+
+// genUploadIndexKey is the key of the index entry of an upload record.
+// Index keys of a bucket sort together, by object and then upload ID.
+func genUploadIndexKey(bucket string, object string, uploadID string) string {
+	return string(Pack(UPLOAD_INDEX_PREFIX, bucket, object, uploadID))
+}
+
+// genBucketUploadIndexKey is the prefix of the index keys of a bucket.
+func genBucketUploadIndexKey(bucket string) string {
+	return string(Pack(UPLOAD_INDEX_PREFIX, bucket))
+}
+
+// parseUploadIndexKey returns the upload an index key points to.
+func parseUploadIndexKey(key []byte) (bucket string, object string, uploadID string, ok bool) {
+	e, err := Unpack(key)
+	if err != nil || len(e) != 4 || e[0] != UPLOAD_INDEX_PREFIX {
+		return "", "", "", false
+	}
+	bucket, ok1 := e[1].(string)
+	object, ok2 := e[2].(string)
+	uploadID, ok3 := e[3].(string)
+	return bucket, object, uploadID, ok1 && ok2 && ok3
+}
+
+// ParseDeletedPartKey parses the key of a deleted multipart record that
+// holds a part, returning when it was deleted and the key the part had.
+// Deleted upload records are rejected.
+func ParseDeletedPartKey(key string) (tsp int64, pk PartKey, ok bool) {
+	e, err := Unpack([]byte(key))
+	if err != nil || len(e) != 4 || e[0] != DELETED_MULTIPART_PREFIX {
+		return 0, PartKey{}, false
+	}
+	tsp, ok1 := e[1].(int64)
+	bucket, ok2 := e[2].(string)
+	name, ok3 := e[3].(string)
+	if !ok1 || !ok2 || !ok3 {
+		return 0, PartKey{}, false
+	}
+	uploadID, n, ok := splitPartName(name)
+	if !ok {
+		return 0, PartKey{}, false
+	}
+	return tsp, PartKey{Bucket: bucket, UploadID: uploadID, PartNumber: n}, true
+}
+
+// GenLeaseKey generate lease key. Lease keys keep the legacy format, so that
+// cleaners of either version exclude each other.
+func GenLeaseKey(name string) string {
+	return fmt.Sprintf("%s#%s", LEASE_PREFIX, name)
+}
+
+func legacyObjectKey(bucket string, object string) string {
+	return fmt.Sprintf("%s#%s#%s", OBJECT_PREFIX, bucket, object)
+}
+
+// legacyBucketObjectKey is the prefix of the legacy object keys of a
+// bucket. It ends with the separator, so that it does not prefix the keys of
+// the buckets whose name starts with bucket.
+func legacyBucketObjectKey(bucket string) string {
+	return fmt.Sprintf("%s#%s#", OBJECT_PREFIX, bucket)
+}
+
+func legacyDeletedObjectKey(tsp int64, bucket string, object string) string {
+	return fmt.Sprintf("%s#%d#%s#%s", DELETED_OBJECT_PREFIX, tsp, bucket, object)
+}
+
+func legacyBucketKey(bucket string) string {
+	return fmt.Sprintf("%s#%s", BUCKET_PREFIX, bucket)
+}
+
+// legacyMultipartKey is the legacy key of a name below a bucket in the
+// multipart space.
+func legacyMultipartKey(bucket string, name string) string {
+	return fmt.Sprintf("%s#%s#%s", MULTIPART_PREFIX, bucket, name)
+}
+
+// legacyBucketMultipartKey is the prefix of the legacy multipart keys of a
+// bucket.
+func legacyBucketMultipartKey(bucket string) string {
+	return legacyMultipartKey(bucket, "")
+}
+
+func (k PartKey) legacyString() string {
+	return legacyMultipartKey(k.Bucket, k.Name())
+}
+
+func parseLegacyMultipartKey(key string) (bucket string, name string, ok bool) {
+	prefix := MULTIPART_PREFIX + KEY_SEPARATOR
+	if !strings.HasPrefix(key, prefix) {
+		return "", "", false
+	}
+	if _, _, _, ok := parseLegacyMultipartTombstone(key); ok {
+		return "", "", false
+	}
+	seg := strings.SplitN(key[len(prefix):], KEY_SEPARATOR, 2)
+	if len(seg) < 2 {
+		return "", "", false
+	}
+	return seg[0], seg[1], true
+}
+
+// tombstoneTimeDigits is the length of the nanosecond timestamps of
+// tombstones.
+const tombstoneTimeDigits = 19
+
+// parseLegacyMultipartTombstone parses the multipart tombstones older
+// versions wrote, by mistake, under the multipart prefix:
+// YDS3_MULTIPART#<ts>#<bucket>#<name>. A bucket named with 19 digits would be
+// taken for the timestamp of a tombstone.
+func parseLegacyMultipartTombstone(key string) (tsp int64, bucket string, name string, ok bool) {
+	prefix := MULTIPART_PREFIX + KEY_SEPARATOR
+	if !strings.HasPrefix(key, prefix) {
+		return 0, "", "", false
+	}
+	seg := strings.SplitN(key[len(prefix):], KEY_SEPARATOR, 3)
+	if len(seg) < 3 || len(seg[0]) != tombstoneTimeDigits {
+		return 0, "", "", false
+	}
+	for _, ch := range seg[0] {
+		if ch < '0' || ch > '9' {
+			return 0, "", "", false
+		}
+	}
+	tsp, err := strconv.ParseInt(seg[0], 10, 64)
+	if err != nil {
+		return 0, "", "", false
+	}
+	return tsp, seg[1], seg[2], true
+}
+
+// genMigrationKey is the key of the checkpoint of a migration.
+func genMigrationKey(name string) string {
+	return string(Pack(MIGRATION_PREFIX, name))
+}
+
+// genQuarantineKey is the key a record at key is moved to when it is
+// quarantined at tsp. Quarantine keys sort by quarantine time.
+func genQuarantineKey(tsp int64, key string) string {
+	return string(Pack(QUARANTINE_PREFIX, tsp, key))
+}
+
+// ParseQuarantineKey returns the quarantine time and the original key of a
+// quarantine key.
+func ParseQuarantineKey(key string) (tsp int64, orig string, ok bool) {
+	e, err := Unpack([]byte(key))
+	if err != nil || len(e) != 3 || e[0] != QUARANTINE_PREFIX {
+		return 0, "", false
+	}
+	tsp, ok1 := e[1].(int64)
+	orig, ok2 := e[2].(string)
+	return tsp, orig, ok1 && ok2
+}
+
+// genAuditKey is the key of the seq-th audit entry of a run at tsp. Audit
+// keys sort by time.
+func genAuditKey(tsp int64, runID string, seq int64) string {
+	return string(Pack(AUDIT_PREFIX, tsp, runID, seq))
+}
+
+// legacyToTupleKey returns the packed key of a legacy key, or false for keys
+// that are not legacy record keys.
+func legacyToTupleKey(key []byte) ([]byte, bool) {
+	if isTupleKey(key) {
+		return nil, false
+	}
+	seg := strings.SplitN(string(key), KEY_SEPARATOR, 2)
+	if len(seg) < 2 {
+		return nil, false
+	}
+	rest := seg[1]
+	switch seg[0] {
+	case BUCKET_PREFIX:
+		return Pack(BUCKET_PREFIX, rest), true
+	case OBJECT_PREFIX:
+		f := strings.SplitN(rest, KEY_SEPARATOR, 2)
+		if len(f) < 2 {
+			return nil, false
+		}
+		return Pack(OBJECT_PREFIX, f[0], f[1]), true
+	case DELETED_OBJECT_PREFIX:
+		f := strings.SplitN(rest, KEY_SEPARATOR, 3)
+		if len(f) < 3 {
+			return nil, false
+		}
+		tsp, err := strconv.ParseInt(f[0], 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		return Pack(DELETED_OBJECT_PREFIX, tsp, f[1], f[2]), true
+	case MULTIPART_PREFIX:
+		bucket, name, ok := parseLegacyMultipartKey(string(key))
+		if !ok {
+			return nil, false
+		}
+		return []byte(multipartNameKey(bucket, name)), true
+	}
+	return nil, false
+}
+
+// orderKey maps a key of either format to the packed key of its record, so
+// that keys of both formats can be merged in one order.
+func orderKey(key []byte) []byte {
+	if tk, ok := legacyToTupleKey(key); ok {
+		return tk
+	}
+	return key
 }
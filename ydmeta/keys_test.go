@@ -0,0 +1,178 @@
+package ydmeta
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+
+	"github.com/stretchr/testify/require"
+)
+
+// genPartKey generates part keys over arbitrary buckets, upload IDs and
+// part numbers. Bucket names never contain KEY_SEPARATOR.
+func genPartKey(r *rand.Rand) PartKey {
+	str := func() string {
+		v, _ := quick.Value(reflect.TypeOf(""), r)
+		return v.String()
+	}
+	k := PartKey{
+		Bucket:   strings.ReplaceAll(str(), KEY_SEPARATOR, ""),
+		UploadID: str() + KEY_SEPARATOR + str(),
+	}
+	switch r.Intn(3) {
+	case 0:
+		k.PartNumber = r.Intn(maxSmallPartNumber + 1)
+	case 1:
+		k.PartNumber = maxSmallPartNumber + 1 + r.Intn(1000)
+	default:
+		k.PartNumber = int(r.Int63n(math.MaxInt64))
+	}
+	return k
+}
+
+func TestPartKeyRoundTrip(t *testing.T) {
+	check := func(seed int64) bool {
+		k := genPartKey(rand.New(rand.NewSource(seed)))
+		if k.UploadID == "" {
+			return true
+		}
+		got, ok := ParsePartKey(k.String())
+		return ok && got == k
+	}
+	require.Nil(t, quick.Check(check, &quick.Config{MaxCount: 5000}))
+}
+
+func TestPartKeyOrder(t *testing.T) {
+	check := func(seed int64) bool {
+		r := rand.New(rand.NewSource(seed))
+		a, b := genPartKey(r), genPartKey(r)
+		b.Bucket, b.UploadID = a.Bucket, a.UploadID
+		return (a.PartNumber < b.PartNumber) == (a.String() < b.String())
+	}
+	require.Nil(t, quick.Check(check, &quick.Config{MaxCount: 5000}))
+}
+
+func TestParsePartNumber(t *testing.T) {
+	for s, n := range map[string]int{
+		"00000":                0,
+		"00042":                42,
+		"99999":                99999,
+		"123456":               123456, // written by older code
+		"~0000000000000100000": 100000,
+	} {
+		got, ok := ParsePartNumber(s)
+		require.True(t, ok, s)
+		require.Equal(t, n, got, s)
+	}
+	for _, s := range []string{"", "1", "0001", "-0001", "0000a", "~100000", "~000000000000010000x"} {
+		_, ok := ParsePartNumber(s)
+		require.False(t, ok, s)
+	}
+
+	_, ok := ParsePartKey(GenMultipartKey("bucket", "upload"))
+	require.False(t, ok)
+	k, ok := ParsePartKey("YDS3_MULTIPART#bucket#up#load#00003")
+	require.True(t, ok)
+	require.Equal(t, PartKey{Bucket: "bucket", UploadID: "up#load", PartNumber: 3}, k)
+}
+
+func TestQuarantineKey(t *testing.T) {
+	part := PartKey{Bucket: "b", UploadID: "up\x00load", PartNumber: 3}.String()
+	tsp, orig, ok := ParseQuarantineKey(genQuarantineKey(42, part))
+	require.True(t, ok)
+	require.Equal(t, int64(42), tsp)
+	require.Equal(t, part, orig)
+	require.True(t, genQuarantineKey(42, part) < genQuarantineKey(43, ""))
+
+	_, _, ok = ParseQuarantineKey(part)
+	require.False(t, ok)
+}
+
+func TestUploadIndexKey(t *testing.T) {
+	bucket, object, uploadID, ok := parseUploadIndexKey([]byte(genUploadIndexKey("b", "dir#obj", "up")))
+	require.True(t, ok)
+	require.Equal(t, []string{"b", "dir#obj", "up"}, []string{bucket, object, uploadID})
+	require.True(t, strings.HasPrefix(genUploadIndexKey("b", "obj", "up"), genBucketUploadIndexKey("b")))
+	require.True(t, genUploadIndexKey("b", "a", "z") < genUploadIndexKey("b", "b", "a"))
+	_, _, _, ok = parseUploadIndexKey([]byte(GenMultipartKey("b", "up")))
+	require.False(t, ok)
+
+	require.True(t, afterUploadMarkers("a", "1", "", ""))
+	require.True(t, afterUploadMarkers("b", "1", "a", "9"))
+	require.True(t, afterUploadMarkers("a", "2", "a", "1"))
+	require.False(t, afterUploadMarkers("a", "1", "a", "1"))
+	require.False(t, afterUploadMarkers("a", "2", "a", ""))
+}
+
+func TestDeletedPartKey(t *testing.T) {
+	part := PartKey{Bucket: "b", UploadID: "up#load", PartNumber: 100000}
+	tsp, pk, ok := ParseDeletedPartKey(string(Pack(DELETED_MULTIPART_PREFIX, int64(42), "b", part.Name())))
+	require.True(t, ok)
+	require.Equal(t, int64(42), tsp)
+	require.Equal(t, part, pk)
+
+	// deleted upload records
+	_, _, ok = ParseDeletedPartKey(string(Pack(DELETED_MULTIPART_PREFIX, int64(42), "b", "upload")))
+	require.False(t, ok)
+	_, _, ok = ParseDeletedPartKey(part.String())
+	require.False(t, ok)
+}
+
+func TestDeletedIndexKey(t *testing.T) {
+	deleted := Pack(DELETED_OBJECT_PREFIX, int64(42), "b", "dir#obj")
+	for _, key := range [][]byte{deleted, []byte(legacyDeletedObjectKey(42, "b", "dir#obj"))} {
+		tsp, bucket, object, ok := parseDeletedObjectKey(key)
+		require.True(t, ok, string(key))
+		require.Equal(t, int64(42), tsp)
+		require.Equal(t, "b", bucket)
+		require.Equal(t, "dir#obj", object)
+	}
+	_, _, _, ok := parseDeletedObjectKey([]byte(GenObjectKey("b", "obj")))
+	require.False(t, ok)
+
+	index := genDeletedIndexKey("b", 42, "dir#obj")
+	key, legacy, ok := parseDeletedIndexKey([]byte(index))
+	require.True(t, ok)
+	require.Equal(t, string(deleted), key)
+	require.Equal(t, legacyDeletedObjectKey(42, "b", "dir#obj"), legacy)
+	require.Equal(t, [][]byte{deleted, []byte(index)}, withDeletedIndex(deleted))
+
+	// entries of a bucket sort together, and not with those of a bucket it
+	// prefixes
+	bucket := genBucketDeletedIndexKey("b")
+	require.True(t, strings.HasPrefix(index, bucket))
+	require.True(t, genDeletedIndexKey("b", 43, "") < string(prefixEnd([]byte(bucket))))
+	require.False(t, strings.HasPrefix(genDeletedIndexKey("bc", 1, "obj"), bucket))
+}
+
+func TestLegacyPrefixBounds(t *testing.T) {
+	for _, c := range []struct {
+		prefix string
+		in     []string
+		out    []string
+	}{
+		{legacyBucketObjectKey("abc"),
+			[]string{legacyObjectKey("abc", "x"), legacyObjectKey("abc", "")},
+			[]string{legacyObjectKey("abcd", "x"), legacyObjectKey("ab", "cx")}},
+		{legacyBucketMultipartKey("abc"),
+			[]string{legacyMultipartKey("abc", "u"), PartKey{Bucket: "abc", UploadID: "u"}.legacyString()},
+			[]string{legacyMultipartKey("abcd", "u")}},
+		{legacyMultipartKey("abc", "u") + KEY_SEPARATOR,
+			[]string{PartKey{Bucket: "abc", UploadID: "u", PartNumber: 7}.legacyString()},
+			[]string{legacyMultipartKey("abc", "u"), PartKey{Bucket: "abc", UploadID: "u2"}.legacyString()}},
+		{MULTIPART_PREFIX + KEY_SEPARATOR,
+			[]string{legacyMultipartKey("abc", "u")},
+			[]string{DELETED_MULTIPART_PREFIX + "#1#abc#u", "YDS3_MULTIPARTS#abc"}},
+	} {
+		end := string(prefixEnd([]byte(c.prefix)))
+		for _, key := range c.in {
+			require.True(t, key >= c.prefix && key < end, "%q in %q", key, c.prefix)
+		}
+		for _, key := range c.out {
+			require.False(t, key >= c.prefix && key < end, "%q not in %q", key, c.prefix)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package ydmeta
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	tikverr "github.com/tikv/client-go/v2/error"
+	"github.com/tikv/client-go/v2/txnkv/transaction"
+)
+
+var (
+	ErrLeaseHeld = errors.New("lease is held by another owner")
+	ErrLeaseLost = errors.New("lease has been lost")
+)
+
+// LeaseInfo is the value stored under a lease key. Token increases every
+// time the lease changes hands and serves as a fencing token.
+type LeaseInfo struct {
+	Owner  string    `json:"owner"`
+	Token  uint64    `json:"token"`
+	Expire time.Time `json:"expire"`
+}
+
+// Lease is a named, time-bounded lock stored in TiKV. Expiry is judged by the
+// wall clock of each contender, so the ttl must be well above clock skew.
+type Lease struct {
+	m     *MetaManager
+	key   []byte
+	owner string
+	ttl   time.Duration
+
+	mu     sync.Mutex
+	token  uint64
+	expire time.Time
+}
+
+func getLeaseInfo(tx *transaction.KVTxn, key []byte) (*LeaseInfo, error) {
+	val, err := tx.Get(context.TODO(), key)
+	if err != nil {
+		if errors.Is(err, tikverr.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	info := &LeaseInfo{}
+	if err = json.Unmarshal(val, info); err != nil {
+		return nil, fmt.Errorf("parse lease info error: %s", err.Error())
+	}
+	return info, nil
+}
+
+func setLeaseInfo(tx *transaction.KVTxn, key []byte, info *LeaseInfo) error {
+	val, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return tx.Set(key, val)
+}
+
+// AcquireLease takes the lease name for owner unless another owner holds an
+// unexpired one, in which case ErrLeaseHeld is returned.
+func (m *MetaManager) AcquireLease(name string, owner string, ttl time.Duration) (*Lease, error) {
+	tx, err := m.client.Begin()
+	if err != nil {
+		return nil, err
+	}
+	key := []byte(GenLeaseKey(name))
+
+	info, err := getLeaseInfo(tx, key)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if info == nil {
+		info = &LeaseInfo{}
+	} else if info.Owner != owner && now.Before(info.Expire) {
+		return nil, fmt.Errorf("%w: %s until %s", ErrLeaseHeld, info.Owner, info.Expire.Format(time.RFC3339))
+	}
+
+	info.Owner = owner
+	info.Token++
+	info.Expire = now.Add(ttl)
+	if err = setLeaseInfo(tx, key, info); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(context.Background()); err != nil {
+		return nil, err
+	}
+
+	return &Lease{m: m, key: key, owner: owner, ttl: ttl, token: info.Token, expire: info.Expire}, nil
+}
+
+// Token returns the fencing token of the lease.
+func (l *Lease) Token() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.token
+}
+
+// check verifies inside tx that the lease is still ours and rewrites it, so
+// that a concurrent takeover conflicts with tx instead of interleaving.
+func (l *Lease) check(tx *transaction.KVTxn, extend bool) (*LeaseInfo, error) {
+	info, err := getLeaseInfo(tx, l.key)
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	token := l.token
+	l.mu.Unlock()
+	now := time.Now()
+	if info == nil || info.Owner != l.owner || info.Token != token || !now.Before(info.Expire) {
+		return nil, ErrLeaseLost
+	}
+	if extend {
+		info.Expire = now.Add(l.ttl)
+	}
+	return info, setLeaseInfo(tx, l.key, info)
+}
+
+// Refresh extends the lease by its ttl, or returns ErrLeaseLost.
+func (l *Lease) Refresh() error {
+	tx, err := l.m.client.Begin()
+	if err != nil {
+		return err
+	}
+	info, err := l.check(tx, true)
+	if err != nil {
+		return err
+	}
+	if err = tx.Commit(context.Background()); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.expire = info.Expire
+	l.mu.Unlock()
+	return nil
+}
+
+// KeepAlive refreshes the lease every interval until ctx is done. It returns
+// the first refresh error, which usually means the lease is gone.
+func (l *Lease) KeepAlive(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := l.Refresh(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Release gives the lease up if it is still ours.
+func (l *Lease) Release() error {
+	tx, err := l.m.client.Begin()
+	if err != nil {
+		return err
+	}
+	info, err := l.check(tx, false)
+	if err != nil {
+		if errors.Is(err, ErrLeaseLost) {
+			return nil
+		}
+		return err
+	}
+	info.Expire = time.Time{}
+	if err = setLeaseInfo(tx, l.key, info); err != nil {
+		return err
+	}
+	return tx.Commit(context.Background())
+}
+
+// delsFenced deletes keys in the same transaction that verifies the lease, so
+// nothing is deleted once another owner has taken over.
+func (m *MetaManager) delsFenced(l *Lease, keys ...[]byte) error {
+	tx, err := m.client.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = l.check(tx, false); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err = tx.Delete(key); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(context.Background())
+}
+
+// CheckLease verifies that l is still held without changing it.
+func (m *MetaManager) CheckLease(l *Lease) error {
+	tx, err := m.client.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = l.check(tx, false); err != nil {
+		return err
+	}
+	return tx.Commit(context.Background())
+}
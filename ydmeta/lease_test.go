@@ -0,0 +1,45 @@
+package ydmeta
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLease(t *testing.T) {
+	om.dels([]byte(GenLeaseKey("test")))
+
+	l1, err := om.AcquireLease("test", "owner-1", 2*time.Second)
+	require.Nil(t, err)
+
+	_, err = om.AcquireLease("test", "owner-2", 2*time.Second)
+	require.True(t, errors.Is(err, ErrLeaseHeld))
+
+	require.Nil(t, l1.Refresh())
+	require.Nil(t, om.CheckLease(l1))
+
+	// after expiry another owner takes over with a newer token
+	time.Sleep(2100 * time.Millisecond)
+	l2, err := om.AcquireLease("test", "owner-2", 2*time.Second)
+	require.Nil(t, err)
+	require.Greater(t, l2.Token(), l1.Token())
+
+	require.True(t, errors.Is(l1.Refresh(), ErrLeaseLost))
+
+	// fenced deletion is refused for the stale holder
+	key := []byte("YDS3_MULTIPART#abc#lease-test#00000")
+	require.Nil(t, om.set(key, []byte("{}")))
+	require.True(t, errors.Is(om.DeleteMultipartKeys(l1, string(key)), ErrLeaseLost))
+	_, err = om.get(key)
+	require.Nil(t, err)
+	require.Nil(t, om.DeleteMultipartKeys(l2, string(key)))
+
+	require.Nil(t, l2.Release())
+	l3, err := om.AcquireLease("test", "owner-1", time.Second)
+	require.Nil(t, err)
+	require.Nil(t, l3.Release())
+
+	om.dels([]byte(GenLeaseKey("test")))
+}
@@ -0,0 +1,251 @@
+package ydmeta
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// Legacy keys sort like their packed keys as long as no field followed by
+// another holds a byte below KEY_SEPARATOR. Such a byte sorts before the
+// separator, but after the end of a packed field: the legacy key
+// "YDS3_MULTIPART#a!b#x" sorts before "YDS3_MULTIPART#a#y", while the packed
+// key of bucket "a" sorts before the one of bucket "a!b". Forward scans of
+// legacy keys read these deviant keys ahead and return them in the order of
+// their packed keys, and start low enough to see the ones that sort before
+// the start of the scan. Reverse scans cannot read ahead for keys that sort
+// later, and fail with ErrLegacyOrder when they meet one out of order.
+
+// ErrLegacyOrder is returned by reverse scans of legacy keys that do not
+// sort like their packed keys. The packed-keys migration removes them.
+var ErrLegacyOrder = errors.New("legacy keys out of order, run the packed-keys migration")
+
+// legacySeparators returns the positions of the separators between the
+// fields of a legacy key, the one after its prefix included. Separators in
+// the last field, such as those of object names, are not.
+func legacySeparators(key []byte) []int {
+	s := string(key)
+	i := strings.Index(s, KEY_SEPARATOR)
+	if i < 0 {
+		return nil
+	}
+	prefix := s[:i]
+	seps := []int{i}
+	fields := 1
+	switch prefix {
+	case OBJECT_PREFIX, MULTIPART_PREFIX:
+		fields = 2
+	case DELETED_OBJECT_PREFIX:
+		fields = 3
+	}
+	for n := 1; n < fields; n++ {
+		j := strings.Index(s[i+1:], KEY_SEPARATOR)
+		if j < 0 {
+			return seps
+		}
+		i += 1 + j
+		seps = append(seps, i)
+	}
+	// the part number follows the last separator of a part name
+	if prefix == MULTIPART_PREFIX && len(seps) == 2 {
+		name := s[i+1:]
+		if _, _, ok := splitPartName(name); ok {
+			seps = append(seps, i+1+strings.LastIndex(name, KEY_SEPARATOR))
+		}
+	}
+	return seps
+}
+
+// legacyDeviant tells whether a legacy key may sort unlike its packed key.
+func legacyDeviant(key []byte) bool {
+	seps := legacySeparators(key)
+	if len(seps) == 0 {
+		return false
+	}
+	return hasByteBelowSeparator(key[:seps[len(seps)-1]])
+}
+
+func hasByteBelowSeparator(b []byte) bool {
+	for _, c := range b {
+		if c < KEY_SEPARATOR[0] {
+			return true
+		}
+	}
+	return false
+}
+
+// legacyRange widens the legacy range from start to end of the records
+// below legacyPrefix so that it covers every legacy key whose packed key
+// falls in the same range. A deviant key sorts before start when it shares
+// start up to one of its separators, and after end only when end holds a
+// byte below the separator.
+func legacyRange(legacyPrefix []byte, start []byte, end []byte) ([]byte, []byte) {
+	for _, sep := range legacySeparators(start) {
+		if sep >= len(legacyPrefix) {
+			start = start[:sep]
+			break
+		}
+	}
+	if end != nil && len(end) > len(legacyPrefix) && hasByteBelowSeparator(end[len(legacyPrefix):]) {
+		end = prefixEnd(legacyPrefix)
+	}
+	return start, end
+}
+
+// inOrderRange tells whether the order key k is within lower, inclusive,
+// and upper, exclusive, nil leaving a side unbounded.
+func inOrderRange(k []byte, lower []byte, upper []byte) bool {
+	return bytes.Compare(k, lower) >= 0 && (upper == nil || bytes.Compare(k, upper) < 0)
+}
+
+type orderedKV struct {
+	order []byte
+	KV
+}
+
+// sortedLegacyIter returns the keys of a forward iterator over legacy keys
+// that are within lower and upper, packed bounds, in the order of their
+// packed keys. Only the deviant keys read ahead of the next other key are
+// held in memory.
+type sortedLegacyIter struct {
+	it           kvIter
+	lower, upper []byte
+	pending      []orderedKV
+	fromPending  bool
+	done         bool
+}
+
+func newSortedLegacyIter(it kvIter, lower []byte, upper []byte) (*sortedLegacyIter, error) {
+	s := &sortedLegacyIter{it: it, lower: lower, upper: upper}
+	if err := s.fill(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// fill reads the deviant keys ahead of the next key that is not, and tells
+// which of the keys read comes first.
+func (s *sortedLegacyIter) fill() error {
+	for !s.done && s.it.Valid() {
+		key := s.it.Key()
+		k := orderKey(key)
+		deviant := legacyDeviant(key)
+		if !deviant && s.upper != nil && bytes.Compare(k, s.upper) >= 0 {
+			// every key that follows sorts after this one
+			s.done = true
+			break
+		}
+		if inOrderRange(k, s.lower, s.upper) {
+			if !deviant {
+				break
+			}
+			kv := orderedKV{order: k, KV: KV{K: append([]byte(nil), key...), V: append([]byte(nil), s.it.Value()...)}}
+			i := sort.Search(len(s.pending), func(i int) bool {
+				return bytes.Compare(s.pending[i].order, k) > 0
+			})
+			s.pending = append(s.pending, orderedKV{})
+			copy(s.pending[i+1:], s.pending[i:])
+			s.pending[i] = kv
+		}
+		if err := s.it.Next(); err != nil {
+			return err
+		}
+	}
+	s.fromPending = len(s.pending) > 0 &&
+		(!s.headValid() || bytes.Compare(s.pending[0].order, orderKey(s.it.Key())) < 0)
+	return nil
+}
+
+func (s *sortedLegacyIter) headValid() bool {
+	return !s.done && s.it.Valid()
+}
+
+func (s *sortedLegacyIter) Valid() bool {
+	return s.fromPending || s.headValid()
+}
+
+func (s *sortedLegacyIter) Key() []byte {
+	if s.fromPending {
+		return s.pending[0].K
+	}
+	return s.it.Key()
+}
+
+func (s *sortedLegacyIter) Value() []byte {
+	if s.fromPending {
+		return s.pending[0].V
+	}
+	return s.it.Value()
+}
+
+func (s *sortedLegacyIter) Next() error {
+	if s.fromPending {
+		s.pending = s.pending[1:]
+	} else if err := s.it.Next(); err != nil {
+		return err
+	}
+	return s.fill()
+}
+
+func (s *sortedLegacyIter) Close() {
+	s.it.Close()
+}
+
+// checkedLegacyIter returns the keys of a reverse iterator over legacy keys
+// that are within lower and upper, packed bounds, and fails with
+// ErrLegacyOrder on a key that does not sort before the previous one.
+type checkedLegacyIter struct {
+	it           kvIter
+	lower, upper []byte
+	last         []byte
+}
+
+func newCheckedLegacyIter(it kvIter, lower []byte, upper []byte) (*checkedLegacyIter, error) {
+	c := &checkedLegacyIter{it: it, lower: lower, upper: upper}
+	if err := c.skip(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// skip moves to the next key within the bounds and checks its order.
+func (c *checkedLegacyIter) skip() error {
+	for c.it.Valid() {
+		k := orderKey(c.it.Key())
+		if inOrderRange(k, c.lower, c.upper) {
+			if c.last != nil && bytes.Compare(k, c.last) > 0 {
+				return ErrLegacyOrder
+			}
+			c.last = k
+			return nil
+		}
+		if err := c.it.Next(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *checkedLegacyIter) Valid() bool {
+	return c.it.Valid()
+}
+
+func (c *checkedLegacyIter) Key() []byte {
+	return c.it.Key()
+}
+
+func (c *checkedLegacyIter) Value() []byte {
+	return c.it.Value()
+}
+
+func (c *checkedLegacyIter) Next() error {
+	if err := c.it.Next(); err != nil {
+		return err
+	}
+	return c.skip()
+}
+
+func (c *checkedLegacyIter) Close() {
+	c.it.Close()
+}
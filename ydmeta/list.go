@@ -0,0 +1,348 @@
+package ydmeta
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The paginated listings return a page of records and, when more follow, a
+// continuation token to pass back for the next page. Tokens are opaque to
+// callers; they hold the position of the last record of the page.
+
+var ErrInvalidToken = errors.New("invalid continuation token")
+
+// defaultMaxKeys is the page size when none is given, as in S3.
+const defaultMaxKeys = 1000
+
+func encodeToken(v interface{}) (string, error) {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bs), nil
+}
+
+func decodeToken(token string, v interface{}) error {
+	bs, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return ErrInvalidToken
+	}
+	if err = json.Unmarshal(bs, v); err != nil {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// maxKey returns the greater of two start keys, nil being the smallest.
+func maxKey(a []byte, b []byte) []byte {
+	if bytes.Compare(a, b) < 0 {
+		return b
+	}
+	return a
+}
+
+// ListObjectsInput selects a page of the objects of a bucket, as in S3's
+// ListObjectsV2.
+type ListObjectsInput struct {
+	Prefix string
+	// Delimiter rolls the names that contain it after Prefix up into common
+	// prefixes, which end with it.
+	Delimiter string
+	// StartAfter lists the names after it; ContinuationToken, when set,
+	// takes over.
+	StartAfter        string
+	ContinuationToken string
+	// MaxKeys bounds the names and common prefixes of the page, 1000 by
+	// default.
+	MaxKeys int
+}
+
+// ObjectsPage is a page of objects. Names and Objects go together, and
+// the names and common prefixes are in order.
+type ObjectsPage struct {
+	Names                 []string
+	Objects               []*ObjectInfo
+	CommonPrefixes        []string
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+type objectsToken struct {
+	After string `json:"after"`
+	// Prefix tells that After is a common prefix, all of whose names have
+	// been rolled up.
+	Prefix bool `json:"prefix,omitempty"`
+}
+
+// objectsStart returns the packed and legacy keys to list the objects of
+// bucket from, past the name after, or past all the names below it when it
+// is a common prefix.
+func objectsStart(bucket string, after string, isPrefix bool) ([]byte, []byte) {
+	if isPrefix {
+		return prefixEnd(PackStringPrefix(after, OBJECT_PREFIX, bucket)),
+			prefixEnd([]byte(legacyObjectKey(bucket, after)))
+	}
+	return append(Pack(OBJECT_PREFIX, bucket, after), 0x00), append([]byte(legacyObjectKey(bucket, after)), 0x00)
+}
+
+// commonPrefix returns the common prefix name rolls up into, if any.
+func commonPrefix(name string, prefix string, delimiter string) (string, bool) {
+	if delimiter == "" || !strings.HasPrefix(name, prefix) {
+		return "", false
+	}
+	i := strings.Index(name[len(prefix):], delimiter)
+	if i < 0 {
+		return "", false
+	}
+	return name[:len(prefix)+i+len(delimiter)], true
+}
+
+// ListObjectsPage lists a page of the objects of bucket, in name order.
+func (o *ObjectMetaManager) ListObjectsPage(bucket string, in ListObjectsInput) (*ObjectsPage, error) {
+	tx, err := o.client.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return listObjectsPage(txnIter(tx), bucket, in)
+}
+
+// listObjectsPage lists a page of objects from the ranges iter opens. The
+// names below a common prefix are not read: once the first one has been
+// rolled up, the listing seeks past all of them with a new iterator, so that
+// a page costs one seek per common prefix rather than a read per name.
+func listObjectsPage(iter rangeIter, bucket string, in ListObjectsInput) (*ObjectsPage, error) {
+	maxKeys := in.MaxKeys
+	if maxKeys <= 0 {
+		maxKeys = defaultMaxKeys
+	}
+	var start, legacyStart []byte
+	if in.ContinuationToken != "" {
+		var token objectsToken
+		if err := decodeToken(in.ContinuationToken, &token); err != nil {
+			return nil, err
+		}
+		start, legacyStart = objectsStart(bucket, token.After, token.Prefix)
+	} else if in.StartAfter != "" {
+		start, legacyStart = objectsStart(bucket, in.StartAfter, false)
+	}
+	prefix, legacyPrefix := PackStringPrefix(in.Prefix, OBJECT_PREFIX, bucket), []byte(legacyObjectKey(bucket, in.Prefix))
+	seek := func(start []byte, legacyStart []byte) (*mergedIter, error) {
+		return iterDualWith(iter, prefix, maxKey(prefix, start), legacyPrefix, maxKey(legacyPrefix, legacyStart))
+	}
+
+	it, err := seek(start, legacyStart)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		it.Close()
+	}()
+
+	page := &ObjectsPage{}
+	var last objectsToken
+	for it.Valid() {
+		name, ok := ParseObjectKey(string(it.Key()))
+		if !ok {
+			if err = it.Next(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if len(page.Names)+len(page.CommonPrefixes) == maxKeys {
+			page.IsTruncated = true
+			break
+		}
+		if cp, rolled := commonPrefix(name, in.Prefix, in.Delimiter); rolled {
+			page.CommonPrefixes = append(page.CommonPrefixes, cp)
+			last = objectsToken{After: cp, Prefix: true}
+			next, err := seek(objectsStart(bucket, cp, true))
+			if err != nil {
+				return nil, err
+			}
+			it.Close()
+			it = next
+			continue
+		}
+		oi, err := decodeObject(it.Value())
+		if err != nil {
+			return nil, fmt.Errorf("parse object %q error: %s", it.Key(), err.Error())
+		}
+		page.Names = append(page.Names, name)
+		page.Objects = append(page.Objects, oi)
+		last = objectsToken{After: name}
+		if err = it.Next(); err != nil {
+			return nil, err
+		}
+	}
+	if page.IsTruncated {
+		if page.NextContinuationToken, err = encodeToken(&last); err != nil {
+			return nil, err
+		}
+	}
+	return page, nil
+}
+
+// ListDeletedInput selects a page of the deleted objects.
+type ListDeletedInput struct {
+	// Since lists the objects deleted at or after it; ContinuationToken,
+	// when set, takes over.
+	Since             time.Time
+	ContinuationToken string
+	// MaxKeys bounds the records of the page, 1000 by default.
+	MaxKeys int
+}
+
+// DeletedObjectsPage is a page of deleted objects, oldest first. Keys and
+// Objects go together.
+type DeletedObjectsPage struct {
+	Keys                  []string
+	Objects               []*ObjectInfo
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+type deletedToken struct {
+	Time   int64  `json:"time"`
+	Bucket string `json:"bucket"`
+	Object string `json:"object"`
+}
+
+// ListDeletedObjectsPage lists a page of the deleted objects, by deletion
+// time.
+func (o *ObjectMetaManager) ListDeletedObjectsPage(in ListDeletedInput) (*DeletedObjectsPage, error) {
+	maxKeys := in.MaxKeys
+	if maxKeys <= 0 {
+		maxKeys = defaultMaxKeys
+	}
+	var start, legacyStart []byte
+	if in.ContinuationToken != "" {
+		var token deletedToken
+		if err := decodeToken(in.ContinuationToken, &token); err != nil {
+			return nil, err
+		}
+		start = append(Pack(DELETED_OBJECT_PREFIX, token.Time, token.Bucket, token.Object), 0x00)
+		legacyStart = append([]byte(legacyDeletedObjectKey(token.Time, token.Bucket, token.Object)), 0x00)
+	} else if !in.Since.IsZero() {
+		start = Pack(DELETED_OBJECT_PREFIX, in.Since.UnixNano())
+		legacyStart = []byte(fmt.Sprintf("%s#%d", DELETED_OBJECT_PREFIX, in.Since.UnixNano()))
+	}
+
+	tx, err := o.client.Begin()
+	if err != nil {
+		return nil, err
+	}
+	it, err := iterDual(tx, Pack(DELETED_OBJECT_PREFIX), start,
+		[]byte(DELETED_OBJECT_PREFIX+KEY_SEPARATOR), legacyStart)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	page := &DeletedObjectsPage{}
+	var last deletedToken
+	for it.Valid() {
+		if tsp, bucket, object, ok := parseDeletedObjectKey(it.Key()); ok {
+			if len(page.Keys) == maxKeys {
+				page.IsTruncated = true
+				break
+			}
+			oi, err := decodeObject(it.Value())
+			if err != nil {
+				return nil, fmt.Errorf("parse deleted object %q error: %s", it.Key(), err.Error())
+			}
+			page.Keys = append(page.Keys, string(it.Key()))
+			page.Objects = append(page.Objects, oi)
+			last = deletedToken{Time: tsp, Bucket: bucket, Object: object}
+		}
+		if err = it.Next(); err != nil {
+			return nil, err
+		}
+	}
+	if page.IsTruncated {
+		if page.NextContinuationToken, err = encodeToken(&last); err != nil {
+			return nil, err
+		}
+	}
+	return page, nil
+}
+
+// ListMultipartsInput selects a page of the parts of an upload.
+type ListMultipartsInput struct {
+	UploadID string
+	// PartNumberMarker lists the parts numbered above it, -1 for all, as
+	// ListMultiparts' startNumber; ContinuationToken, when set, takes over.
+	PartNumberMarker  int
+	ContinuationToken string
+	// MaxParts bounds the parts of the page, 1000 by default.
+	MaxParts int
+}
+
+// MultipartsPage is a page of parts, by part number.
+type MultipartsPage struct {
+	Parts                 []KV
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+type multipartsToken struct {
+	PartNumber int `json:"partNumber"`
+}
+
+// ListMultipartsPage lists a page of the parts of an upload of bucket.
+func (o *ObjectMetaManager) ListMultipartsPage(bucket string, in ListMultipartsInput) (*MultipartsPage, error) {
+	maxParts := in.MaxParts
+	if maxParts <= 0 {
+		maxParts = defaultMaxKeys
+	}
+	marker := in.PartNumberMarker
+	if in.ContinuationToken != "" {
+		var token multipartsToken
+		if err := decodeToken(in.ContinuationToken, &token); err != nil {
+			return nil, err
+		}
+		marker = token.PartNumber
+	}
+	var start, legacyStart []byte
+	if marker >= 0 {
+		pk := PartKey{Bucket: bucket, UploadID: in.UploadID, PartNumber: marker + 1}
+		start, legacyStart = []byte(pk.String()), []byte(pk.legacyString())
+	}
+
+	tx, err := o.client.Begin()
+	if err != nil {
+		return nil, err
+	}
+	it, err := iterDual(tx, []byte(GenMultipartKey(bucket, in.UploadID)), start,
+		[]byte(legacyMultipartKey(bucket, in.UploadID)+KEY_SEPARATOR), legacyStart)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	page := &MultipartsPage{}
+	var last multipartsToken
+	for it.Valid() {
+		if pk, ok := ParsePartKey(string(it.Key())); ok && pk.UploadID == in.UploadID {
+			if len(page.Parts) == maxParts {
+				page.IsTruncated = true
+				break
+			}
+			page.Parts = append(page.Parts, KV{K: append([]byte(nil), it.Key()...), V: append([]byte(nil), it.Value()...)})
+			last = multipartsToken{PartNumber: pk.PartNumber}
+		}
+		if err = it.Next(); err != nil {
+			return nil, err
+		}
+	}
+	if page.IsTruncated {
+		if page.NextContinuationToken, err = encodeToken(&last); err != nil {
+			return nil, err
+		}
+	}
+	return page, nil
+}
@@ -0,0 +1,229 @@
+package ydmeta
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListToken(t *testing.T) {
+	token, err := encodeToken(&objectsToken{After: "dir/", Prefix: true})
+	require.Nil(t, err)
+	var got objectsToken
+	require.Nil(t, decodeToken(token, &got))
+	require.Equal(t, objectsToken{After: "dir/", Prefix: true}, got)
+
+	require.Equal(t, ErrInvalidToken, decodeToken("not base64!", &got))
+	require.Equal(t, ErrInvalidToken, decodeToken("bm90IGpzb24", &got))
+}
+
+func TestCommonPrefix(t *testing.T) {
+	for _, c := range []struct {
+		name, prefix, delimiter, cp string
+	}{
+		{"a/b/c", "", "/", "a/"},
+		{"a/b/c", "a/", "/", "a/b/"},
+		{"a/b", "a/b", "/", ""},
+		{"a/b/c", "", "", ""},
+		{"abc", "a", "b", "ab"},
+		{"x--y--z", "x--", "--", "x--y--"},
+	} {
+		cp, ok := commonPrefix(c.name, c.prefix, c.delimiter)
+		require.Equal(t, c.cp != "", ok, c.name)
+		require.Equal(t, c.cp, cp, c.name)
+	}
+}
+
+func TestObjectsStart(t *testing.T) {
+	key := func(name string) string { return GenObjectKey("b", name) }
+	start, legacyStart := objectsStart("b", "dir/a", false)
+	require.True(t, key("dir/a") < string(start))
+	require.True(t, string(start) < key("dir/a\x00"))
+	require.True(t, legacyObjectKey("b", "dir/a") < string(legacyStart))
+	require.True(t, string(legacyStart) <= legacyObjectKey("b", "dir/a\x00"))
+
+	start, legacyStart = objectsStart("b", "dir/", true)
+	require.True(t, key("dir/\xff\xff") < string(start))
+	require.True(t, string(start) < key("dir0"))
+	require.True(t, legacyObjectKey("b", "dir/\xff") < string(legacyStart))
+	require.True(t, string(legacyStart) <= legacyObjectKey("b", "dir0"))
+}
+
+// memStore is a sorted in-memory key space that counts the iterators opened
+// over it and the keys they read.
+type memStore struct {
+	keys  []string
+	opens int
+	reads int
+}
+
+func (m *memStore) iter(start []byte, end []byte) (kvIter, error) {
+	m.opens++
+	i := sort.SearchStrings(m.keys, string(start))
+	j := len(m.keys)
+	if end != nil {
+		j = sort.SearchStrings(m.keys, string(end))
+	}
+	if j < i {
+		j = i
+	}
+	return &memIter{store: m, keys: m.keys[i:j]}, nil
+}
+
+// reverseIter opens the keys from start to end in descending order.
+func (m *memStore) reverseIter(start []byte, end []byte) (kvIter, error) {
+	it, _ := m.iter(start, end)
+	keys := append([]string(nil), it.(*memIter).keys...)
+	for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+		keys[i], keys[j] = keys[j], keys[i]
+	}
+	return &memIter{store: m, keys: keys}, nil
+}
+
+type memIter struct {
+	store *memStore
+	keys  []string
+}
+
+func (m *memIter) Valid() bool   { return len(m.keys) > 0 }
+func (m *memIter) Key() []byte   { return []byte(m.keys[0]) }
+func (m *memIter) Value() []byte { return []byte(`{"size":1}`) }
+func (m *memIter) Next() error   { m.store.reads++; m.keys = m.keys[1:]; return nil }
+func (m *memIter) Close()        {}
+
+// synthTree returns the names of a tree of the given depth, with files
+// files and dirs directories in every directory.
+func synthTree(dir string, depth int, dirs int, files int) []string {
+	var names []string
+	for i := 0; i < files; i++ {
+		names = append(names, fmt.Sprintf("%sf%d", dir, i))
+	}
+	if depth == 0 {
+		return names
+	}
+	for i := 0; i < dirs; i++ {
+		names = append(names, synthTree(fmt.Sprintf("%sd%d/", dir, i), depth-1, dirs, files)...)
+	}
+	return names
+}
+
+// newTreeStore stores names as objects of bucket, every third one under its
+// legacy key.
+func newTreeStore(bucket string, names []string) *memStore {
+	m := &memStore{}
+	for i, name := range names {
+		if i%3 == 0 {
+			m.keys = append(m.keys, legacyObjectKey(bucket, name))
+		} else {
+			m.keys = append(m.keys, GenObjectKey(bucket, name))
+		}
+	}
+	sort.Strings(m.keys)
+	return m
+}
+
+// expectedListing lists names as S3 does, all pages at once.
+func expectedListing(names []string, in ListObjectsInput) (objects []string, prefixes []string) {
+	sorted := append([]string(nil), names...)
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		if !strings.HasPrefix(name, in.Prefix) || name <= in.StartAfter {
+			continue
+		}
+		if cp, ok := commonPrefix(name, in.Prefix, in.Delimiter); ok {
+			if len(prefixes) == 0 || prefixes[len(prefixes)-1] != cp {
+				prefixes = append(prefixes, cp)
+			}
+			continue
+		}
+		objects = append(objects, name)
+	}
+	return objects, prefixes
+}
+
+func TestListObjectsDelimiter(t *testing.T) {
+	// 4 levels of 6 directories, with 5 files in each: 7775 names
+	names := synthTree("", 4, 6, 5)
+	store := newTreeStore("b", names)
+
+	for _, in := range []ListObjectsInput{
+		{Delimiter: "/"},
+		{Delimiter: "/", MaxKeys: 4},
+		{Prefix: "d2/", Delimiter: "/", MaxKeys: 3},
+		{Prefix: "d2/d5/d1/", Delimiter: "/"},
+		{Prefix: "d3/d", Delimiter: "/", MaxKeys: 2},
+		{Prefix: "d1/", Delimiter: "/", StartAfter: "d1/d2/f0", MaxKeys: 5},
+		{Prefix: "d4/d0/d3/", MaxKeys: 7},
+		{Prefix: "d0/", Delimiter: "d1/"},
+	} {
+		name := fmt.Sprintf("%+v", in)
+		store.opens, store.reads = 0, 0
+		var objects, prefixes []string
+		pages := 0
+		for {
+			page, err := listObjectsPage(store.iter, "b", in)
+			require.Nil(t, err, name)
+			pages++
+			if in.MaxKeys > 0 {
+				require.LessOrEqual(t, len(page.Names)+len(page.CommonPrefixes), in.MaxKeys, name)
+			}
+			require.Equal(t, len(page.Names), len(page.Objects), name)
+			objects = append(objects, page.Names...)
+			prefixes = append(prefixes, page.CommonPrefixes...)
+			if !page.IsTruncated {
+				break
+			}
+			in.ContinuationToken = page.NextContinuationToken
+		}
+		wantObjects, wantPrefixes := expectedListing(names, ListObjectsInput{
+			Prefix: in.Prefix, Delimiter: in.Delimiter, StartAfter: in.StartAfter})
+		require.Equal(t, wantObjects, objects, name)
+		require.Equal(t, wantPrefixes, prefixes, name)
+
+		// every page opens a packed and a legacy iterator, and so does every
+		// seek past a common prefix
+		entries := len(objects) + len(prefixes)
+		require.LessOrEqual(t, store.opens, 2*(pages+len(prefixes)), name)
+		require.LessOrEqual(t, store.reads, entries+pages, name)
+	}
+}
+
+func TestListObjectsDeepTree(t *testing.T) {
+	// a single path 40 levels deep, with a file at every level and a wide
+	// sibling directory at the bottom
+	var names []string
+	dir := ""
+	for i := 0; i < 40; i++ {
+		names = append(names, dir+"file")
+		dir += fmt.Sprintf("l%d/", i)
+	}
+	names = append(names, synthTree(dir+"wide/", 1, 200, 10)...)
+	store := newTreeStore("b", names)
+
+	in := ListObjectsInput{Prefix: "l0/l1/", Delimiter: "/"}
+	page, err := listObjectsPage(store.iter, "b", in)
+	require.Nil(t, err)
+	require.Equal(t, []string{"l0/l1/file"}, page.Names)
+	require.Equal(t, []string{"l0/l1/l2/"}, page.CommonPrefixes)
+	require.False(t, page.IsTruncated)
+	require.LessOrEqual(t, store.reads, 2)
+
+	in = ListObjectsInput{Prefix: dir + "wide/", Delimiter: "/", MaxKeys: 50}
+	var prefixes []string
+	for {
+		store.reads = 0
+		page, err := listObjectsPage(store.iter, "b", in)
+		require.Nil(t, err)
+		require.LessOrEqual(t, store.reads, 51)
+		prefixes = append(prefixes, page.CommonPrefixes...)
+		if !page.IsTruncated {
+			break
+		}
+		in.ContinuationToken = page.NextContinuationToken
+	}
+	require.Equal(t, 200, len(prefixes))
+	require.True(t, sort.StringsAreSorted(prefixes))
+}
@@ -0,0 +1,547 @@
+package ydmeta
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	tikverr "github.com/tikv/client-go/v2/error"
+	"github.com/tikv/client-go/v2/txnkv/transaction"
+)
+
+// Records change in two ways. The values of object and upload records carry
+// a schema version, and upgrades from one version to the next are applied
+// whenever such a record is read, so that readers only ever see the current
+// version. Migrations rewrite the records in bulk, for upgrades and for
+// changes of keys, which cannot be applied on read. A migration runs in
+// batches, each in one transaction together with its checkpoint, so that it
+// resumes where it stopped and never applies a batch twice. Migrations run
+// under the cleaner lease, so that they never move records a cleaner run is
+// deleting, and each batch records the previous value of every key it
+// rewrites or removes in the audit trail.
+
+// KeyRange is the range of keys from Start, inclusive, to End, exclusive.
+type KeyRange struct {
+	Start, End []byte
+}
+
+// prefixRange is the range of the keys starting with prefix.
+func prefixRange(prefix []byte) KeyRange {
+	return KeyRange{Start: prefix, End: prefixEnd(prefix)}
+}
+
+// Migration rewrites the records in some key ranges.
+type Migration struct {
+	Name        string
+	Description string
+	Ranges      []KeyRange
+	// Apply migrates one record within tx and reports whether it changed
+	// anything.
+	Apply func(tx *transaction.KVTxn, key []byte, value []byte) (bool, error)
+}
+
+var (
+	migrationsMu sync.Mutex
+	migrations   []*Migration
+)
+
+// RegisterMigration adds m to the migrations run by the migrate command, in
+// order of registration. It panics when another migration has the same
+// name.
+func RegisterMigration(m *Migration) {
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+	for _, r := range migrations {
+		if r.Name == m.Name {
+			panic(fmt.Sprintf("ydmeta: migration %q registered twice", m.Name))
+		}
+	}
+	migrations = append(migrations, m)
+}
+
+// Migrations returns the registered migrations in order.
+func Migrations() []*Migration {
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+	return append([]*Migration(nil), migrations...)
+}
+
+// LookupMigration returns the registered migration called name.
+func LookupMigration(name string) (*Migration, bool) {
+	for _, m := range Migrations() {
+		if m.Name == name {
+			return m, true
+		}
+	}
+	return nil, false
+}
+
+// MigrationStatus is the checkpoint of a migration.
+type MigrationStatus struct {
+	Name string `json:"name"`
+	// Range is the index of the range in progress, and Next the key to
+	// continue from within it.
+	Range    int       `json:"range"`
+	Next     []byte    `json:"next,omitempty"`
+	Scanned  int64     `json:"scanned"`
+	Migrated int64     `json:"migrated"`
+	Done     bool      `json:"done"`
+	Updated  time.Time `json:"updated"`
+}
+
+func (s *MigrationStatus) String() string {
+	bs, _ := json.Marshal(s)
+	return string(bs)
+}
+
+func getMigrationStatus(tx *transaction.KVTxn, name string) (*MigrationStatus, error) {
+	val, err := tx.Get(context.TODO(), []byte(genMigrationKey(name)))
+	if err != nil {
+		if errors.Is(err, tikverr.ErrNotExist) {
+			return &MigrationStatus{Name: name}, nil
+		}
+		return nil, err
+	}
+	status := &MigrationStatus{}
+	if err = json.Unmarshal(val, status); err != nil {
+		return nil, fmt.Errorf("parse migration status error: %s", err.Error())
+	}
+	return status, nil
+}
+
+// MigrationStatus returns the checkpoint of migration name.
+func (m *MetaManager) MigrationStatus(name string) (*MigrationStatus, error) {
+	tx, err := m.client.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return getMigrationStatus(tx, name)
+}
+
+// ResetMigration drops the checkpoint of migration name, so that it runs
+// again from the start.
+func (m *MetaManager) ResetMigration(name string) error {
+	return m.dels([]byte(genMigrationKey(name)))
+}
+
+// DefaultMigrateBatch is the number of records migrated per transaction
+// when no limit is given.
+const DefaultMigrateBatch = 500
+
+// MigrateBatch applies mig to up to limit records after its checkpoint and
+// moves the checkpoint past them, in one transaction, while l is held. The
+// audit entries of the batch are part of run runID.
+func (m *MetaManager) MigrateBatch(l *Lease, runID string, mig *Migration, limit int) (*MigrationStatus, error) {
+	tx, err := m.client.Begin()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = l.check(tx, false); err != nil {
+		return nil, err
+	}
+	status, err := getMigrationStatus(tx, mig.Name)
+	if err != nil {
+		return nil, err
+	}
+	if status.Done {
+		return status, nil
+	}
+	if limit <= 0 {
+		limit = DefaultMigrateBatch
+	}
+
+	var batch []KV
+	for len(batch) < limit && status.Range < len(mig.Ranges) {
+		r := mig.Ranges[status.Range]
+		start := status.Next
+		if start == nil {
+			start = r.Start
+		}
+		it, err := tx.Iter(start, r.End)
+		if err != nil {
+			return nil, err
+		}
+		for it.Valid() && len(batch) < limit {
+			batch = append(batch, KV{K: append([]byte(nil), it.Key()...), V: append([]byte(nil), it.Value()...)})
+			if err = it.Next(); err != nil {
+				it.Close()
+				return nil, err
+			}
+		}
+		exhausted := !it.Valid()
+		it.Close()
+		if !exhausted {
+			// the smallest key after the last one of the batch
+			status.Next = append(append([]byte(nil), batch[len(batch)-1].K...), 0x00)
+			break
+		}
+		status.Range++
+		status.Next = nil
+	}
+
+	now := time.Now()
+	for i, kv := range batch {
+		changed, err := mig.Apply(tx, kv.K, kv.V)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s of %q: %w", mig.Name, kv.K, err)
+		}
+		if !changed {
+			continue
+		}
+		status.Migrated++
+		// the sequence of the record in the migration keeps entries unique
+		err = auditMigrated(tx, &AuditEntry{
+			Time:   now,
+			RunID:  runID,
+			Seq:    status.Scanned + int64(i) + 1,
+			Action: AuditMigrate,
+			Key:    kv.K,
+			Value:  kv.V,
+			Reason: "migration " + mig.Name,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	status.Scanned += int64(len(batch))
+	status.Done = status.Range == len(mig.Ranges)
+	status.Updated = time.Now()
+
+	val, err := json.Marshal(status)
+	if err != nil {
+		return nil, err
+	}
+	if err = tx.Set([]byte(genMigrationKey(mig.Name)), val); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(context.Background()); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// auditMigrated appends e to the audit trail within tx when the record at
+// its key was rewritten or removed.
+func auditMigrated(tx *transaction.KVTxn, e *AuditEntry) error {
+	val, err := tx.Get(context.TODO(), e.Key)
+	if err == nil && bytes.Equal(val, e.Value) {
+		return nil
+	}
+	if err != nil && !errors.Is(err, tikverr.ErrNotExist) {
+		return err
+	}
+	bs, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return tx.Set([]byte(genAuditKey(e.Time.UnixNano(), e.RunID, e.Seq)), bs)
+}
+
+// Migrate runs mig to completion from its checkpoint in batches of limit
+// records while l is held, calling progress, when not nil, after every
+// batch.
+func (m *MetaManager) Migrate(ctx context.Context, l *Lease, runID string, mig *Migration, limit int,
+	progress func(*MigrationStatus)) (*MigrationStatus, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		status, err := m.MigrateBatch(l, runID, mig, limit)
+		if err != nil {
+			return nil, err
+		}
+		if progress != nil {
+			progress(status)
+		}
+		if status.Done {
+			return status, nil
+		}
+	}
+}
+
+// Schema versions. Records written before versions were maintained carry
+// none, or one that is not a number, and are version 1.
+
+var (
+	upgradesMu     sync.RWMutex
+	objectUpgrades []func(*ObjectInfo) error
+	uploadUpgrades []func(*MultipartMetaV1) error
+)
+
+func recordVersion(v string) int {
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 1
+	}
+	return n
+}
+
+// ObjectVersion is the current schema version of object records.
+func ObjectVersion() int {
+	upgradesMu.RLock()
+	defer upgradesMu.RUnlock()
+	return len(objectUpgrades) + 1
+}
+
+// UploadVersion is the current schema version of upload records.
+func UploadVersion() int {
+	upgradesMu.RLock()
+	defer upgradesMu.RUnlock()
+	return len(uploadUpgrades) + 1
+}
+
+// RegisterObjectUpgrade registers f, which upgrades object records from
+// version from, the current version, to the next. It also registers the
+// migration called name, which upgrades the stored object records, deleted
+// ones included.
+func RegisterObjectUpgrade(from int, name string, f func(*ObjectInfo) error) {
+	upgradesMu.Lock()
+	if from != len(objectUpgrades)+1 {
+		upgradesMu.Unlock()
+		panic(fmt.Sprintf("ydmeta: object upgrade from version %d, current is %d", from, len(objectUpgrades)+1))
+	}
+	objectUpgrades = append(objectUpgrades, f)
+	upgradesMu.Unlock()
+
+	RegisterMigration(&Migration{
+		Name:        name,
+		Description: fmt.Sprintf("upgrade object records to version %d", from+1),
+		Ranges: []KeyRange{
+			prefixRange(Pack(OBJECT_PREFIX)),
+			prefixRange([]byte(OBJECT_PREFIX + KEY_SEPARATOR)),
+			prefixRange(Pack(DELETED_OBJECT_PREFIX)),
+			prefixRange([]byte(DELETED_OBJECT_PREFIX + KEY_SEPARATOR)),
+		},
+		Apply: func(tx *transaction.KVTxn, key []byte, value []byte) (bool, error) {
+			oi := &ObjectInfo{}
+			if err := DecodeValue(value, oi); err != nil {
+				return false, err
+			}
+			return rewriteUpgraded(tx, key, value, oi, upgradeObject)
+		},
+	})
+}
+
+// RegisterUploadUpgrade is RegisterObjectUpgrade for upload records.
+func RegisterUploadUpgrade(from int, name string, f func(*MultipartMetaV1) error) {
+	upgradesMu.Lock()
+	if from != len(uploadUpgrades)+1 {
+		upgradesMu.Unlock()
+		panic(fmt.Sprintf("ydmeta: upload upgrade from version %d, current is %d", from, len(uploadUpgrades)+1))
+	}
+	uploadUpgrades = append(uploadUpgrades, f)
+	upgradesMu.Unlock()
+
+	RegisterMigration(&Migration{
+		Name:        name,
+		Description: fmt.Sprintf("upgrade upload records to version %d", from+1),
+		Ranges: []KeyRange{
+			prefixRange(Pack(MULTIPART_PREFIX)),
+			prefixRange([]byte(MULTIPART_PREFIX + KEY_SEPARATOR)),
+		},
+		Apply: func(tx *transaction.KVTxn, key []byte, value []byte) (bool, error) {
+			if _, _, ok := ParseMultipartKey(string(key)); !ok {
+				return false, nil
+			}
+			if _, isPart := ParsePartKey(string(key)); isPart {
+				return false, nil
+			}
+			meta := &MultipartMetaV1{}
+			if err := DecodeValue(value, meta); err != nil {
+				return false, err
+			}
+			return rewriteUpgraded(tx, key, value, meta, upgradeUpload)
+		},
+	})
+}
+
+// rewriteUpgraded upgrades v, decoded from value, and writes it back with
+// the codec value was written with.
+func rewriteUpgraded(tx *transaction.KVTxn, key []byte, value []byte, v interface{},
+	upgrade func(interface{}) (bool, error)) (bool, error) {
+	changed, err := upgrade(v)
+	if err != nil || !changed {
+		return false, err
+	}
+	val, err := EncodeValue(valueCodec(value), v)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Set(key, val)
+}
+
+// upgradeObject upgrades v, an *ObjectInfo, to the current version.
+func upgradeObject(v interface{}) (bool, error) {
+	oi := v.(*ObjectInfo)
+	upgradesMu.RLock()
+	defer upgradesMu.RUnlock()
+	version := recordVersion(oi.Version)
+	if version > len(objectUpgrades) {
+		return false, nil
+	}
+	for ; version <= len(objectUpgrades); version++ {
+		if err := objectUpgrades[version-1](oi); err != nil {
+			return false, fmt.Errorf("upgrade object to version %d: %w", version+1, err)
+		}
+	}
+	oi.Version = strconv.Itoa(version)
+	return true, nil
+}
+
+// upgradeUpload upgrades v, a *MultipartMetaV1, to the current version.
+func upgradeUpload(v interface{}) (bool, error) {
+	meta := v.(*MultipartMetaV1)
+	upgradesMu.RLock()
+	defer upgradesMu.RUnlock()
+	version := recordVersion(meta.Version)
+	if version > len(uploadUpgrades) {
+		return false, nil
+	}
+	for ; version <= len(uploadUpgrades); version++ {
+		if err := uploadUpgrades[version-1](meta); err != nil {
+			return false, fmt.Errorf("upgrade upload to version %d: %w", version+1, err)
+		}
+	}
+	meta.Version = strconv.Itoa(version)
+	return true, nil
+}
+
+// decodeObject decodes an object record and upgrades it to the current
+// version. The fids of the record are typed, whatever the codec.
+func decodeObject(value []byte) (*ObjectInfo, error) {
+	oi := &ObjectInfo{}
+	if err := DecodeValue(value, oi); err != nil {
+		return nil, err
+	}
+	if _, err := upgradeObject(oi); err != nil {
+		return nil, err
+	}
+	if _, typed := oi.ExtFields[ExtFids].([]FileIdInfo); !typed {
+		fids, err := oi.Fids()
+		if err != nil {
+			return nil, err
+		}
+		oi.SetFids(fids)
+	}
+	return oi, nil
+}
+
+// decodeUpload decodes an upload record and upgrades it to the current
+// version.
+func decodeUpload(value []byte) (*MultipartMetaV1, error) {
+	meta := &MultipartMetaV1{}
+	if err := DecodeValue(value, meta); err != nil {
+		return nil, err
+	}
+	if _, err := upgradeUpload(meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+func init() {
+	RegisterMigration(&Migration{
+		Name:        "multipart-tombstones",
+		Description: "move multipart tombstones written under the multipart prefix to the deleted multipart prefix",
+		Ranges:      []KeyRange{prefixRange([]byte(MULTIPART_PREFIX + KEY_SEPARATOR))},
+		Apply: func(tx *transaction.KVTxn, key []byte, value []byte) (bool, error) {
+			tsp, bucket, name, ok := parseLegacyMultipartTombstone(string(key))
+			if !ok {
+				return false, nil
+			}
+			if err := tx.Set(Pack(DELETED_MULTIPART_PREFIX, tsp, bucket, name), value); err != nil {
+				return false, err
+			}
+			return true, tx.Delete(key)
+		},
+	})
+
+	var legacyRanges []KeyRange
+	for _, prefix := range []string{BUCKET_PREFIX, OBJECT_PREFIX, DELETED_OBJECT_PREFIX, MULTIPART_PREFIX} {
+		legacyRanges = append(legacyRanges, prefixRange([]byte(prefix+KEY_SEPARATOR)))
+	}
+	RegisterMigration(&Migration{
+		Name:        "packed-keys",
+		Description: "move records from legacy keys to packed keys",
+		Ranges:      legacyRanges,
+		Apply: func(tx *transaction.KVTxn, key []byte, value []byte) (bool, error) {
+			packed, ok := legacyToTupleKey(key)
+			if !ok {
+				return false, nil
+			}
+			_, err := tx.Get(context.TODO(), packed)
+			if err == nil {
+				// the record has been written since, drop the stale copy
+				return true, tx.Delete(key)
+			}
+			if !errors.Is(err, tikverr.ErrNotExist) {
+				return false, err
+			}
+			return true, setDual(tx, string(packed), string(key), value)
+		},
+	})
+
+	RegisterMigration(&Migration{
+		Name:        DeletedIndexMigration,
+		Description: "index the deleted object records by bucket",
+		Ranges: []KeyRange{
+			prefixRange(Pack(DELETED_OBJECT_PREFIX)),
+			prefixRange([]byte(DELETED_OBJECT_PREFIX + KEY_SEPARATOR)),
+		},
+		Apply: func(tx *transaction.KVTxn, key []byte, value []byte) (bool, error) {
+			tsp, bucket, object, ok := parseDeletedObjectKey(key)
+			if !ok {
+				return false, nil
+			}
+			indexKey := []byte(genDeletedIndexKey(bucket, tsp, object))
+			_, err := tx.Get(context.TODO(), indexKey)
+			if err == nil {
+				return false, nil
+			}
+			if !errors.Is(err, tikverr.ErrNotExist) {
+				return false, err
+			}
+			return true, tx.Set(indexKey, Pack(DELETED_OBJECT_PREFIX, tsp, bucket, object))
+		},
+	})
+
+	RegisterMigration(&Migration{
+		Name:        UploadIndexMigration,
+		Description: "index the upload records by object",
+		Ranges: []KeyRange{
+			prefixRange(Pack(MULTIPART_PREFIX)),
+			prefixRange([]byte(MULTIPART_PREFIX + KEY_SEPARATOR)),
+		},
+		Apply: func(tx *transaction.KVTxn, key []byte, value []byte) (bool, error) {
+			if _, _, _, ok := parseLegacyMultipartTombstone(string(key)); ok {
+				return false, nil
+			}
+			if _, isPart := ParsePartKey(string(key)); isPart {
+				return false, nil
+			}
+			bucket, uploadID, ok := ParseMultipartKey(string(key))
+			if !ok {
+				return false, nil
+			}
+			// an upload of an unknown object cannot be listed by object
+			meta, err := decodeUpload(value)
+			if err != nil {
+				return false, nil
+			}
+			indexKey := []byte(genUploadIndexKey(bucket, meta.Object, uploadID))
+			_, err = tx.Get(context.TODO(), indexKey)
+			if err == nil {
+				return false, nil
+			}
+			if !errors.Is(err, tikverr.ErrNotExist) {
+				return false, err
+			}
+			return true, setUploadIndex(tx, bucket, meta.Object, uploadID)
+		},
+	})
+}
@@ -0,0 +1,101 @@
+package ydmeta
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLegacyMultipartTombstone(t *testing.T) {
+	key := "YDS3_MULTIPART#1672531200000000000#bucket#up#load#00002"
+	tsp, bucket, name, ok := parseLegacyMultipartTombstone(key)
+	require.True(t, ok)
+	require.Equal(t, int64(1672531200000000000), tsp)
+	require.Equal(t, "bucket", bucket)
+	require.Equal(t, "up#load#00002", name)
+
+	// tombstones are not parts nor records of the bucket named like their time
+	_, ok = ParsePartKey(key)
+	require.False(t, ok)
+	_, ok = legacyToTupleKey([]byte(key))
+	require.False(t, ok)
+
+	for _, key := range []string{
+		"YDS3_MULTIPART#bucket#upload#00002",
+		"YDS3_MULTIPART#167253120000000000#bucket#upload",
+		"YDS3_MULTIPART#167253120000000000x#bucket#upload",
+		"YDS3_MULTIPART#1672531200000000000#bucket",
+		"YDS3_DELETED_MULTIPART#1672531200000000000#bucket#upload",
+	} {
+		_, _, _, ok := parseLegacyMultipartTombstone(key)
+		require.False(t, ok, key)
+	}
+}
+
+// withObjectUpgrades runs f with upgrades in place of the registered object
+// upgrades.
+func withObjectUpgrades(upgrades []func(*ObjectInfo) error, f func()) {
+	upgradesMu.Lock()
+	saved := objectUpgrades
+	objectUpgrades = upgrades
+	upgradesMu.Unlock()
+	defer func() {
+		upgradesMu.Lock()
+		objectUpgrades = saved
+		upgradesMu.Unlock()
+	}()
+	f()
+}
+
+func TestUpgradeObject(t *testing.T) {
+	var applied []string
+	upgrades := []func(*ObjectInfo) error{
+		func(oi *ObjectInfo) error {
+			applied = append(applied, "2")
+			return nil
+		},
+		func(oi *ObjectInfo) error {
+			applied = append(applied, "3")
+			oi.ContentType = "upgraded"
+			return nil
+		},
+	}
+	withObjectUpgrades(upgrades, func() {
+		require.Equal(t, 3, ObjectVersion())
+
+		val, err := EncodeValue(ProtoCodec, &ObjectInfo{Name: "o"})
+		require.Nil(t, err)
+		oi, err := decodeObject(val)
+		require.Nil(t, err)
+		require.Equal(t, []string{"2", "3"}, applied)
+		require.Equal(t, "3", oi.Version)
+		require.Equal(t, "upgraded", oi.ContentType)
+
+		applied = nil
+		oi = &ObjectInfo{Name: "o", Version: "2"}
+		changed, err := upgradeObject(oi)
+		require.Nil(t, err)
+		require.True(t, changed)
+		require.Equal(t, []string{"3"}, applied)
+
+		applied = nil
+		changed, err = upgradeObject(oi)
+		require.Nil(t, err)
+		require.False(t, changed)
+		require.Nil(t, applied)
+	})
+	require.Equal(t, 1, ObjectVersion())
+}
+
+func TestRegisterMigration(t *testing.T) {
+	names := map[string]bool{}
+	for _, m := range Migrations() {
+		require.False(t, names[m.Name], m.Name)
+		names[m.Name] = true
+	}
+	require.True(t, names["multipart-tombstones"])
+	require.True(t, names["packed-keys"])
+	require.True(t, names[DeletedIndexMigration])
+	require.True(t, names[UploadIndexMigration])
+	require.Panics(t, func() { RegisterMigration(&Migration{Name: "packed-keys"}) })
+}
@@ -2,11 +2,13 @@ package ydmeta
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/tikv/client-go/v2/txnkv"
-	"strings"
+	"sort"
 	"time"
+
+	tikverr "github.com/tikv/client-go/v2/error"
 )
 
 type MultipartMetaV1 struct {
@@ -17,6 +19,8 @@ type MultipartMetaV1 struct {
 	ContentEncoding string                 `json:"contentEncoding"`
 	ModTime         time.Time              `json:"modifyTime"`
 	ExtFields       map[string]interface{} `json:"extFields"`
+	UploadID        string                 `json:"uploadID,omitempty"`
+	InitiateTime    time.Time              `json:"initiateTime"`
 }
 type FileIdInfo struct {
 	FileId   string
@@ -28,24 +32,30 @@ type MultipartPartMetaV1 struct {
 	Size     int64
 	Etag     string
 	FidInfos []FileIdInfo
+	ModTime  time.Time
 }
 
 func (o *ObjectMetaManager) SaveMultipart(bucket string, objectName string, value []byte) error {
-	key := GenMultipartKey(bucket, objectName)
+	if _, _, isPart := splitPartName(objectName); !isPart {
+		return o.saveUpload(bucket, objectName, value)
+	}
+	key := multipartNameKey(bucket, objectName)
 	delKey := genDeletedMultipartKey(bucket, objectName)
-	return o.save(bucket, objectName, value, key, delKey)
+	return o.save(key, legacyMultipartKey(bucket, objectName), delKey, value)
 }
 
+// ListMultiparts lists up to limit parts of upload prefix numbered above
+// startNumber. ListMultipartsPage lists them page by page.
 func (o *ObjectMetaManager) ListMultiparts(bucket string, prefix string, startNumber int, limit int) ([]KV, error) {
-	nextKeyPrefix := fmt.Sprintf("%s#%s#%s#~", MULTIPART_PREFIX, bucket, prefix)
-	keyPrefix := fmt.Sprintf("%s#%s#%s#%05d", MULTIPART_PREFIX, bucket, prefix, startNumber+1)
+	start := PartKey{Bucket: bucket, UploadID: prefix, PartNumber: startNumber + 1}
 	var ret []KV
 	//iter
 	tx, err := o.client.Begin()
 	if err != nil {
 		return nil, err
 	}
-	it, err := tx.Iter([]byte(keyPrefix), []byte(nextKeyPrefix))
+	it, err := iterDual(tx, []byte(GenMultipartKey(bucket, prefix)), []byte(start.String()),
+		[]byte(legacyMultipartKey(bucket, prefix)+KEY_SEPARATOR), []byte(start.legacyString()))
 	if err != nil {
 		return nil, err
 	}
@@ -54,26 +64,25 @@ func (o *ObjectMetaManager) ListMultiparts(bucket string, prefix string, startNu
 		limit = 10000
 	}
 	for it.Valid() && limit > 0 {
-		strKey := string(it.Key())
-		if strings.HasPrefix(strKey, fmt.Sprintf("%s#%s#%s", MULTIPART_PREFIX, bucket, prefix)) {
+		if pk, ok := ParsePartKey(string(it.Key())); ok && pk.UploadID == prefix {
 			ret = append(ret, KV{K: it.Key()[:], V: it.Value()[:]})
 			limit--
 		}
-		it.Next()
+		if err = it.Next(); err != nil {
+			return nil, err
+		}
 	}
 
 	return ret, nil
 }
 
 func (o *ObjectMetaManager) GetMultipartMeta(bucket string, objectName string) (*MultipartMetaV1, error) {
-	key := GenMultipartKey(bucket, objectName)
-	val, err := o.get([]byte(key))
+	val, err := o.getDual(multipartNameKey(bucket, objectName), legacyMultipartKey(bucket, objectName))
 	if err != nil {
 		return nil, err
 	}
 
-	swfsMultipartInfo := new(MultipartMetaV1)
-	err = json.Unmarshal(val, swfsMultipartInfo)
+	swfsMultipartInfo, err := decodeUpload(val)
 	if err != nil {
 		return nil, fmt.Errorf("parse MultipartMeta info error: %s", err.Error())
 	}
@@ -82,14 +91,13 @@ func (o *ObjectMetaManager) GetMultipartMeta(bucket string, objectName string) (
 
 }
 func (o *ObjectMetaManager) GetMultipartPartMeta(bucket string, objectName string) (*MultipartPartMetaV1, error) {
-	key := GenMultipartKey(bucket, objectName)
-	val, err := o.get([]byte(key))
+	val, err := o.getDual(multipartNameKey(bucket, objectName), legacyMultipartKey(bucket, objectName))
 	if err != nil {
 		return nil, err
 	}
 
 	partMetaInfo := new(MultipartPartMetaV1)
-	err = json.Unmarshal(val, partMetaInfo)
+	err = DecodeValue(val, partMetaInfo)
 	if err != nil {
 		return nil, fmt.Errorf("parse object info error: %s", err.Error())
 	}
@@ -104,8 +112,9 @@ func (o *ObjectMetaManager) MarkMultipartDeleted(bucket string, objectName strin
 		return err
 	}
 	//get original object
-	oriKey := GenMultipartKey(bucket, objectName)
-	val, err := tx.Get(context.TODO(), []byte(oriKey))
+	oriKey := multipartNameKey(bucket, objectName)
+	legacyKey := legacyMultipartKey(bucket, objectName)
+	val, _, err := getDual(tx, oriKey, legacyKey)
 	if err != nil {
 		return err
 	}
@@ -116,10 +125,15 @@ func (o *ObjectMetaManager) MarkMultipartDeleted(bucket string, objectName strin
 		return err
 	}
 	//delete original object
-	err = tx.Delete([]byte(oriKey))
+	err = deleteDual(tx, oriKey, legacyKey)
 	if err != nil {
 		return err
 	}
+	if _, _, isPart := splitPartName(objectName); !isPart {
+		if err = deleteUploadIndexOf(tx, bucket, objectName, val); err != nil {
+			return err
+		}
+	}
 	return tx.Commit(context.Background())
 }
 
@@ -129,17 +143,144 @@ func (o *ObjectMetaManager) DeleteMultipartMeta(bucket string, objectName string
 	if err != nil {
 		return err
 	}
+	if _, _, isPart := splitPartName(objectName); !isPart {
+		val, _, err := getDual(tx, multipartNameKey(bucket, objectName), legacyMultipartKey(bucket, objectName))
+		if err == nil {
+			err = deleteUploadIndexOf(tx, bucket, objectName, val)
+		}
+		if err != nil && !errors.Is(err, tikverr.ErrNotExist) {
+			return err
+		}
+	}
 	//get original object
-	oriKey := GenMultipartKey(bucket, objectName)
-	err = tx.Delete([]byte(oriKey))
+	err = deleteDual(tx, multipartNameKey(bucket, objectName), legacyMultipartKey(bucket, objectName))
 	if err != nil {
 		return err
 	}
 	return tx.Commit(context.Background())
 }
 
+// DeleteMultipartKeys deletes raw multipart keys, or deleted multipart keys,
+// while l is still held.
+func (o *ObjectMetaManager) DeleteMultipartKeys(l *Lease, keys ...string) error {
+	raw := make([][]byte, 0, len(keys))
+	for _, key := range keys {
+		raw = append(raw, []byte(key))
+	}
+	return o.delsFenced(l, raw...)
+}
+
 func (o *ObjectMetaManager) ListMultipartByIter() (*MultipartMetaIter, error) {
-	return newMultipartMetaIter([]byte(MULTIPART_PREFIX), o.client)
+	return o.ListMultipartRangeByIter(IterOptions{})
+}
+
+// ListMultipartRangeByIter iterates the upload records and parts within the
+// bounds of opt, which are multipart keys such as GenMultipartKey or
+// PartKey.String. A long iteration reads from fresh snapshots as it goes, see
+// renewingIter.
+func (o *ObjectMetaManager) ListMultipartRangeByIter(opt IterOptions) (*MultipartMetaIter, error) {
+	return newMultipartMetaIter(o.client, Pack(MULTIPART_PREFIX), []byte(MULTIPART_PREFIX+KEY_SEPARATOR), opt)
+}
+
+// ListBucketsMultipartByIter is ListMultipartByIter limited to buckets, which
+// are read bucket by bucket, each from fresh snapshots.
+func (o *ObjectMetaManager) ListBucketsMultipartByIter(buckets []string) (*MultipartMetaIter, error) {
+	buckets = append([]string(nil), buckets...)
+	sort.Strings(buckets)
+	open := make([]func() (kvIter, error), 0, len(buckets))
+	for _, b := range buckets {
+		prefix, legacyPrefix := []byte(genBucketMultipartKey(b)), []byte(legacyBucketMultipartKey(b))
+		open = append(open, func() (kvIter, error) {
+			return newRenewingDualIter(o.client, prefix, legacyPrefix, IterOptions{})
+		})
+	}
+	it, err := newChainIter(open...)
+	if err != nil {
+		return nil, err
+	}
+	return multipartMetaIter(it), nil
+}
+
+// ListBucketMultipartByIter iterates the upload records and parts of bucket.
+func (o *ObjectMetaManager) ListBucketMultipartByIter(bucket string) (*MultipartMetaIter, error) {
+	return o.ListBucketMultipartRangeByIter(bucket, IterOptions{})
+}
+
+// ListBucketMultipartRangeByIter is ListMultipartRangeByIter within bucket.
+func (o *ObjectMetaManager) ListBucketMultipartRangeByIter(bucket string, opt IterOptions) (*MultipartMetaIter, error) {
+	return newMultipartMetaIter(o.client, []byte(genBucketMultipartKey(bucket)),
+		[]byte(legacyBucketMultipartKey(bucket)), opt)
+}
+
+// ListUploadMultipartByIter iterates the record of an upload and its parts.
+func (o *ObjectMetaManager) ListUploadMultipartByIter(bucket string, uploadID string) (*MultipartMetaIter, error) {
+	tx, err := o.client.Begin()
+	if err != nil {
+		return nil, err
+	}
+	// the packed record prefixes the keys of its parts, the legacy one also
+	// prefixes the records of longer upload IDs, so it is read on its own
+	legacyKey := []byte(legacyMultipartKey(bucket, uploadID))
+	it, err := iterDual(tx, []byte(GenMultipartKey(bucket, uploadID)), nil,
+		append(append([]byte(nil), legacyKey...), KEY_SEPARATOR...), nil)
+	if err != nil {
+		return nil, err
+	}
+	recordIt, err := tx.Iter(legacyKey, append(append([]byte(nil), legacyKey...), 0x00))
+	if err != nil {
+		it.Close()
+		return nil, err
+	}
+	return multipartMetaIter(newMergedIter(it, recordIt)), nil
+}
+
+// ListDeletedMultipartsByIter iterates the deleted multipart records, oldest
+// first: the parts replaced by a new upload of the same part or left by an
+// aborted upload, and the records overwritten through SaveMultipart.
+func (o *ObjectMetaManager) ListDeletedMultipartsByIter() (*MultipartMetaIter, error) {
+	tx, err := o.client.Begin()
+	if err != nil {
+		return nil, err
+	}
+	prefix := Pack(DELETED_MULTIPART_PREFIX)
+	it, err := tx.Iter(prefix, prefixEnd(prefix))
+	if err != nil {
+		return nil, err
+	}
+	return multipartMetaIter(it), nil
+}
+
+// GetParts returns the parts stored at pks, in either format. Parts that do
+// not exist are missing from the map.
+func (o *ObjectMetaManager) GetParts(pks []PartKey) (map[PartKey]*MultipartPartMetaV1, error) {
+	tx, err := o.client.Begin()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([][]byte, 0, 2*len(pks))
+	for _, pk := range pks {
+		keys = append(keys, []byte(pk.String()), []byte(pk.legacyString()))
+	}
+	vals, err := tx.BatchGet(context.TODO(), keys)
+	if err != nil {
+		return nil, err
+	}
+	parts := make(map[PartKey]*MultipartPartMetaV1, len(vals))
+	for _, pk := range pks {
+		val, ok := vals[pk.String()]
+		if !ok {
+			val, ok = vals[pk.legacyString()]
+		}
+		if !ok {
+			continue
+		}
+		part := &MultipartPartMetaV1{}
+		if err = DecodeValue(val, part); err != nil {
+			return nil, &DecodeError{Key: pk.String(), Err: err}
+		}
+		parts[pk] = part
+	}
+	return parts, nil
 }
 
 type MultipartMetaIter struct {
@@ -148,37 +289,77 @@ type MultipartMetaIter struct {
 	interNext  func() error
 	interKey   func() []byte
 	interValue func() []byte
+	interSeek  func([]byte) error
 }
 
-func newMultipartMetaIter(key []byte, tc *txnkv.Client) (*MultipartMetaIter, error) {
-	tx, err := tc.Begin()
-	if err != nil {
-		return nil, err
-	}
-	it, err := tx.Iter(key, upper(key))
+func newMultipartMetaIter(tc *txnkv.Client, prefix []byte, legacyPrefix []byte, opt IterOptions) (*MultipartMetaIter, error) {
+	it, err := newRenewingDualIter(tc, prefix, legacyPrefix, opt)
 	if err != nil {
 		return nil, err
 	}
+	i := multipartMetaIter(it)
+	i.interSeek = it.Seek
+	return i, nil
+}
+
+func multipartMetaIter(it kvIter) *MultipartMetaIter {
 	return &MultipartMetaIter{
 		interClose: it.Close,
 		interValid: it.Valid,
 		interNext:  it.Next,
 		interKey:   it.Key,
 		interValue: it.Value,
-	}, nil
+	}
 }
 
 func (i *MultipartMetaIter) Next() error {
 	return i.interNext()
 }
 
+// Seek moves to the first key at or after key, or at or before it in
+// reverse, within the bounds the iterator was opened with, as
+// ObjectMetaIter.Seek.
+func (i *MultipartMetaIter) Seek(key string) error {
+	if i.interSeek == nil {
+		return ErrNotSeekable
+	}
+	return i.interSeek([]byte(key))
+}
+
+// Value decodes the current value as a part, or returns nil when it cannot
+// be decoded. Cursor reports the error instead.
 func (i *MultipartMetaIter) Value() *MultipartPartMetaV1 {
+	oi, _ := i.decodePart()
+	return oi
+}
+
+func (i *MultipartMetaIter) decodePart() (*MultipartPartMetaV1, error) {
 	oi := &MultipartPartMetaV1{}
-	err := json.Unmarshal(i.interValue(), oi)
+	err := DecodeValue(i.interValue(), oi)
 	if err != nil {
-		return nil
+		return nil, &DecodeError{Key: i.Key(), Err: err}
 	}
-	return oi
+	return oi, nil
+}
+
+// RawValue returns a copy of the current value as stored.
+func (i *MultipartMetaIter) RawValue() []byte {
+	return append([]byte(nil), i.interValue()...)
+}
+
+// UploadMeta decodes the current value as an upload record rather than a
+// part, or returns nil.
+func (i *MultipartMetaIter) UploadMeta() *MultipartMetaV1 {
+	mi, _ := i.decodeUpload()
+	return mi
+}
+
+func (i *MultipartMetaIter) decodeUpload() (*MultipartMetaV1, error) {
+	mi, err := decodeUpload(i.interValue())
+	if err != nil {
+		return nil, &DecodeError{Key: i.Key(), Err: err}
+	}
+	return mi, nil
 }
 
 func (i *MultipartMetaIter) Key() string {
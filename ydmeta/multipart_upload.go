@@ -0,0 +1,592 @@
+package ydmeta
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	tikverr "github.com/tikv/client-go/v2/error"
+	"github.com/tikv/client-go/v2/txnkv/transaction"
+)
+
+var (
+	ErrNoSuchUpload = errors.New("no such upload")
+	ErrInvalidPart  = errors.New("invalid part")
+	ErrUploadActive = errors.New("upload is active")
+)
+
+// MultipartUpload is an upload session. Its record lives at
+// GenMultipartKey(bucket, uploadID) for as long as the upload is in
+// progress, and its parts at their PartKey right after it. Part
+// numbers are the zero based indices that ObjectInfo.PartTotal counts.
+type MultipartUpload struct {
+	o    *ObjectMetaManager
+	Meta MultipartMetaV1
+}
+
+// MultipartPart is one uploaded part.
+type MultipartPart struct {
+	Number int
+	// Key is the key the part is stored under, in either format.
+	Key string
+	// Value is the value stored under Key.
+	Value []byte `json:"-"`
+	MultipartPartMetaV1
+}
+
+// CompletedPart names a part, and optionally its etag, in
+// CompleteMultipartUpload.
+type CompletedPart struct {
+	Number int
+	Etag   string
+}
+
+func newUploadID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// InitiateMultipartUpload starts an upload of object. Bucket, Object,
+// UploadID, Version and the times of meta are filled in.
+func (o *ObjectMetaManager) InitiateMultipartUpload(bucket string, object string, meta MultipartMetaV1) (*MultipartUpload, error) {
+	uploadID, err := newUploadID()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	meta.Bucket = bucket
+	meta.Object = object
+	meta.UploadID = uploadID
+	meta.Version = strconv.Itoa(UploadVersion())
+	meta.InitiateTime = now
+	meta.ModTime = now
+
+	val, err := o.Encode(&meta)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := o.client.Begin()
+	if err != nil {
+		return nil, err
+	}
+	key := []byte(GenMultipartKey(bucket, uploadID))
+	if _, err = tx.Get(context.TODO(), key); err == nil {
+		return nil, fmt.Errorf("key %q has existed", key)
+	} else if !errors.Is(err, tikverr.ErrNotExist) {
+		return nil, err
+	}
+	if err = tx.Set(key, val); err != nil {
+		return nil, err
+	}
+	if err = setUploadIndex(tx, bucket, object, uploadID); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(context.Background()); err != nil {
+		return nil, err
+	}
+	return &MultipartUpload{o: o, Meta: meta}, nil
+}
+
+func getUploadMeta(tx *transaction.KVTxn, bucket string, uploadID string) (*MultipartMetaV1, error) {
+	meta, _, err := getUploadRecord(tx, bucket, uploadID)
+	return meta, err
+}
+
+// getUploadRecord is getUploadMeta that also returns the stored value.
+func getUploadRecord(tx *transaction.KVTxn, bucket string, uploadID string) (*MultipartMetaV1, []byte, error) {
+	val, _, err := getDual(tx, GenMultipartKey(bucket, uploadID), legacyMultipartKey(bucket, uploadID))
+	if err != nil {
+		if errors.Is(err, tikverr.ErrNotExist) {
+			return nil, nil, ErrNoSuchUpload
+		}
+		return nil, nil, err
+	}
+	meta, err := decodeUpload(val)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parse MultipartMeta info error: %s", err.Error())
+	}
+	return meta, val, nil
+}
+
+// lockUpload reads the upload record and adds it to the write set of tx, so
+// that tx conflicts with a concurrent completion or abort of the upload.
+func lockUpload(tx *transaction.KVTxn, bucket string, uploadID string) (*MultipartMetaV1, error) {
+	meta, err := getUploadMeta(tx, bucket, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.LockKeysWithWaitTime(context.TODO(), 0,
+		[]byte(GenMultipartKey(bucket, uploadID)), []byte(legacyMultipartKey(bucket, uploadID)))
+	if err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// GetMultipartUpload returns an upload in progress, or ErrNoSuchUpload.
+func (o *ObjectMetaManager) GetMultipartUpload(bucket string, uploadID string) (*MultipartUpload, error) {
+	tx, err := o.client.Begin()
+	if err != nil {
+		return nil, err
+	}
+	meta, err := getUploadMeta(tx, bucket, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	return &MultipartUpload{o: o, Meta: *meta}, nil
+}
+
+// UploadPart stores part partNumber. A part that is uploaded again replaces
+// the previous one, which is moved to the deleted multiparts for the cleaner
+// to reclaim.
+// The part's ModTime defaults to now.
+func (u *MultipartUpload) UploadPart(partNumber int, part *MultipartPartMetaV1) error {
+	if partNumber < 0 {
+		return fmt.Errorf("%w: part number %d", ErrInvalidPart, partNumber)
+	}
+	if part.ModTime.IsZero() {
+		part.ModTime = time.Now()
+	}
+	val, err := u.o.Encode(part)
+	if err != nil {
+		return err
+	}
+
+	tx, err := u.o.client.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = lockUpload(tx, u.Meta.Bucket, u.Meta.UploadID); err != nil {
+		return err
+	}
+
+	pk := PartKey{Bucket: u.Meta.Bucket, UploadID: u.Meta.UploadID, PartNumber: partNumber}
+	key := []byte(pk.String())
+	old, _, err := getDual(tx, string(key), pk.legacyString())
+	if err != nil {
+		if !errors.Is(err, tikverr.ErrNotExist) {
+			return err
+		}
+	} else {
+		if err = tx.Set([]byte(genDeletedMultipartKey(u.Meta.Bucket, pk.Name())), old); err != nil {
+			return err
+		}
+	}
+	if err = setDual(tx, string(key), pk.legacyString(), val); err != nil {
+		return err
+	}
+	return tx.Commit(context.Background())
+}
+
+// ListParts returns up to limit parts numbered above marker, in order; pass
+// -1 to start from the first part. truncated reports whether more follow.
+func (u *MultipartUpload) ListParts(marker int, limit int) (parts []MultipartPart, truncated bool, err error) {
+	tx, err := u.o.client.Begin()
+	if err != nil {
+		return nil, false, err
+	}
+	return u.listParts(tx, marker, limit)
+}
+
+func (u *MultipartUpload) listParts(tx *transaction.KVTxn, marker int, limit int) (parts []MultipartPart,
+	truncated bool, err error) {
+	if limit <= 0 {
+		limit = 1000
+	}
+	var start, legacyStart []byte
+	if marker >= 0 {
+		pk := PartKey{Bucket: u.Meta.Bucket, UploadID: u.Meta.UploadID, PartNumber: marker + 1}
+		start, legacyStart = []byte(pk.String()), []byte(pk.legacyString())
+	}
+	it, err := iterDual(tx, []byte(GenMultipartKey(u.Meta.Bucket, u.Meta.UploadID)), start,
+		[]byte(legacyMultipartKey(u.Meta.Bucket, u.Meta.UploadID)+KEY_SEPARATOR), legacyStart)
+	if err != nil {
+		return nil, false, err
+	}
+	defer it.Close()
+
+	for it.Valid() {
+		// legacy keys of uploads whose ID extends ours share the prefix
+		if pk, ok := ParsePartKey(string(it.Key())); ok && pk.UploadID == u.Meta.UploadID {
+			if len(parts) == limit {
+				return parts, true, nil
+			}
+			part := MultipartPart{
+				Number: pk.PartNumber,
+				Key:    string(it.Key()),
+				Value:  append([]byte(nil), it.Value()...),
+			}
+			if err = DecodeValue(it.Value(), &part.MultipartPartMetaV1); err != nil {
+				return nil, false, fmt.Errorf("parse part %d error: %s", pk.PartNumber, err.Error())
+			}
+			parts = append(parts, part)
+		}
+		if err = it.Next(); err != nil {
+			return nil, false, err
+		}
+	}
+	return parts, false, nil
+}
+
+// multipartEtag is the S3 style etag of a multipart object: the md5 of the
+// concatenated part md5s, suffixed with the part count.
+func multipartEtag(etags []string) string {
+	h := md5.New()
+	for _, etag := range etags {
+		etag = strings.Trim(etag, `"`)
+		if b, err := hex.DecodeString(etag); err == nil {
+			h.Write(b)
+		} else {
+			h.Write([]byte(etag))
+		}
+	}
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(h.Sum(nil)), len(etags))
+}
+
+// Complete turns the upload into a large object made of parts, which must be
+// numbered 0 to len(parts)-1 and, except for the last one, all of the same
+// size. The object record is written, any previous version of the object is
+// moved to the deleted objects and the upload record is removed in a single
+// transaction. Uploaded parts that are not listed are left to the cleaner.
+func (u *MultipartUpload) Complete(parts []CompletedPart) (*ObjectInfo, error) {
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("%w: no parts", ErrInvalidPart)
+	}
+	tx, err := u.o.client.Begin()
+	if err != nil {
+		return nil, err
+	}
+	meta, err := getUploadMeta(tx, u.Meta.Bucket, u.Meta.UploadID)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([][]byte, 0, 2*len(parts))
+	for i, p := range parts {
+		if p.Number != i {
+			return nil, fmt.Errorf("%w: expected part %d, got %d", ErrInvalidPart, i, p.Number)
+		}
+		pk := PartKey{Bucket: meta.Bucket, UploadID: meta.UploadID, PartNumber: p.Number}
+		keys = append(keys, []byte(pk.String()), []byte(pk.legacyString()))
+	}
+	vals, err := tx.BatchGet(context.TODO(), keys)
+	if err != nil {
+		return nil, err
+	}
+
+	var size, partSize int64
+	etags := make([]string, len(parts))
+	for i, p := range parts {
+		val, ok := vals[string(keys[2*i])]
+		if !ok {
+			val, ok = vals[string(keys[2*i+1])]
+		}
+		if !ok {
+			return nil, fmt.Errorf("%w: part %d has not been uploaded", ErrInvalidPart, p.Number)
+		}
+		part := &MultipartPartMetaV1{}
+		if err = DecodeValue(val, part); err != nil {
+			return nil, fmt.Errorf("parse part %d error: %s", p.Number, err.Error())
+		}
+		if p.Etag != "" && strings.Trim(p.Etag, `"`) != strings.Trim(part.Etag, `"`) {
+			return nil, fmt.Errorf("%w: etag of part %d does not match", ErrInvalidPart, p.Number)
+		}
+		if i == 0 {
+			partSize = part.Size
+		} else if part.Size > partSize || (i < len(parts)-1 && part.Size != partSize) {
+			return nil, fmt.Errorf("%w: part %d has size %d, expected %d", ErrInvalidPart, p.Number, part.Size, partSize)
+		}
+		size += part.Size
+		etags[i] = part.Etag
+	}
+
+	info := &ObjectInfo{
+		Name:            meta.Object,
+		Size:            size,
+		Bucket:          meta.Bucket,
+		Etag:            multipartEtag(etags),
+		ModTime:         time.Now(),
+		ContentType:     meta.ContentType,
+		ContentEncoding: meta.ContentEncoding,
+		Type:            ObjectLargeType,
+		ExtFields:       meta.ExtFields,
+		UploadID:        meta.UploadID,
+		PartSize:        partSize,
+		PartTotal:       int64(len(parts)),
+		Version:         strconv.Itoa(ObjectVersion()),
+	}
+	val, err := u.o.Encode(info)
+	if err != nil {
+		return nil, err
+	}
+
+	key, legacyKey := GenObjectKey(meta.Bucket, meta.Object), legacyObjectKey(meta.Bucket, meta.Object)
+	old, _, err := getDual(tx, key, legacyKey)
+	if err != nil {
+		if !errors.Is(err, tikverr.ErrNotExist) {
+			return nil, err
+		}
+	} else if err = setDeletedObject(tx, meta.Bucket, meta.Object, old); err != nil {
+		return nil, err
+	}
+	if err = setDual(tx, key, legacyKey, val); err != nil {
+		return nil, err
+	}
+	err = deleteDual(tx, GenMultipartKey(meta.Bucket, meta.UploadID), legacyMultipartKey(meta.Bucket, meta.UploadID))
+	if err != nil {
+		return nil, err
+	}
+	if err = deleteUploadIndex(tx, meta.Bucket, meta.Object, meta.UploadID); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(context.Background()); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Abort ends the upload. The upload record is removed and the parts are
+// moved to the deleted multiparts in the same transaction, for the cleaner to
+// reclaim their data.
+func (u *MultipartUpload) Abort() error {
+	tx, err := u.o.client.Begin()
+	if err != nil {
+		return err
+	}
+	meta, err := getUploadMeta(tx, u.Meta.Bucket, u.Meta.UploadID)
+	if err != nil {
+		return err
+	}
+	marker := -1
+	for {
+		parts, truncated, err := u.listParts(tx, marker, 0)
+		if err != nil {
+			return err
+		}
+		for _, part := range parts {
+			if err = deletePart(tx, u.Meta.Bucket, u.Meta.UploadID, part); err != nil {
+				return err
+			}
+		}
+		if !truncated {
+			break
+		}
+		marker = parts[len(parts)-1].Number
+	}
+	err = deleteDual(tx, GenMultipartKey(u.Meta.Bucket, u.Meta.UploadID), legacyMultipartKey(u.Meta.Bucket, u.Meta.UploadID))
+	if err != nil {
+		return err
+	}
+	if err = deleteUploadIndex(tx, u.Meta.Bucket, meta.Object, u.Meta.UploadID); err != nil {
+		return err
+	}
+	return tx.Commit(context.Background())
+}
+
+// deletePart moves part to the deleted multiparts.
+func deletePart(tx *transaction.KVTxn, bucket string, uploadID string, part MultipartPart) error {
+	pk := PartKey{Bucket: bucket, UploadID: uploadID, PartNumber: part.Number}
+	if err := tx.Set([]byte(genDeletedMultipartKey(bucket, pk.Name())), part.Value); err != nil {
+		return err
+	}
+	return deleteDual(tx, pk.String(), pk.legacyString())
+}
+
+// MultipartUploadInfo summarizes an upload in progress.
+type MultipartUploadInfo struct {
+	Bucket    string
+	Object    string
+	UploadID  string
+	Initiated time.Time
+	// LastModified is the time of the newest part, or of the upload
+	// record when no part is newer.
+	LastModified time.Time
+	PartCount    int
+	Size         int64
+}
+
+// ListMultipartUploads returns up to limit uploads in progress in bucket,
+// ordered by object and then upload ID, that follow the markers as in S3's
+// ListMultipartUploads: uploads of objects after keyMarker, and uploads of
+// keyMarker itself with an upload ID after uploadIDMarker. truncated
+// reports whether more follow.
+//
+// Pages are read from the markers on through the upload index once
+// UploadIndexMigration is done. Until then every page reads all the uploads
+// of the bucket.
+func (o *ObjectMetaManager) ListMultipartUploads(bucket string, keyMarker string, uploadIDMarker string,
+	limit int) (uploads []MultipartUploadInfo, truncated bool, err error) {
+	if limit <= 0 {
+		limit = 1000
+	}
+	tx, err := o.client.Begin()
+	if err != nil {
+		return nil, false, err
+	}
+	status, err := getMigrationStatus(tx, UploadIndexMigration)
+	if err != nil {
+		return nil, false, err
+	}
+	if status.Done {
+		return listIndexedUploads(tx, bucket, keyMarker, uploadIDMarker, limit)
+	}
+
+	all, err := listBucketUploads(tx, bucket)
+	if err != nil {
+		return nil, false, err
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Object != all[j].Object {
+			return all[i].Object < all[j].Object
+		}
+		return all[i].UploadID < all[j].UploadID
+	})
+	for _, u := range all {
+		if !afterUploadMarkers(u.Object, u.UploadID, keyMarker, uploadIDMarker) {
+			continue
+		}
+		if len(uploads) == limit {
+			return uploads, true, nil
+		}
+		uploads = append(uploads, u)
+	}
+	return uploads, false, nil
+}
+
+// ListBucketUploads returns all the uploads in progress in bucket, ordered
+// by upload ID. It reads the upload records themselves, in one pass, and so
+// does not depend on the upload index.
+func (o *ObjectMetaManager) ListBucketUploads(bucket string) ([]MultipartUploadInfo, error) {
+	tx, err := o.client.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return listBucketUploads(tx, bucket)
+}
+
+func listBucketUploads(tx *transaction.KVTxn, bucket string) ([]MultipartUploadInfo, error) {
+	it, err := iterDual(tx, []byte(genBucketMultipartKey(bucket)), nil,
+		[]byte(legacyBucketMultipartKey(bucket)), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	// an upload record sorts before its parts, as it prefixes their keys
+	var all []MultipartUploadInfo
+	index := make(map[string]int)
+	for it.Valid() {
+		if pk, ok := ParsePartKey(string(it.Key())); ok {
+			part := &MultipartPartMetaV1{}
+			if i, found := index[pk.UploadID]; found && DecodeValue(it.Value(), part) == nil {
+				all[i].addPart(part)
+			}
+		} else {
+			if meta, err := decodeUpload(it.Value()); err == nil {
+				_, uploadID, _ := ParseMultipartKey(string(it.Key()))
+				index[uploadID] = len(all)
+				all = append(all, newUploadInfo(bucket, uploadID, meta))
+			}
+		}
+		if err = it.Next(); err != nil {
+			return nil, err
+		}
+	}
+	return all, nil
+}
+
+func newUploadInfo(bucket string, uploadID string, meta *MultipartMetaV1) MultipartUploadInfo {
+	initiated := meta.InitiateTime
+	if initiated.IsZero() {
+		initiated = meta.ModTime
+	}
+	return MultipartUploadInfo{
+		Bucket:       bucket,
+		Object:       meta.Object,
+		UploadID:     uploadID,
+		Initiated:    initiated,
+		LastModified: latest(initiated, meta.ModTime),
+	}
+}
+
+func (u *MultipartUploadInfo) addPart(part *MultipartPartMetaV1) {
+	u.PartCount++
+	u.Size += part.Size
+	u.LastModified = latest(u.LastModified, part.ModTime)
+}
+
+func latest(a time.Time, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
+
+// AbortIdleMultipartUpload aborts an upload on behalf of the cleaner while l
+// is held, provided neither its record nor any of its parts was modified
+// after idleSince; otherwise it returns ErrUploadActive. The upload record is
+// removed and the parts are returned for the caller to reclaim. Before the
+// removal is committed, record is called with the value of the upload
+// record, and a failure of record cancels the abort.
+func (o *ObjectMetaManager) AbortIdleMultipartUpload(l *Lease, bucket string, uploadID string,
+	idleSince time.Time, record func(value []byte) error) ([]MultipartPart, error) {
+	tx, err := o.client.Begin()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = l.check(tx, false); err != nil {
+		return nil, err
+	}
+	meta, value, err := getUploadRecord(tx, bucket, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	if meta.ModTime.After(idleSince) {
+		return nil, ErrUploadActive
+	}
+
+	u := &MultipartUpload{o: o, Meta: *meta}
+	var parts []MultipartPart
+	marker := -1
+	for {
+		page, truncated, err := u.listParts(tx, marker, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, part := range page {
+			if part.ModTime.After(idleSince) {
+				return nil, ErrUploadActive
+			}
+		}
+		parts = append(parts, page...)
+		if !truncated {
+			break
+		}
+		marker = page[len(page)-1].Number
+	}
+
+	// deleting the record conflicts with parts uploaded meanwhile
+	if err = deleteDual(tx, GenMultipartKey(bucket, uploadID), legacyMultipartKey(bucket, uploadID)); err != nil {
+		return nil, err
+	}
+	if err = deleteUploadIndex(tx, bucket, meta.Object, uploadID); err != nil {
+		return nil, err
+	}
+	if err = record(value); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(context.Background()); err != nil {
+		return nil, err
+	}
+	return parts, nil
+}
@@ -0,0 +1,332 @@
+package ydmeta
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultipartUpload(t *testing.T) {
+	u, err := om.InitiateMultipartUpload(testBucketName, "upload-test", MultipartMetaV1{ContentType: "text/plain"})
+	require.Nil(t, err)
+	require.NotEmpty(t, u.Meta.UploadID)
+
+	got, err := om.GetMultipartUpload(testBucketName, u.Meta.UploadID)
+	require.Nil(t, err)
+	require.Equal(t, "upload-test", got.Meta.Object)
+
+	for i, size := range []int64{100, 100, 40} {
+		require.Nil(t, u.UploadPart(i, &MultipartPartMetaV1{Size: size, Etag: "d41d8cd98f00b204e9800998ecf8427e"}))
+	}
+	parts, truncated, err := u.ListParts(-1, 2)
+	require.Nil(t, err)
+	require.True(t, truncated)
+	require.Equal(t, 2, len(parts))
+	parts, truncated, err = u.ListParts(1, 2)
+	require.Nil(t, err)
+	require.False(t, truncated)
+	require.Equal(t, 1, len(parts))
+	require.Equal(t, 2, parts[0].Number)
+
+	_, err = u.Complete([]CompletedPart{{Number: 0}, {Number: 2}})
+	require.True(t, errors.Is(err, ErrInvalidPart))
+
+	info, err := u.Complete([]CompletedPart{{Number: 0}, {Number: 1}, {Number: 2}})
+	require.Nil(t, err)
+	require.Equal(t, ObjectLargeType, info.Type)
+	require.Equal(t, int64(240), info.Size)
+	require.Equal(t, int64(100), info.PartSize)
+	require.Equal(t, int64(3), info.PartTotal)
+
+	obj, err := om.GetObject(testBucketName, "upload-test")
+	require.Nil(t, err)
+	require.Equal(t, u.Meta.UploadID, obj.UploadID)
+	_, err = om.GetMultipartUpload(testBucketName, u.Meta.UploadID)
+	require.True(t, errors.Is(err, ErrNoSuchUpload))
+
+	aborted, err := om.InitiateMultipartUpload(testBucketName, "upload-test", MultipartMetaV1{})
+	require.Nil(t, err)
+	require.Nil(t, aborted.UploadPart(0, &MultipartPartMetaV1{Size: 7}))
+	require.Nil(t, aborted.Abort())
+	require.True(t, errors.Is(aborted.UploadPart(0, &MultipartPartMetaV1{}), ErrNoSuchUpload))
+	requireDeletedPart(t, PartKey{Bucket: testBucketName, UploadID: aborted.Meta.UploadID}, 7)
+
+	require.Nil(t, om.DeleteObject(testBucketName, "upload-test"))
+}
+
+// requireDeletedPart checks that the part at pk is gone and that a deleted
+// multipart record holds it.
+func requireDeletedPart(t *testing.T, pk PartKey, size int64) {
+	parts, err := om.GetParts([]PartKey{pk})
+	require.Nil(t, err)
+	require.Empty(t, parts)
+
+	it, err := om.ListDeletedMultipartsByIter()
+	require.Nil(t, err)
+	cur := it.Cursor()
+	defer cur.Close()
+	found := false
+	for cur.Next() {
+		if _, deleted, ok := ParseDeletedPartKey(cur.Item().Key); ok && deleted == pk {
+			require.Nil(t, cur.Item().Err)
+			require.Equal(t, size, cur.Item().Part.Size)
+			found = true
+		}
+	}
+	require.Nil(t, cur.Err())
+	require.True(t, found)
+}
+
+func TestListMultipartUploads(t *testing.T) {
+	bucket := "list-uploads-test"
+	var ids []string
+	for _, object := range []string{"b", "a", "b"} {
+		u, err := om.InitiateMultipartUpload(bucket, object, MultipartMetaV1{})
+		require.Nil(t, err)
+		require.Nil(t, u.UploadPart(0, &MultipartPartMetaV1{Size: 10}))
+		require.Nil(t, u.UploadPart(1, &MultipartPartMetaV1{Size: 5}))
+		ids = append(ids, u.Meta.UploadID)
+		defer u.Abort()
+	}
+	// an index entry whose upload is gone
+	tx, err := om.client.Begin()
+	require.Nil(t, err)
+	require.Nil(t, setUploadIndex(tx, bucket, "a", "gone"))
+	require.Nil(t, tx.Commit(context.Background()))
+	defer om.dels([]byte(genUploadIndexKey(bucket, "a", "gone")))
+
+	check := func() {
+		uploads, truncated, err := om.ListMultipartUploads(bucket, "", "", 2)
+		require.Nil(t, err)
+		require.True(t, truncated)
+		require.Equal(t, "a", uploads[0].Object)
+		require.Equal(t, ids[1], uploads[0].UploadID)
+		require.Equal(t, 2, uploads[0].PartCount)
+		require.Equal(t, int64(15), uploads[0].Size)
+		require.False(t, uploads[0].Initiated.IsZero())
+
+		last := uploads[1]
+		uploads, truncated, err = om.ListMultipartUploads(bucket, last.Object, last.UploadID, 2)
+		require.Nil(t, err)
+		require.False(t, truncated)
+		require.Equal(t, 1, len(uploads))
+		require.Equal(t, "b", uploads[0].Object)
+		require.NotEqual(t, last.UploadID, uploads[0].UploadID)
+
+		uploads, truncated, err = om.ListMultipartUploads(bucket, "a", "", 1)
+		require.Nil(t, err)
+		require.True(t, truncated)
+		require.Equal(t, "b", uploads[0].Object)
+
+		uploads, _, err = om.ListMultipartUploads(bucket, "b", "", 0)
+		require.Nil(t, err)
+		require.Equal(t, 0, len(uploads))
+	}
+
+	mig, ok := LookupMigration(UploadIndexMigration)
+	require.True(t, ok)
+	require.Nil(t, om.ResetMigration(mig.Name))
+	check()
+	l := migrationLease(t)
+	defer l.Release()
+	status, err := om.Migrate(context.Background(), l, "migrate-test", mig, 100, nil)
+	require.Nil(t, err)
+	require.True(t, status.Done)
+	check()
+
+	all, err := om.ListBucketUploads(bucket)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(all))
+}
+
+func TestAbortIdleMultipartUpload(t *testing.T) {
+	om.dels([]byte(GenLeaseKey("abort-test")))
+	l, err := om.AcquireLease("abort-test", "owner", 10*time.Second)
+	require.Nil(t, err)
+	defer l.Release()
+
+	u, err := om.InitiateMultipartUpload(testBucketName, "abort-test", MultipartMetaV1{})
+	require.Nil(t, err)
+	require.Nil(t, u.UploadPart(0, &MultipartPartMetaV1{Size: 10}))
+
+	var recorded []byte
+	record := func(value []byte) error {
+		recorded = value
+		return nil
+	}
+	_, err = om.AbortIdleMultipartUpload(l, testBucketName, u.Meta.UploadID, time.Now().Add(-time.Hour), record)
+	require.True(t, errors.Is(err, ErrUploadActive))
+	require.Nil(t, recorded)
+
+	// a failure to record the abort cancels it
+	failed := errors.New("audit failed")
+	_, err = om.AbortIdleMultipartUpload(l, testBucketName, u.Meta.UploadID, time.Now(),
+		func([]byte) error { return failed })
+	require.True(t, errors.Is(err, failed))
+	_, err = om.GetMultipartUpload(testBucketName, u.Meta.UploadID)
+	require.Nil(t, err)
+
+	parts, err := om.AbortIdleMultipartUpload(l, testBucketName, u.Meta.UploadID, time.Now(), record)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(parts))
+	meta := &MultipartMetaV1{}
+	require.Nil(t, DecodeValue(recorded, meta))
+	require.Equal(t, u.Meta.UploadID, meta.UploadID)
+	_, err = om.GetMultipartUpload(testBucketName, u.Meta.UploadID)
+	require.True(t, errors.Is(err, ErrNoSuchUpload))
+
+	require.Nil(t, om.dels([]byte(PartKey{Bucket: testBucketName, UploadID: u.Meta.UploadID}.String())))
+}
+
+func TestMigrateMultipartTombstones(t *testing.T) {
+	mig, ok := LookupMigration("multipart-tombstones")
+	require.True(t, ok)
+	require.Nil(t, om.ResetMigration(mig.Name))
+
+	value := []byte(`{"Size":10}`)
+	tombstones := []string{
+		"YDS3_MULTIPART#1672531200000000000#" + testBucketName + "#up#00001",
+		"YDS3_MULTIPART#1672531200000000001#" + testBucketName + "#up#00002",
+	}
+	for _, key := range tombstones {
+		require.Nil(t, om.set([]byte(key), value))
+	}
+
+	// one record per batch, the checkpoint moves past it
+	l := migrationLease(t)
+	defer l.Release()
+	status, err := om.MigrateBatch(l, "migrate-test", mig, 1)
+	require.Nil(t, err)
+	require.False(t, status.Done)
+	require.NotNil(t, status.Next)
+
+	status, err = om.Migrate(context.Background(), l, "migrate-test", mig, 1, nil)
+	require.Nil(t, err)
+	require.True(t, status.Done)
+	require.GreaterOrEqual(t, status.Migrated, int64(2))
+
+	for i, key := range tombstones {
+		_, err = om.get([]byte(key))
+		require.NotNil(t, err)
+		moved := Pack(DELETED_MULTIPART_PREFIX, int64(1672531200000000000+i), testBucketName, "up#"+EncodePartNumber(i+1))
+		val, err := om.get(moved)
+		require.Nil(t, err)
+		require.Equal(t, value, val)
+		require.Nil(t, om.dels(moved))
+	}
+
+	// a finished migration does nothing more
+	status, err = om.MigrateBatch(l, "migrate-test", mig, 1)
+	require.Nil(t, err)
+	require.True(t, status.Done)
+}
+
+func TestQuarantine(t *testing.T) {
+	om.dels([]byte(GenLeaseKey("quarantine-test")))
+	l, err := om.AcquireLease("quarantine-test", "owner", 10*time.Second)
+	require.Nil(t, err)
+	defer l.Release()
+
+	part := PartKey{Bucket: testBucketName, UploadID: "quarantined", PartNumber: 1}.String()
+	value := []byte(`{"Size":10}`)
+	require.Nil(t, om.set([]byte(part), value))
+	require.Nil(t, om.QuarantineKeys(l, "test", part))
+	_, err = om.get([]byte(part))
+	require.NotNil(t, err)
+
+	var qkeys []string
+	iter, err := om.ListQuarantineByIter()
+	require.Nil(t, err)
+	for ; iter.Valid(); iter.Next() {
+		entry := iter.Value()
+		require.NotNil(t, entry)
+		if entry.Key == part {
+			require.Equal(t, value, entry.Value)
+			require.Equal(t, "test", entry.Reason)
+			qkeys = append(qkeys, iter.Key())
+		}
+	}
+	iter.Close()
+	require.Equal(t, 1, len(qkeys))
+
+	released, err := om.ReleaseQuarantined(l, qkeys...)
+	require.Nil(t, err)
+	require.Equal(t, 1, released)
+	got, err := om.get([]byte(part))
+	require.Nil(t, err)
+	require.Equal(t, value, got)
+
+	require.Nil(t, om.QuarantineKeys(l, "test", part))
+	iter, err = om.ListQuarantineByIter()
+	require.Nil(t, err)
+	qkeys = qkeys[:0]
+	for ; iter.Valid(); iter.Next() {
+		qkeys = append(qkeys, iter.Key())
+	}
+	iter.Close()
+	require.Nil(t, om.DeleteQuarantineKeys(l, qkeys...))
+	_, err = om.get([]byte(part))
+	require.NotNil(t, err)
+}
+
+func TestScopedMultipartIters(t *testing.T) {
+	bucket := "scoped-iter-test"
+	value := []byte(`{"Size":10}`)
+	keys := []string{
+		legacyMultipartKey(bucket, "scoped"),
+		PartKey{Bucket: bucket, UploadID: "scoped", PartNumber: 1}.legacyString(),
+		PartKey{Bucket: bucket, UploadID: "scoped", PartNumber: 2}.String(),
+		GenMultipartKey(bucket, "scoped2"),
+		PartKey{Bucket: bucket + "d", UploadID: "scoped", PartNumber: 1}.legacyString(),
+	}
+	for _, key := range keys {
+		require.Nil(t, om.set([]byte(key), value))
+	}
+	defer func() {
+		for _, key := range keys {
+			require.Nil(t, om.dels([]byte(key)))
+		}
+	}()
+
+	collect := func(iter *MultipartMetaIter, err error) []string {
+		require.Nil(t, err)
+		defer iter.Close()
+		var got []string
+		for ; iter.Valid(); iter.Next() {
+			got = append(got, iter.Key())
+		}
+		return got
+	}
+	require.Equal(t, keys[:3], collect(om.ListUploadMultipartByIter(bucket, "scoped")))
+	require.Equal(t, keys[:4], collect(om.ListBucketMultipartByIter(bucket)))
+	require.Equal(t, keys[4:], collect(om.ListBucketMultipartByIter(bucket+"d")))
+}
+
+func TestListMultipartsPage(t *testing.T) {
+	u, err := om.InitiateMultipartUpload(testBucketName, "paged", MultipartMetaV1{})
+	require.Nil(t, err)
+	defer u.Abort()
+	for i := 0; i < 5; i++ {
+		require.Nil(t, u.UploadPart(i, &MultipartPartMetaV1{Size: 1}))
+	}
+
+	var numbers []int
+	in := ListMultipartsInput{UploadID: u.Meta.UploadID, PartNumberMarker: 0, MaxParts: 2}
+	for {
+		page, err := om.ListMultipartsPage(testBucketName, in)
+		require.Nil(t, err)
+		for _, kv := range page.Parts {
+			pk, ok := ParsePartKey(string(kv.K))
+			require.True(t, ok)
+			numbers = append(numbers, pk.PartNumber)
+		}
+		if !page.IsTruncated {
+			break
+		}
+		in.ContinuationToken = page.NextContinuationToken
+	}
+	require.Equal(t, []int{1, 2, 3, 4}, numbers)
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/tikv/client-go/v2/txnkv"
+	"strconv"
 	"time"
 
 	tikverr "github.com/tikv/client-go/v2/error"
@@ -32,6 +33,77 @@ func (i *ObjectInfo) String() string {
 	return string(bs)
 }
 
+// ExtFids is the ObjectInfo.ExtFields entry holding the fids of the data of
+// an object that is not a large object, in order.
+const ExtFids = "fids"
+
+// Fids returns the fids of the data of the object, or nil when it has none.
+func (i *ObjectInfo) Fids() ([]FileIdInfo, error) {
+	switch v := i.ExtFields[ExtFids].(type) {
+	case nil:
+		return nil, nil
+	case []FileIdInfo:
+		return v, nil
+	case []interface{}:
+		return fidsFromJSON(v)
+	default:
+		return nil, fmt.Errorf("fids of %s/%s: unexpected %T", i.Bucket, i.Name, v)
+	}
+}
+
+// SetFids sets the fids of the data of the object.
+func (i *ObjectInfo) SetFids(fids []FileIdInfo) {
+	if len(fids) == 0 {
+		delete(i.ExtFields, ExtFids)
+		return
+	}
+	if i.ExtFields == nil {
+		i.ExtFields = make(map[string]interface{})
+	}
+	i.ExtFields[ExtFids] = fids
+}
+
+// ExtLegalHold is the ObjectInfo.ExtFields marker of objects under legal
+// hold, whose data must be kept even once deleted.
+const ExtLegalHold = "legalHold"
+
+// LegalHold tells whether the object is under legal hold.
+func (i *ObjectInfo) LegalHold() bool {
+	return extFlag(i.ExtFields, ExtLegalHold)
+}
+
+// fidsFromJSON converts fids decoded from JSON into generic values.
+func fidsFromJSON(v []interface{}) ([]FileIdInfo, error) {
+	fids := make([]FileIdInfo, 0, len(v))
+	for _, e := range v {
+		m, ok := e.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unexpected fid %v", e)
+		}
+		var fid FileIdInfo
+		for k, field := range m {
+			valid := true
+			switch k {
+			case "FileId":
+				fid.FileId, valid = field.(string)
+			case "Offset":
+				var n float64
+				n, valid = field.(float64)
+				fid.Offset = int64(n)
+			case "FileSize":
+				var n float64
+				n, valid = field.(float64)
+				fid.FileSize = int64(n)
+			}
+			if !valid {
+				return nil, fmt.Errorf("unexpected %s %v of fid", k, field)
+			}
+		}
+		fids = append(fids, fid)
+	}
+	return fids, nil
+}
+
 type ObjectMetaManager struct {
 	MetaManager
 }
@@ -44,24 +116,36 @@ func NewObjectMetaManager(addr string) (*ObjectMetaManager, error) {
 	return &ObjectMetaManager{MetaManager{client: client}}, nil
 }
 
+// NewObjectMetaManagerWithSecurity connects to the PD endpoints in addr over TLS.
+func NewObjectMetaManagerWithSecurity(addr string, sec Security) (*ObjectMetaManager, error) {
+	client, err := newTikvClientWithSecurity(addr, sec)
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectMetaManager{MetaManager{client: client}}, nil
+}
+
 func NewObjectMetaManagerByClient(client *txnkv.Client) *ObjectMetaManager {
 	return &ObjectMetaManager{MetaManager{client: client}}
 }
 
+// ListObjects lists up to limit objects of bucket under prefix, -1 for all.
+// ListObjectsPage lists them page by page.
 func (o *ObjectMetaManager) ListObjects(bucket string, prefix string, limit int) (keys []string,
 	objs []*ObjectInfo, err error) {
-	keyPrefix := fmt.Sprintf("%s#%s#%s", OBJECT_PREFIX, bucket, prefix)
+	keyPrefix := PackStringPrefix(prefix, OBJECT_PREFIX, bucket)
+	legacyPrefix := legacyObjectKey(bucket, prefix)
 	keys = make([]string, 0)
 	objs = make([]*ObjectInfo, 0)
 
-	raw, err := o.list([]byte(keyPrefix), limit)
+	raw, err := o.listDual(keyPrefix, nil, []byte(legacyPrefix), nil, limit)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	for _, kv := range raw {
-		oi := &ObjectInfo{}
-		if err = json.Unmarshal(kv.V, oi); err != nil {
+		oi, err := decodeObject(kv.V)
+		if err != nil {
 			return nil, nil, err
 		}
 		objs = append(objs, oi)
@@ -72,17 +156,23 @@ func (o *ObjectMetaManager) ListObjects(bucket string, prefix string, limit int)
 
 // ListBucketObjectsByIter returns an iter to list
 func (o *ObjectMetaManager) ListBucketObjectsByIter(bucket string) (*ObjectMetaIter, error) {
-	return newObjectMetaIter([]byte(GenBucketObjectKey(bucket)), o.client)
+	return o.ListBucketObjectsRangeByIter(bucket, IterOptions{})
+}
+
+// ListBucketObjectsRangeByIter iterates the objects of bucket within the
+// bounds of opt, which are object keys such as GenObjectKey(bucket, name).
+func (o *ObjectMetaManager) ListBucketObjectsRangeByIter(bucket string, opt IterOptions) (*ObjectMetaIter, error) {
+	return newObjectMetaIter(o.client, []byte(GenBucketObjectKey(bucket)), []byte(legacyBucketObjectKey(bucket)), opt)
 }
 
 //pure save
-func (o *ObjectMetaManager) save(bucket string, objectName string, value []byte, key string, delKey string) error {
+func (o *ObjectMetaManager) save(key string, legacyKey string, delKey string, value []byte) error {
 	tx, err := o.client.Begin()
 	if err != nil {
 		return err
 	}
 
-	objectInfo, err := tx.Get(context.TODO(), []byte(key))
+	objectInfo, _, err := getDual(tx, key, legacyKey)
 	if err != nil {
 		if !errors.Is(err, tikverr.ErrNotExist) {
 			return err
@@ -94,7 +184,7 @@ func (o *ObjectMetaManager) save(bucket string, objectName string, value []byte,
 		}
 	}
 
-	err = tx.Set([]byte(key), value)
+	err = setDual(tx, key, legacyKey, value)
 	if err != nil {
 		return err
 	}
@@ -108,21 +198,21 @@ func (o *ObjectMetaManager) SaveObject(bucket string, objectName string, value [
 		return err
 	}
 	key := GenObjectKey(bucket, objectName)
+	legacyKey := legacyObjectKey(bucket, objectName)
 
-	objectInfo, err := tx.Get(context.TODO(), []byte(key))
+	objectInfo, _, err := getDual(tx, key, legacyKey)
 	if err != nil {
 		if !errors.Is(err, tikverr.ErrNotExist) {
 			return err
 		}
 	} else {
-		delKey := GenDeletedObjectKey(bucket, objectName)
-		err = tx.Set([]byte(delKey), objectInfo)
+		err = setDeletedObject(tx, bucket, objectName, objectInfo)
 		if err != nil {
 			return err
 		}
 	}
 
-	err = tx.Set([]byte(key), value)
+	err = setDual(tx, key, legacyKey, value)
 	if err != nil {
 		return err
 	}
@@ -131,15 +221,12 @@ func (o *ObjectMetaManager) SaveObject(bucket string, objectName string, value [
 }
 
 func (o *ObjectMetaManager) GetObject(bucket string, objectName string) (*ObjectInfo, error) {
-	key := GenObjectKey(bucket, objectName)
-
-	val, err := o.get([]byte(key))
+	val, err := o.getDual(GenObjectKey(bucket, objectName), legacyObjectKey(bucket, objectName))
 	if err != nil {
 		return nil, err
 	}
 
-	objectInfo := new(ObjectInfo)
-	err = json.Unmarshal(val, objectInfo)
+	objectInfo, err := decodeObject(val)
 	if err != nil {
 		return nil, fmt.Errorf("parse object info error: %s", err.Error())
 	}
@@ -148,8 +235,7 @@ func (o *ObjectMetaManager) GetObject(bucket string, objectName string) (*Object
 }
 
 func (o *ObjectMetaManager) DeleteObject(bucket string, objectName string) error {
-	key := GenObjectKey(bucket, objectName)
-	return o.dels([]byte(key))
+	return o.delsDual(GenObjectKey(bucket, objectName), legacyObjectKey(bucket, objectName))
 }
 
 //Mark object as deleted
@@ -160,18 +246,18 @@ func (o *ObjectMetaManager) MarkObjectDeleted(bucket string, objectName string)
 	}
 	//get original object
 	oriKey := GenObjectKey(bucket, objectName)
-	val, err := tx.Get(context.TODO(), []byte(oriKey))
+	legacyKey := legacyObjectKey(bucket, objectName)
+	val, _, err := getDual(tx, oriKey, legacyKey)
 	if err != nil {
 		return err
 	}
 	// set deleted object
-	delKey := GenDeletedObjectKey(bucket, objectName)
-	err = tx.Set([]byte(delKey), val)
+	err = setDeletedObject(tx, bucket, objectName, val)
 	if err != nil {
 		return err
 	}
 	//delete original object
-	err = tx.Delete([]byte(oriKey))
+	err = deleteDual(tx, oriKey, legacyKey)
 	if err != nil {
 		return err
 	}
@@ -186,8 +272,7 @@ func (o *ObjectMetaManager) MarkObjectDeletedWithValue(bucket string, objectName
 	}
 
 	// set deleted object
-	delKey := GenDeletedObjectKey(bucket, objectName)
-	err = tx.Set([]byte(delKey), value)
+	err = setDeletedObject(tx, bucket, objectName, value)
 	if err != nil {
 		return err
 	}
@@ -195,26 +280,30 @@ func (o *ObjectMetaManager) MarkObjectDeletedWithValue(bucket string, objectName
 	return tx.Commit(context.Background())
 }
 
+// GetObjectName returns the object name of the object key objectName.
 func (o *ObjectMetaManager) GetObjectName(bucket string, objectName string) string {
-	var fname string
-	prefix := fmt.Sprintf("%s#%s#", OBJECT_PREFIX, bucket)
-	if len(prefix) > len(objectName) {
-		return ""
-	}
-	fname = objectName[len(prefix):] //objectName:includes filepath/filename
+	fname, _ := ParseObjectKey(objectName) //objectName:includes filepath/filename
 	return fname
 }
 
+// ListDeletedObjects lists deleted objects, oldest first, starting with the
+// ones deleted at start, a time in nanoseconds; an empty start lists from
+// the first.
+// ListDeletedObjectsPage lists them page by page.
 func (o *ObjectMetaManager) ListDeletedObjects(start string, limit int) (deletedKeys []string,
 	deletedObjectInfo []*ObjectInfo, err error) {
-	lhs := GenDeletedObjectPrefix(start)
-	raw, err := o.list([]byte(lhs), limit)
+	var lhs []byte
+	if tsp, parseErr := strconv.ParseInt(start, 10, 64); parseErr == nil {
+		lhs = Pack(DELETED_OBJECT_PREFIX, tsp)
+	}
+	legacyPrefix := DELETED_OBJECT_PREFIX + KEY_SEPARATOR
+	raw, err := o.listDual(Pack(DELETED_OBJECT_PREFIX), lhs, []byte(legacyPrefix), []byte(legacyPrefix+start), limit)
 	if err != nil {
 		return nil, nil, err
 	}
 	for _, kv := range raw {
-		oi := &ObjectInfo{}
-		if err = json.Unmarshal(kv.V, oi); err != nil {
+		oi, err := decodeObject(kv.V)
+		if err != nil {
 			return nil, nil, err
 		}
 		deletedObjectInfo = append(deletedObjectInfo, oi)
@@ -225,12 +314,30 @@ func (o *ObjectMetaManager) ListDeletedObjects(start string, limit int) (deleted
 
 // ListDeletedObjectsByIter need to ensure that each fetched key/value is deleted after use
 func (o *ObjectMetaManager) ListDeletedObjectsByIter() (*ObjectMetaIter, error) {
-	return newObjectMetaIter([]byte(GetDeletedObjectKey()), o.client)
+	return o.ListDeletedObjectsRangeByIter(IterOptions{})
+}
+
+// ListDeletedObjectsRangeByIter iterates the deleted objects within the
+// bounds of opt, by deletion time. Bounds such as
+// GenDeletedObjectTimeKey(since) select a period, and Reverse lists the
+// newest records first.
+func (o *ObjectMetaManager) ListDeletedObjectsRangeByIter(opt IterOptions) (*ObjectMetaIter, error) {
+	return newObjectMetaIter(o.client, []byte(GetDeletedObjectKey()), []byte(DELETED_OBJECT_PREFIX+KEY_SEPARATOR), opt)
 }
 
 // DeleteByDeletedKey delete object == pure deletion
 func (o *ObjectMetaManager) DeleteByDeletedKey(key string) error {
-	return o.dels([]byte(key))
+	return o.dels(withDeletedIndex([]byte(key))...)
+}
+
+// DeleteDeletedObjectKeys deletes raw deleted object keys while l is still
+// held.
+func (o *ObjectMetaManager) DeleteDeletedObjectKeys(l *Lease, keys ...string) error {
+	raw := make([][]byte, 0, len(keys))
+	for _, key := range keys {
+		raw = append(raw, []byte(key))
+	}
+	return o.delsFenced(l, withDeletedIndex(raw...)...)
 }
 
 type ObjectMetaIter struct {
@@ -239,36 +346,71 @@ type ObjectMetaIter struct {
 	interNext  func() error
 	interKey   func() []byte
 	interValue func() []byte
+	interSeek  func([]byte) error
 }
 
-func newObjectMetaIter(key []byte, tc *txnkv.Client) (*ObjectMetaIter, error) {
+func newObjectMetaIter(tc *txnkv.Client, prefix []byte, legacyPrefix []byte, opt IterOptions) (*ObjectMetaIter, error) {
 	tx, err := tc.Begin()
 	if err != nil {
 		return nil, err
 	}
-	it, err := tx.Iter(key, upper(key))
+	it, err := newDualIter(txnIter(tx), txnReverseIter(tx), prefix, legacyPrefix, opt)
 	if err != nil {
 		return nil, err
 	}
+	i := objectMetaIter(it)
+	i.interSeek = it.Seek
+	return i, nil
+}
+
+func objectMetaIter(it kvIter) *ObjectMetaIter {
 	return &ObjectMetaIter{
 		interClose: it.Close,
 		interValid: it.Valid,
 		interNext:  it.Next,
 		interKey:   it.Key,
 		interValue: it.Value,
-	}, nil
+	}
 }
 
 func (i *ObjectMetaIter) Next() error {
 	return i.interNext()
 }
 
+// Seek moves to the first record at or after key, or at or before it in
+// reverse, within the bounds the iterator was opened with. key is a record
+// key of either format, such as a key returned by Key, or a packed prefix of
+// keys.
+func (i *ObjectMetaIter) Seek(key string) error {
+	if i.interSeek == nil {
+		return ErrNotSeekable
+	}
+	return i.interSeek([]byte(key))
+}
+
+// Value decodes the current record, or returns an empty one when it cannot
+// be decoded. Cursor reports the error instead.
 func (i *ObjectMetaIter) Value() *ObjectInfo {
-	oi := &ObjectInfo{}
-	_ = json.Unmarshal(i.interValue(), oi)
+	oi, err := i.decode()
+	if err != nil {
+		return &ObjectInfo{}
+	}
 	return oi
 }
 
+func (i *ObjectMetaIter) decode() (*ObjectInfo, error) {
+	oi, err := decodeObject(i.interValue())
+	if err != nil {
+		return nil, &DecodeError{Key: i.Key(), Err: err}
+	}
+	return oi, nil
+}
+
+// RawValue returns a copy of the current value as stored.
+func (i *ObjectMetaIter) RawValue() []byte {
+	return append([]byte(nil), i.interValue()...)
+}
+
 func (i *ObjectMetaIter) Key() string {
 	return string(i.interKey())
 }
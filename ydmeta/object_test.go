@@ -1,6 +1,7 @@
 package ydmeta
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/stretchr/testify/assert"
@@ -56,6 +57,10 @@ func TestObjectInfo(t *testing.T) {
 	err = json.Unmarshal(fidsBytes, &fidInfos2)
 	require.Nil(t, err)
 	require.Equal(t, 8, len(fidInfos2))
+
+	fidInfos3, err := objectInfo2.Fids()
+	require.Nil(t, err)
+	require.Equal(t, fidInfos, fidInfos3)
 }
 
 func initTestBucket() {
@@ -106,16 +111,16 @@ func buildTestObjectInfoWithName(name string) ([]byte, error) {
 }
 
 func clearupObjects(t *testing.T) {
-	kvs, err := om.scan([]byte("YDS3_OBJECT#"), []byte("YDS3_OBJECT~"), 1024)
-	require.Nil(t, err)
-	for _, kv := range kvs {
-		om.dels(kv.K)
-	}
-
-	kvs, err = om.scan([]byte("YDS3_DELETED_OBJECT#"), []byte("YDS3_DELETED_OBJECT~"), 1024)
-	require.Nil(t, err)
-	for _, kv := range kvs {
-		om.dels(kv.K)
+	for _, prefix := range [][]byte{
+		Pack(OBJECT_PREFIX), []byte("YDS3_OBJECT#"),
+		Pack(DELETED_OBJECT_PREFIX), []byte("YDS3_DELETED_OBJECT#"),
+		Pack(DELETED_INDEX_PREFIX),
+	} {
+		kvs, err := om.scan(prefix, prefixEnd(prefix), 1024)
+		require.Nil(t, err)
+		for _, kv := range kvs {
+			om.dels(kv.K)
+		}
 	}
 }
 
@@ -131,11 +136,12 @@ func TestCreateDeleteObject(t *testing.T) {
 	require.Nil(t, err)
 	require.NotNil(t, objInfo)
 
-	objInfoBytes, err := om.get([]byte("YDS3_OBJECT#abc#objtest"))
+	objInfoBytes, err := om.get([]byte(GenObjectKey(testBucketName, "objtest")))
 	require.Nil(t, err)
 	t.Logf("%s", string(objInfoBytes))
 
-	kvs, err := om.scan([]byte("YDS3_DELETED_OBJECT#"), []byte("YDS3_DELETED_OBJECT~"), 10)
+	deleted := Pack(DELETED_OBJECT_PREFIX)
+	kvs, err := om.scan(deleted, prefixEnd(deleted), 10)
 	require.Nil(t, err)
 	require.Equal(t, 0, len(kvs))
 
@@ -144,14 +150,14 @@ func TestCreateDeleteObject(t *testing.T) {
 	err = om.SaveObject(testBucketName, "objtest", objectInfoBytes2)
 	require.Nil(t, err)
 
-	kvs, err = om.scan([]byte("YDS3_DELETED_OBJECT#"), []byte("YDS3_DELETED_OBJECT~"), 10)
+	kvs, err = om.scan(deleted, prefixEnd(deleted), 10)
 	require.Nil(t, err)
 	require.Equal(t, 1, len(kvs))
 
 	err = om.MarkObjectDeleted(testBucketName, "objtest")
 	require.Nil(t, err)
 
-	kvs, err = om.scan([]byte("YDS3_DELETED_OBJECT#"), []byte("YDS3_DELETED_OBJECT~"), 10)
+	kvs, err = om.scan(deleted, prefixEnd(deleted), 10)
 	require.Nil(t, err)
 	require.Equal(t, 2, len(kvs))
 }
@@ -160,9 +166,222 @@ func TestListKey(t *testing.T) {
 	tc, err := txnkv.NewClient([]string{"localhost:2379"})
 	assert.NoError(t, err)
 	om := NewObjectMetaManagerByClient(tc)
-	kvs, err := om.list([]byte(fmt.Sprintf("%s#%s#", MULTIPART_PREFIX, "shenjiaqi123")), 10)
+	kvs, err := om.list([]byte(genBucketMultipartKey("shenjiaqi123")), 10)
 	assert.NoError(t, err)
 	for _, kv := range kvs {
 		fmt.Println("key", string(kv.K))
 	}
 }
+
+// migrationLease takes the lease the migrations of a test run under.
+func migrationLease(t *testing.T) *Lease {
+	om.dels([]byte(GenLeaseKey("migrate-test")))
+	l, err := om.AcquireLease("migrate-test", "owner", 10*time.Second)
+	require.Nil(t, err)
+	return l
+}
+
+func TestLegacyObjectKeys(t *testing.T) {
+	clearupObjects(t)
+
+	legacyKey := []byte(legacyObjectKey(testBucketName, "dir#legacy"))
+	value, err := buildTestObjectInfoWithName("dir#legacy")
+	require.Nil(t, err)
+	require.Nil(t, om.set(legacyKey, value))
+	legacyValue := value
+	value, err = buildTestObjectInfoWithName("packed")
+	require.Nil(t, err)
+	require.Nil(t, om.SaveObject(testBucketName, "packed", value))
+
+	objInfo, err := om.GetObject(testBucketName, "dir#legacy")
+	require.Nil(t, err)
+	require.Equal(t, "dir#legacy", objInfo.Name)
+
+	keys, _, err := om.ListObjects(testBucketName, "", -1)
+	require.Nil(t, err)
+	require.Equal(t, []string{string(legacyKey), GenObjectKey(testBucketName, "packed")}, keys)
+
+	mig, ok := LookupMigration("packed-keys")
+	require.True(t, ok)
+	require.Nil(t, om.ResetMigration(mig.Name))
+	l := migrationLease(t)
+	defer l.Release()
+	start := time.Now()
+	status, err := om.Migrate(context.Background(), l, "migrate-test", mig, 2, nil)
+	require.Nil(t, err)
+	require.True(t, status.Done)
+	require.GreaterOrEqual(t, status.Migrated, int64(1))
+	_, err = om.get(legacyKey)
+	require.NotNil(t, err)
+
+	// the legacy record removed is in the audit trail
+	iter, err := om.ListAuditByIter(start)
+	require.Nil(t, err)
+	var audited []byte
+	for ; iter.Valid(); iter.Next() {
+		e, err := iter.Value()
+		require.Nil(t, err)
+		if e.Action == AuditMigrate && string(e.Key) == string(legacyKey) {
+			audited = e.Value
+		}
+	}
+	iter.Close()
+	require.Equal(t, legacyValue, audited)
+	objInfo, err = om.GetObject(testBucketName, "dir#legacy")
+	require.Nil(t, err)
+	require.Equal(t, "dir#legacy", objInfo.Name)
+}
+
+func TestDeletedIndex(t *testing.T) {
+	clearupObjects(t)
+
+	value, err := buildTestObjectInfoWithName("indexed")
+	require.Nil(t, err)
+	require.Nil(t, om.SaveObject(testBucketName, "indexed", value))
+	require.Nil(t, om.MarkObjectDeleted(testBucketName, "indexed"))
+	require.Nil(t, om.MarkObjectDeletedWithValue(testBucketName+"d", "other", value))
+	// a record written before the index was maintained
+	legacyKey := legacyDeletedObjectKey(1, testBucketName, "dir#legacy")
+	require.Nil(t, om.set([]byte(legacyKey), value))
+
+	list := func(buckets ...string) []string {
+		iter, err := om.ListBucketsDeletedObjectsByIter(buckets)
+		require.Nil(t, err)
+		defer iter.Close()
+		var keys []string
+		for ; iter.Valid(); iter.Next() {
+			keys = append(keys, iter.Key())
+		}
+		return keys
+	}
+	// unindexed legacy records follow the indexed ones, all of them until
+	// the migration is done
+	require.Nil(t, om.ResetMigration(DeletedIndexMigration))
+	keys := list(testBucketName)
+	require.Equal(t, 2, len(keys))
+	require.Equal(t, legacyKey, keys[1])
+	keys = keys[:1]
+
+	mig, ok := LookupMigration(DeletedIndexMigration)
+	require.True(t, ok)
+	require.Nil(t, om.ResetMigration(mig.Name))
+	l := migrationLease(t)
+	defer l.Release()
+	status, err := om.Migrate(context.Background(), l, "migrate-test", mig, 2, nil)
+	require.Nil(t, err)
+	require.True(t, status.Done)
+	require.Equal(t, int64(1), status.Migrated)
+	require.Equal(t, append([]string{legacyKey}, keys...), list(testBucketName))
+	require.Equal(t, 3, len(list(testBucketName, testBucketName+"d")))
+
+	require.Nil(t, om.DeleteByDeletedKey(keys[0]))
+	require.Equal(t, []string{legacyKey}, list(testBucketName))
+	index := Pack(DELETED_INDEX_PREFIX, testBucketName)
+	kvs, err := om.scan(index, prefixEnd(index), 10)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(kvs))
+
+	// then only the ones deleted since it was done
+	oldKey := legacyDeletedObjectKey(time.Now().Add(-2*legacyIndexMargin).UnixNano(), testBucketName, "dir#old")
+	newKey := legacyDeletedObjectKey(time.Now().UnixNano(), testBucketName, "dir#new")
+	require.Nil(t, om.set([]byte(oldKey), value))
+	require.Nil(t, om.set([]byte(newKey), value))
+	require.Equal(t, []string{legacyKey, newKey}, list(testBucketName))
+}
+
+func TestDeletedObjectsRange(t *testing.T) {
+	clearupObjects(t)
+
+	value, err := buildTestObjectInfoWithName("ranged")
+	require.Nil(t, err)
+	for i := 0; i < 5; i++ {
+		require.Nil(t, om.MarkObjectDeletedWithValue(testBucketName, fmt.Sprintf("ranged-%d", i), value))
+	}
+	list := func(opt IterOptions) []string {
+		iter, err := om.ListDeletedObjectsRangeByIter(opt)
+		require.Nil(t, err)
+		defer iter.Close()
+		var keys []string
+		for ; iter.Valid(); iter.Next() {
+			keys = append(keys, iter.Key())
+		}
+		return keys
+	}
+	keys := list(IterOptions{})
+	require.Equal(t, 5, len(keys))
+	newest := list(IterOptions{Reverse: true})
+	for i, k := range newest {
+		require.Equal(t, keys[len(keys)-1-i], k)
+	}
+	require.Equal(t, keys[1:3], list(IterOptions{Start: []byte(keys[1]), End: []byte(keys[3])}))
+
+	iter, err := om.ListDeletedObjectsRangeByIter(IterOptions{Reverse: true})
+	require.Nil(t, err)
+	defer iter.Close()
+	require.Nil(t, iter.Seek(keys[2]))
+	require.True(t, iter.Valid())
+	require.Equal(t, keys[2], iter.Key())
+	require.Nil(t, iter.Next())
+	require.Equal(t, keys[1], iter.Key())
+}
+
+func TestListObjectsPage(t *testing.T) {
+	clearupObjects(t)
+
+	names := []string{"a", "dir/x", "dir/y", "dir2/z", "e"}
+	for _, name := range names {
+		value, err := buildTestObjectInfoWithName(name)
+		require.Nil(t, err)
+		require.Nil(t, om.SaveObject(testBucketName, name, value))
+	}
+
+	var got []string
+	in := ListObjectsInput{MaxKeys: 2}
+	for {
+		page, err := om.ListObjectsPage(testBucketName, in)
+		require.Nil(t, err)
+		require.LessOrEqual(t, len(page.Names), 2)
+		got = append(got, page.Names...)
+		if !page.IsTruncated {
+			break
+		}
+		in.ContinuationToken = page.NextContinuationToken
+	}
+	require.Equal(t, names, got)
+
+	page, err := om.ListObjectsPage(testBucketName, ListObjectsInput{Delimiter: "/", MaxKeys: 2})
+	require.Nil(t, err)
+	require.Equal(t, []string{"a"}, page.Names)
+	require.Equal(t, []string{"dir/"}, page.CommonPrefixes)
+	require.True(t, page.IsTruncated)
+	page, err = om.ListObjectsPage(testBucketName, ListObjectsInput{Delimiter: "/",
+		ContinuationToken: page.NextContinuationToken})
+	require.Nil(t, err)
+	require.Equal(t, []string{"e"}, page.Names)
+	require.Equal(t, []string{"dir2/"}, page.CommonPrefixes)
+	require.False(t, page.IsTruncated)
+
+	page, err = om.ListObjectsPage(testBucketName, ListObjectsInput{Prefix: "dir", StartAfter: "dir/x"})
+	require.Nil(t, err)
+	require.Equal(t, []string{"dir/y", "dir2/z"}, page.Names)
+
+	_, err = om.ListObjectsPage(testBucketName, ListObjectsInput{ContinuationToken: "garbage"})
+	require.Equal(t, ErrInvalidToken, err)
+
+	for _, name := range names {
+		require.Nil(t, om.MarkObjectDeleted(testBucketName, name))
+	}
+	var keys []string
+	var deletedIn ListDeletedInput
+	deletedIn.MaxKeys = 3
+	for {
+		page, err := om.ListDeletedObjectsPage(deletedIn)
+		require.Nil(t, err)
+		keys = append(keys, page.Keys...)
+		if !page.IsTruncated {
+			break
+		}
+		deletedIn.ContinuationToken = page.NextContinuationToken
+	}
+	require.Equal(t, len(names), len(keys))
+}
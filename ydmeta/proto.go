@@ -0,0 +1,408 @@
+package ydmeta
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// ProtoCodec encodes values in the protobuf wire format, which is smaller
+// and much faster to decode than JSON. The messages are, in proto3:
+//
+//	message BucketInfo {
+//	  string name = 1;
+//	  string type = 2;
+//	  int64 create_time = 3;  // unix nanoseconds, absent when zero
+//	  bytes ext_fields = 4;   // JSON object
+//	}
+//
+//	message ObjectInfo {
+//	  string name = 1;
+//	  int64 size = 2;
+//	  string bucket = 3;
+//	  string etag = 4;
+//	  int64 mod_time = 5;
+//	  string content_type = 6;
+//	  string content_encoding = 7;
+//	  string type = 8;
+//	  bytes ext_fields = 9;
+//	  string upload_id = 10;
+//	  int64 part_size = 11;
+//	  int64 part_total = 12;
+//	  string version = 13;
+//	  repeated FileIdInfo fids = 14;  // ext_fields["fids"]
+//	}
+//
+//	message MultipartMetaV1 {
+//	  string version = 1;
+//	  string bucket = 2;
+//	  string object = 3;
+//	  string content_type = 4;
+//	  string content_encoding = 5;
+//	  int64 mod_time = 6;
+//	  bytes ext_fields = 7;
+//	  string upload_id = 8;
+//	  int64 initiate_time = 9;
+//	}
+//
+//	message MultipartPartMetaV1 {
+//	  int64 size = 1;
+//	  string etag = 2;
+//	  repeated FileIdInfo fid_infos = 3;
+//	  int64 mod_time = 4;
+//	}
+//
+//	message FileIdInfo {
+//	  string file_id = 1;
+//	  int64 offset = 2;
+//	  int64 file_size = 3;
+//	}
+//
+// Fields are only ever added, with new numbers, and unknown fields are
+// skipped, so that values stay readable across versions.
+var ProtoCodec Codec = protoCodec{}
+
+// protoMessage is implemented by the values ProtoCodec can encode.
+type protoMessage interface {
+	appendProto(b []byte) ([]byte, error)
+	unmarshalProto(b []byte) error
+}
+
+type protoCodec struct{}
+
+func (protoCodec) ID() byte {
+	return codecProto
+}
+
+func (protoCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(protoMessage)
+	if !ok {
+		return nil, fmt.Errorf("%T has no protobuf encoding", v)
+	}
+	return m.appendProto(nil)
+}
+
+func (protoCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(protoMessage)
+	if !ok {
+		return fmt.Errorf("%T has no protobuf encoding", v)
+	}
+	return m.unmarshalProto(data)
+}
+
+func appendProtoString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendProtoInt(b []byte, num protowire.Number, n int64) []byte {
+	if n == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(n))
+}
+
+func appendProtoTime(b []byte, num protowire.Number, t time.Time) []byte {
+	if t.IsZero() {
+		return b
+	}
+	return appendProtoInt(b, num, t.UnixNano())
+}
+
+func appendProtoExt(b []byte, num protowire.Number, ext map[string]interface{}) ([]byte, error) {
+	if len(ext) == 0 {
+		return b, nil
+	}
+	val, err := json.Marshal(ext)
+	if err != nil {
+		return nil, err
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, val), nil
+}
+
+// protoField is a varint or length delimited field of a message.
+type protoField struct {
+	num protowire.Number
+	typ protowire.Type
+	n   uint64
+	b   []byte
+}
+
+func (f protoField) string() string {
+	if f.typ != protowire.BytesType {
+		return ""
+	}
+	return string(f.b)
+}
+
+func (f protoField) int() int64 {
+	if f.typ != protowire.VarintType {
+		return 0
+	}
+	return int64(f.n)
+}
+
+func (f protoField) time() time.Time {
+	if f.typ != protowire.VarintType {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(f.n))
+}
+
+func (f protoField) ext() (map[string]interface{}, error) {
+	if f.typ != protowire.BytesType {
+		return nil, nil
+	}
+	var ext map[string]interface{}
+	if err := json.Unmarshal(f.b, &ext); err != nil {
+		return nil, err
+	}
+	return ext, nil
+}
+
+// walkProto calls field for every varint and length delimited field of the
+// message in b, and skips the others.
+func walkProto(b []byte, field func(f protoField) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		f := protoField{num: num, typ: typ}
+		switch typ {
+		case protowire.VarintType:
+			f.n, n = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			f.b, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if typ != protowire.VarintType && typ != protowire.BytesType {
+			continue
+		}
+		if err := field(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *BucketInfo) appendProto(buf []byte) ([]byte, error) {
+	buf = appendProtoString(buf, 1, b.Name)
+	buf = appendProtoString(buf, 2, b.Type)
+	buf = appendProtoTime(buf, 3, b.CreateTime)
+	return appendProtoExt(buf, 4, b.ExtFields)
+}
+
+func (b *BucketInfo) unmarshalProto(buf []byte) error {
+	*b = BucketInfo{}
+	return walkProto(buf, func(f protoField) (err error) {
+		switch f.num {
+		case 1:
+			b.Name = f.string()
+		case 2:
+			b.Type = f.string()
+		case 3:
+			b.CreateTime = f.time()
+		case 4:
+			b.ExtFields, err = f.ext()
+		}
+		return err
+	})
+}
+
+func (i *ObjectInfo) appendProto(b []byte) ([]byte, error) {
+	b = appendProtoString(b, 1, i.Name)
+	b = appendProtoInt(b, 2, i.Size)
+	b = appendProtoString(b, 3, i.Bucket)
+	b = appendProtoString(b, 4, i.Etag)
+	b = appendProtoTime(b, 5, i.ModTime)
+	b = appendProtoString(b, 6, i.ContentType)
+	b = appendProtoString(b, 7, i.ContentEncoding)
+	b = appendProtoString(b, 8, i.Type)
+	fids, err := i.Fids()
+	if err != nil {
+		return nil, err
+	}
+	ext := i.ExtFields
+	if fids != nil {
+		ext = make(map[string]interface{}, len(i.ExtFields))
+		for k, v := range i.ExtFields {
+			if k != ExtFids {
+				ext[k] = v
+			}
+		}
+	}
+	if b, err = appendProtoExt(b, 9, ext); err != nil {
+		return nil, err
+	}
+	b = appendProtoString(b, 10, i.UploadID)
+	b = appendProtoInt(b, 11, i.PartSize)
+	b = appendProtoInt(b, 12, i.PartTotal)
+	b = appendProtoString(b, 13, i.Version)
+	return appendProtoFids(b, 14, fids), nil
+}
+
+func (i *ObjectInfo) unmarshalProto(b []byte) error {
+	*i = ObjectInfo{}
+	var fids []FileIdInfo
+	err := walkProto(b, func(f protoField) (err error) {
+		switch f.num {
+		case 1:
+			i.Name = f.string()
+		case 2:
+			i.Size = f.int()
+		case 3:
+			i.Bucket = f.string()
+		case 4:
+			i.Etag = f.string()
+		case 5:
+			i.ModTime = f.time()
+		case 6:
+			i.ContentType = f.string()
+		case 7:
+			i.ContentEncoding = f.string()
+		case 8:
+			i.Type = f.string()
+		case 9:
+			i.ExtFields, err = f.ext()
+		case 10:
+			i.UploadID = f.string()
+		case 11:
+			i.PartSize = f.int()
+		case 12:
+			i.PartTotal = f.int()
+		case 13:
+			i.Version = f.string()
+		case 14:
+			fids, err = appendFid(fids, f)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if fids != nil {
+		i.SetFids(fids)
+	}
+	return nil
+}
+
+func (m *MultipartMetaV1) appendProto(b []byte) ([]byte, error) {
+	b = appendProtoString(b, 1, m.Version)
+	b = appendProtoString(b, 2, m.Bucket)
+	b = appendProtoString(b, 3, m.Object)
+	b = appendProtoString(b, 4, m.ContentType)
+	b = appendProtoString(b, 5, m.ContentEncoding)
+	b = appendProtoTime(b, 6, m.ModTime)
+	b, err := appendProtoExt(b, 7, m.ExtFields)
+	if err != nil {
+		return nil, err
+	}
+	b = appendProtoString(b, 8, m.UploadID)
+	return appendProtoTime(b, 9, m.InitiateTime), nil
+}
+
+func (m *MultipartMetaV1) unmarshalProto(b []byte) error {
+	*m = MultipartMetaV1{}
+	return walkProto(b, func(f protoField) (err error) {
+		switch f.num {
+		case 1:
+			m.Version = f.string()
+		case 2:
+			m.Bucket = f.string()
+		case 3:
+			m.Object = f.string()
+		case 4:
+			m.ContentType = f.string()
+		case 5:
+			m.ContentEncoding = f.string()
+		case 6:
+			m.ModTime = f.time()
+		case 7:
+			m.ExtFields, err = f.ext()
+		case 8:
+			m.UploadID = f.string()
+		case 9:
+			m.InitiateTime = f.time()
+		}
+		return err
+	})
+}
+
+func (p *MultipartPartMetaV1) appendProto(b []byte) ([]byte, error) {
+	b = appendProtoInt(b, 1, p.Size)
+	b = appendProtoString(b, 2, p.Etag)
+	b = appendProtoFids(b, 3, p.FidInfos)
+	return appendProtoTime(b, 4, p.ModTime), nil
+}
+
+func (p *MultipartPartMetaV1) unmarshalProto(b []byte) error {
+	*p = MultipartPartMetaV1{}
+	return walkProto(b, func(f protoField) (err error) {
+		switch f.num {
+		case 1:
+			p.Size = f.int()
+		case 2:
+			p.Etag = f.string()
+		case 3:
+			p.FidInfos, err = appendFid(p.FidInfos, f)
+		case 4:
+			p.ModTime = f.time()
+		}
+		return err
+	})
+}
+
+func appendProtoFids(b []byte, num protowire.Number, fids []FileIdInfo) []byte {
+	for _, fid := range fids {
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendBytes(b, fid.appendProto(nil))
+	}
+	return b
+}
+
+// appendFid appends the fid in f to fids.
+func appendFid(fids []FileIdInfo, f protoField) ([]FileIdInfo, error) {
+	if f.typ != protowire.BytesType {
+		return fids, nil
+	}
+	var fid FileIdInfo
+	if err := fid.unmarshalProto(f.b); err != nil {
+		return nil, err
+	}
+	return append(fids, fid), nil
+}
+
+func (i *FileIdInfo) appendProto(b []byte) []byte {
+	b = appendProtoString(b, 1, i.FileId)
+	b = appendProtoInt(b, 2, i.Offset)
+	return appendProtoInt(b, 3, i.FileSize)
+}
+
+func (i *FileIdInfo) unmarshalProto(b []byte) error {
+	*i = FileIdInfo{}
+	return walkProto(b, func(f protoField) error {
+		switch f.num {
+		case 1:
+			i.FileId = f.string()
+		case 2:
+			i.Offset = f.int()
+		case 3:
+			i.FileSize = f.int()
+		}
+		return nil
+	})
+}
@@ -0,0 +1,187 @@
+package ydmeta
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	tikverr "github.com/tikv/client-go/v2/error"
+	"github.com/tikv/client-go/v2/txnkv"
+	"github.com/tikv/client-go/v2/txnkv/transaction"
+)
+
+// QuarantineEntry is the value of a quarantine key: a record the cleaner
+// took out of its space instead of deleting it, with the reason why. It is
+// either released, which puts the record back, or purged.
+type QuarantineEntry struct {
+	Key    string    `json:"key"`
+	Value  []byte    `json:"value"`
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+}
+
+func getQuarantineEntry(tx *transaction.KVTxn, key []byte) (*QuarantineEntry, error) {
+	val, err := tx.Get(context.TODO(), key)
+	if err != nil {
+		if errors.Is(err, tikverr.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return decodeQuarantineEntry(val)
+}
+
+func decodeQuarantineEntry(val []byte) (*QuarantineEntry, error) {
+	entry := &QuarantineEntry{}
+	if err := json.Unmarshal(val, entry); err != nil {
+		return nil, fmt.Errorf("parse quarantine entry error: %s", err.Error())
+	}
+	return entry, nil
+}
+
+// QuarantineKeys moves the records at keys to the quarantine, with reason,
+// while l is still held. Keys that no longer exist are skipped.
+func (m *MetaManager) QuarantineKeys(l *Lease, reason string, keys ...string) error {
+	tx, err := m.client.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = l.check(tx, false); err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, key := range keys {
+		val, err := tx.Get(context.TODO(), []byte(key))
+		if err != nil {
+			if errors.Is(err, tikverr.ErrNotExist) {
+				continue
+			}
+			return err
+		}
+		entry, err := json.Marshal(&QuarantineEntry{Key: key, Value: val, Reason: reason, Time: now})
+		if err != nil {
+			return err
+		}
+		if err = tx.Set([]byte(genQuarantineKey(now.UnixNano(), key)), entry); err != nil {
+			return err
+		}
+		if err = tx.Delete([]byte(key)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(context.Background())
+}
+
+// ReleaseQuarantined puts the records quarantined under qkeys back while l
+// is still held, and returns how many it released. An entry whose original
+// key has been written again since is left in the quarantine.
+func (m *MetaManager) ReleaseQuarantined(l *Lease, qkeys ...string) (int, error) {
+	tx, err := m.client.Begin()
+	if err != nil {
+		return 0, err
+	}
+	if _, err = l.check(tx, false); err != nil {
+		return 0, err
+	}
+	released := 0
+	for _, qkey := range qkeys {
+		entry, err := getQuarantineEntry(tx, []byte(qkey))
+		if err != nil {
+			return 0, err
+		}
+		if entry == nil {
+			continue
+		}
+		_, err = tx.Get(context.TODO(), []byte(entry.Key))
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, tikverr.ErrNotExist) {
+			return 0, err
+		}
+		if err = tx.Set([]byte(entry.Key), entry.Value); err != nil {
+			return 0, err
+		}
+		if err = tx.Delete([]byte(qkey)); err != nil {
+			return 0, err
+		}
+		released++
+	}
+	if err = tx.Commit(context.Background()); err != nil {
+		return 0, err
+	}
+	return released, nil
+}
+
+// DeleteQuarantineKeys deletes quarantine keys while l is still held.
+func (m *MetaManager) DeleteQuarantineKeys(l *Lease, qkeys ...string) error {
+	raw := make([][]byte, 0, len(qkeys))
+	for _, key := range qkeys {
+		raw = append(raw, []byte(key))
+	}
+	return m.delsFenced(l, raw...)
+}
+
+// ListQuarantineByIter iterates the quarantine, oldest entries first.
+func (m *MetaManager) ListQuarantineByIter() (*QuarantineIter, error) {
+	return newQuarantineIter(m.client, Pack(QUARANTINE_PREFIX))
+}
+
+type QuarantineIter struct {
+	interClose func()
+	interValid func() bool
+	interNext  func() error
+	interKey   func() []byte
+	interValue func() []byte
+}
+
+func newQuarantineIter(tc *txnkv.Client, prefix []byte) (*QuarantineIter, error) {
+	tx, err := tc.Begin()
+	if err != nil {
+		return nil, err
+	}
+	it, err := tx.Iter(prefix, prefixEnd(prefix))
+	if err != nil {
+		return nil, err
+	}
+	return &QuarantineIter{
+		interClose: it.Close,
+		interValid: it.Valid,
+		interNext:  it.Next,
+		interKey:   it.Key,
+		interValue: it.Value,
+	}, nil
+}
+
+func (i *QuarantineIter) Next() error {
+	return i.interNext()
+}
+
+// Value returns the entry, or nil when it cannot be decoded. Cursor reports
+// the error instead.
+func (i *QuarantineIter) Value() *QuarantineEntry {
+	entry, _ := i.decode()
+	return entry
+}
+
+func (i *QuarantineIter) decode() (*QuarantineEntry, error) {
+	entry, err := decodeQuarantineEntry(i.interValue())
+	if err != nil {
+		return nil, &DecodeError{Key: i.Key(), Err: err}
+	}
+	return entry, nil
+}
+
+func (i *QuarantineIter) Key() string {
+	return string(i.interKey())
+}
+
+func (i *QuarantineIter) Valid() bool {
+	return i.interValid()
+}
+
+func (i *QuarantineIter) Close() {
+	i.interClose()
+}
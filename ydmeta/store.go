@@ -0,0 +1,90 @@
+package ydmeta
+
+import (
+	"sync"
+
+	"github.com/tikv/client-go/v2/txnkv"
+)
+
+// Store owns a single TiKV client and hands out the metadata managers that
+// share it. It is reference counted: every Retain must be matched by a
+// Close, and the client is closed by the last one. Managers handed out by a
+// Store borrow its client, so closing them does nothing.
+type Store struct {
+	client *txnkv.Client
+	codec  Codec
+
+	mu   sync.Mutex
+	refs int
+}
+
+// NewStore connects to the PD endpoints in addr, comma separated.
+func NewStore(addr string) (*Store, error) {
+	return NewStoreWithSecurity(addr, Security{})
+}
+
+// NewStoreWithSecurity connects to the PD endpoints in addr over TLS.
+func NewStoreWithSecurity(addr string, sec Security) (*Store, error) {
+	client, err := newTikvClientWithSecurity(addr, sec)
+	if err != nil {
+		return nil, err
+	}
+	return NewStoreByClient(client), nil
+}
+
+// NewStoreByClient takes ownership of client.
+func NewStoreByClient(client *txnkv.Client) *Store {
+	return &Store{client: client, refs: 1}
+}
+
+// Retain adds a reference to the store for another owner.
+func (s *Store) Retain() *Store {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.refs <= 0 {
+		panic("ydmeta: Retain on a closed Store")
+	}
+	s.refs++
+	return s
+}
+
+// Close drops a reference and closes the client with the last one.
+func (s *Store) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.refs <= 0 {
+		return
+	}
+	s.refs--
+	if s.refs == 0 {
+		s.client.Close()
+	}
+}
+
+// SetCodec sets the codec of the values written by managers handed out
+// afterwards.
+func (s *Store) SetCodec(c Codec) {
+	s.codec = c
+}
+
+func (s *Store) metaManager() MetaManager {
+	return MetaManager{client: s.client, borrowed: true, codec: s.codec}
+}
+
+func (s *Store) Buckets() *BucketMetaManager {
+	return &BucketMetaManager{s.metaManager()}
+}
+
+func (s *Store) Objects() *ObjectMetaManager {
+	return &ObjectMetaManager{s.metaManager()}
+}
+
+// MultipartMetaManager exposes the multipart operations of
+// ObjectMetaManager.
+type MultipartMetaManager struct {
+	*ObjectMetaManager
+}
+
+func (s *Store) Multiparts() *MultipartMetaManager {
+	return &MultipartMetaManager{s.Objects()}
+}
@@ -0,0 +1,65 @@
+package ydmeta
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreSharesClient(t *testing.T) {
+	metaAddr := os.Getenv("META_SERVER_ADDRESS")
+	if len(metaAddr) == 0 {
+		metaAddr = "localhost:2379"
+	}
+	store, err := NewStore(metaAddr)
+	require.Nil(t, err)
+
+	buckets, objects, multiparts := store.Buckets(), store.Objects(), store.Multiparts()
+	require.True(t, buckets.client == objects.client)
+	require.True(t, objects.client == multiparts.client)
+
+	// closing a borrowed manager keeps the client usable
+	buckets.Close()
+	info := &BucketInfo{Name: "store-test", Type: "seaweedfs", CreateTime: time.Now()}
+	require.Nil(t, buckets.CreateBucket("store-test", info))
+	got, err := store.Buckets().GetBucketInfo("store-test")
+	require.Nil(t, err)
+	require.Equal(t, "store-test", got.Name)
+	require.Nil(t, buckets.DeleteBucket("store-test"))
+
+	// the client survives until the last reference is closed
+	store.Retain()
+	store.Close()
+	require.Equal(t, 1, store.refs)
+	_, _, err = objects.ListObjects("store-test", "", 1)
+	require.Nil(t, err)
+	store.Close()
+	require.Equal(t, 0, store.refs)
+	store.Close()
+	require.Equal(t, 0, store.refs)
+	require.Panics(t, func() { store.Retain() })
+}
+
+func TestStoreCodec(t *testing.T) {
+	metaAddr := os.Getenv("META_SERVER_ADDRESS")
+	if len(metaAddr) == 0 {
+		metaAddr = "localhost:2379"
+	}
+	store, err := NewStore(metaAddr)
+	require.Nil(t, err)
+	defer store.Close()
+	store.SetCodec(ProtoCodec)
+
+	buckets := store.Buckets()
+	info := &BucketInfo{Name: "codec-test", Type: "seaweedfs", CreateTime: time.Now()}
+	require.Nil(t, buckets.CreateBucket("codec-test", info))
+	defer buckets.DeleteBucket("codec-test")
+	val, err := buckets.get([]byte(GenBucketKey("codec-test")))
+	require.Nil(t, err)
+	require.Equal(t, []byte{envelopeV1, codecProto}, val[:2])
+	got, err := buckets.GetBucketInfo("codec-test")
+	require.Nil(t, err)
+	require.Equal(t, "codec-test", got.Name)
+}
@@ -0,0 +1,123 @@
+package ydmeta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Keys are tuples of strings and integers packed so that the byte order of
+// packed tuples is the element-wise order of the tuples, and a packed tuple
+// is a prefix of every tuple that extends it.
+//
+// A string is tupleString, its bytes with 0x00 escaped as 0x00 0xff, and a
+// 0x00 terminator. An integer is tupleInt and its eight big endian bytes
+// with the sign bit flipped.
+const (
+	tupleString byte = 0x02
+	tupleInt    byte = 0x15
+
+	tupleEscape byte = 0xff
+)
+
+var ErrInvalidTuple = errors.New("invalid tuple")
+
+// Pack packs elements, which must be strings, ints or int64s.
+func Pack(elements ...interface{}) []byte {
+	var b []byte
+	for _, e := range elements {
+		switch v := e.(type) {
+		case string:
+			b = appendTupleString(b, v)
+		case int:
+			b = appendTupleInt(b, int64(v))
+		case int64:
+			b = appendTupleInt(b, v)
+		default:
+			panic(fmt.Sprintf("ydmeta: cannot pack %T", e))
+		}
+	}
+	return b
+}
+
+// PackStringPrefix packs elements followed by an unterminated prefix string
+// element: every tuple of elements followed by a string that starts with
+// prefix starts with the result.
+func PackStringPrefix(prefix string, elements ...interface{}) []byte {
+	b := appendTupleString(Pack(elements...), prefix)
+	return b[:len(b)-1]
+}
+
+func appendTupleString(b []byte, s string) []byte {
+	b = append(b, tupleString)
+	for i := 0; i < len(s); i++ {
+		b = append(b, s[i])
+		if s[i] == 0x00 {
+			b = append(b, tupleEscape)
+		}
+	}
+	return append(b, 0x00)
+}
+
+func appendTupleInt(b []byte, n int64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(n)^(1<<63))
+	return append(append(b, tupleInt), buf[:]...)
+}
+
+// Unpack returns the elements of a packed tuple, as strings and int64s.
+func Unpack(b []byte) ([]interface{}, error) {
+	var elements []interface{}
+	for len(b) > 0 {
+		switch b[0] {
+		case tupleString:
+			var s []byte
+			i := 1
+			for ; i < len(b); i++ {
+				if b[i] != 0x00 {
+					s = append(s, b[i])
+					continue
+				}
+				if i+1 < len(b) && b[i+1] == tupleEscape {
+					s = append(s, 0x00)
+					i++
+					continue
+				}
+				break
+			}
+			if i == len(b) {
+				return nil, fmt.Errorf("%w: unterminated string", ErrInvalidTuple)
+			}
+			elements = append(elements, string(s))
+			b = b[i+1:]
+		case tupleInt:
+			if len(b) < 9 {
+				return nil, fmt.Errorf("%w: short integer", ErrInvalidTuple)
+			}
+			elements = append(elements, int64(binary.BigEndian.Uint64(b[1:9])^(1<<63)))
+			b = b[9:]
+		default:
+			return nil, fmt.Errorf("%w: unknown type 0x%02x", ErrInvalidTuple, b[0])
+		}
+	}
+	return elements, nil
+}
+
+// isTupleKey tells keys in the tuple encoding from the legacy '#' joined
+// keys, which all start with "YDS3_".
+func isTupleKey(key []byte) bool {
+	return len(key) > 0 && key[0] == tupleString
+}
+
+// prefixEnd returns the smallest key after every key that starts with
+// prefix, or nil when there is none.
+func prefixEnd(prefix []byte) []byte {
+	end := bytes.TrimRight(prefix, "\xff")
+	if len(end) == 0 {
+		return nil
+	}
+	end = append([]byte(nil), end...)
+	end[len(end)-1]++
+	return end
+}
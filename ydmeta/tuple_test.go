@@ -0,0 +1,134 @@
+package ydmeta
+
+import (
+	"bytes"
+	"testing"
+	"testing/quick"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTupleRoundTrip(t *testing.T) {
+	check := func(s1 string, n int64, s2 string) bool {
+		e, err := Unpack(Pack(s1, n, s2))
+		return err == nil && len(e) == 3 && e[0] == s1 && e[1] == n && e[2] == s2
+	}
+	require.Nil(t, quick.Check(check, nil))
+
+	for _, b := range [][]byte{{tupleString, 'a'}, {tupleInt, 1, 2}, {0x01}} {
+		_, err := Unpack(b)
+		require.ErrorIs(t, err, ErrInvalidTuple)
+	}
+}
+
+func TestTupleOrder(t *testing.T) {
+	strOrder := func(a, b string) bool {
+		return (a < b) == (bytes.Compare(Pack(a, "x"), Pack(b, "x")) < 0)
+	}
+	require.Nil(t, quick.Check(strOrder, nil))
+	intOrder := func(a, b int64) bool {
+		return (a < b) == (bytes.Compare(Pack(a), Pack(b)) < 0)
+	}
+	require.Nil(t, quick.Check(intOrder, nil))
+
+	// An element that is a prefix of another sorts first, whatever follows.
+	require.True(t, bytes.Compare(Pack("a", "\xff"), Pack("a\x00", "")) < 0)
+	require.True(t, bytes.Compare(Pack("a", "\xff"), Pack("a#b")) < 0)
+}
+
+func TestPackStringPrefix(t *testing.T) {
+	prefix := PackStringPrefix("di", OBJECT_PREFIX, "bucket")
+	require.True(t, bytes.HasPrefix(Pack(OBJECT_PREFIX, "bucket", "dir/a"), prefix))
+	require.True(t, bytes.HasPrefix(Pack(OBJECT_PREFIX, "bucket", "di"), prefix))
+	require.False(t, bytes.HasPrefix(Pack(OBJECT_PREFIX, "bucket2", "dir/a"), prefix))
+	require.False(t, bytes.HasPrefix(Pack(OBJECT_PREFIX, "bucket", "d"), prefix))
+
+	// Objects of bucket "a" do not include those of bucket "a#b".
+	require.False(t, bytes.HasPrefix([]byte(GenObjectKey("a#b", "c")), []byte(GenBucketObjectKey("a"))))
+}
+
+func TestPrefixEnd(t *testing.T) {
+	require.Equal(t, []byte("ab"), prefixEnd([]byte("aa")))
+	require.Equal(t, []byte("b"), prefixEnd([]byte("a\xff\xff")))
+	require.Nil(t, prefixEnd([]byte("\xff")))
+}
+
+func TestLegacyToTupleKey(t *testing.T) {
+	for legacy, key := range map[string]string{
+		"YDS3_BUCKET#b":                  GenBucketKey("b"),
+		"YDS3_OBJECT#b#dir#obj":          GenObjectKey("b", "dir#obj"),
+		"YDS3_DELETED_OBJECT#42#b#o":     string(Pack(DELETED_OBJECT_PREFIX, 42, "b", "o")),
+		"YDS3_MULTIPART#b#up#load":       GenMultipartKey("b", "up#load"),
+		"YDS3_MULTIPART#b#up#load#00003": PartKey{Bucket: "b", UploadID: "up#load", PartNumber: 3}.String(),
+		"YDS3_MULTIPART#b#up#123456":     PartKey{Bucket: "b", UploadID: "up", PartNumber: 123456}.String(),
+	} {
+		got, ok := legacyToTupleKey([]byte(legacy))
+		require.True(t, ok, legacy)
+		require.Equal(t, key, string(got), legacy)
+	}
+	for _, key := range []string{"YDS3_LEASE#cleaner", "YDS3_OBJECT#b", "YDS3_DELETED_OBJECT#x#b#o", GenBucketKey("b")} {
+		_, ok := legacyToTupleKey([]byte(key))
+		require.False(t, ok, key)
+	}
+}
+
+// sliceIter is a kvIter over sorted keys, whose values are the keys.
+type sliceIter struct {
+	keys []string
+}
+
+func (s *sliceIter) Valid() bool   { return len(s.keys) > 0 }
+func (s *sliceIter) Key() []byte   { return []byte(s.keys[0]) }
+func (s *sliceIter) Value() []byte { return []byte(s.keys[0]) }
+func (s *sliceIter) Next() error   { s.keys = s.keys[1:]; return nil }
+func (s *sliceIter) Close()        {}
+
+func TestMergedIter(t *testing.T) {
+	packed := &sliceIter{keys: []string{
+		GenMultipartKey("b", "u1"),
+		PartKey{Bucket: "b", UploadID: "u1", PartNumber: 2}.String(),
+		GenMultipartKey("b", "u2"),
+	}}
+	legacy := &sliceIter{keys: []string{
+		"YDS3_MULTIPART#b#u1#00001",
+		"YDS3_MULTIPART#b#u1#00002",
+		"YDS3_MULTIPART#b#u2#00001",
+	}}
+	it := newMergedIter(packed, legacy)
+	var got []string
+	for it.Valid() {
+		got = append(got, string(it.Key()))
+		require.Nil(t, it.Next())
+	}
+	require.Equal(t, []string{
+		GenMultipartKey("b", "u1"),
+		"YDS3_MULTIPART#b#u1#00001",
+		PartKey{Bucket: "b", UploadID: "u1", PartNumber: 2}.String(),
+		GenMultipartKey("b", "u2"),
+		"YDS3_MULTIPART#b#u2#00001",
+	}, got)
+}
+
+func TestChainIter(t *testing.T) {
+	ranges := [][]string{{"a1", "a2"}, nil, {"c1"}, nil}
+	var opened int
+	var open []func() (kvIter, error)
+	for _, keys := range ranges {
+		keys := keys
+		open = append(open, func() (kvIter, error) {
+			opened++
+			return &sliceIter{keys: keys}, nil
+		})
+	}
+	it, err := newChainIter(open...)
+	require.Nil(t, err)
+	require.Equal(t, 1, opened)
+	var got []string
+	for it.Valid() {
+		got = append(got, string(it.Key()))
+		require.Nil(t, it.Next())
+	}
+	it.Close()
+	require.Equal(t, []string{"a1", "a2", "c1"}, got)
+	require.Equal(t, 4, opened)
+}
@@ -0,0 +1,183 @@
+package ydmeta
+
+import (
+	"context"
+	"errors"
+
+	tikverr "github.com/tikv/client-go/v2/error"
+	"github.com/tikv/client-go/v2/txnkv/transaction"
+)
+
+// Upload records are keyed by upload ID, while uploads are listed by object.
+// The upload index lists them by bucket, object and upload ID, so that a
+// page of uploads is read from its markers on. An index entry holds the
+// packed key of its record; it is written and deleted together with the
+// record by this package, and entries of records written by older versions
+// are added by the upload-index migration. An entry may outlive its record
+// when an older version deletes it, so readers skip entries without a
+// record, or whose record is of another object.
+
+// UploadIndexMigration is the migration that indexes the upload records
+// written before the index was maintained.
+const UploadIndexMigration = "upload-index"
+
+// setUploadIndex indexes the record of an upload of object.
+func setUploadIndex(tx *transaction.KVTxn, bucket string, object string, uploadID string) error {
+	return tx.Set([]byte(genUploadIndexKey(bucket, object, uploadID)), []byte(GenMultipartKey(bucket, uploadID)))
+}
+
+// deleteUploadIndex removes the index entry of an upload of object.
+func deleteUploadIndex(tx *transaction.KVTxn, bucket string, object string, uploadID string) error {
+	return tx.Delete([]byte(genUploadIndexKey(bucket, object, uploadID)))
+}
+
+// deleteUploadIndexOf removes the index entry of the upload record value,
+// which may not decode.
+func deleteUploadIndexOf(tx *transaction.KVTxn, bucket string, uploadID string, value []byte) error {
+	meta, err := decodeUpload(value)
+	if err != nil {
+		return nil
+	}
+	return deleteUploadIndex(tx, bucket, meta.Object, uploadID)
+}
+
+// saveUpload is save for upload records written by name, which also keeps
+// their index entry. A value that does not decode is saved without one.
+func (o *ObjectMetaManager) saveUpload(bucket string, uploadID string, value []byte) error {
+	tx, err := o.client.Begin()
+	if err != nil {
+		return err
+	}
+	key, legacyKey := GenMultipartKey(bucket, uploadID), legacyMultipartKey(bucket, uploadID)
+	old, _, err := getDual(tx, key, legacyKey)
+	if err != nil {
+		if !errors.Is(err, tikverr.ErrNotExist) {
+			return err
+		}
+	} else {
+		if err = tx.Set([]byte(genDeletedMultipartKey(bucket, uploadID)), old); err != nil {
+			return err
+		}
+		if err = deleteUploadIndexOf(tx, bucket, uploadID, old); err != nil {
+			return err
+		}
+	}
+	if meta, err := decodeUpload(value); err == nil {
+		if err = setUploadIndex(tx, bucket, meta.Object, uploadID); err != nil {
+			return err
+		}
+	}
+	if err = setDual(tx, key, legacyKey, value); err != nil {
+		return err
+	}
+	return tx.Commit(context.Background())
+}
+
+// listIndexedUploads returns up to limit uploads of bucket that follow the
+// markers, reading the index from the markers on, and whether more follow.
+func listIndexedUploads(tx *transaction.KVTxn, bucket string, keyMarker string, uploadIDMarker string,
+	limit int) ([]MultipartUploadInfo, bool, error) {
+	prefix := []byte(genBucketUploadIndexKey(bucket))
+	start := prefix
+	if keyMarker != "" {
+		start = []byte(genUploadIndexKey(bucket, keyMarker, uploadIDMarker))
+	}
+	it, err := tx.Iter(start, prefixEnd(prefix))
+	if err != nil {
+		return nil, false, err
+	}
+	defer it.Close()
+
+	// one more than limit tells whether the listing is truncated
+	var uploads []MultipartUploadInfo
+	for len(uploads) <= limit {
+		var refs []MultipartUploadInfo
+		for it.Valid() && len(refs) <= limit-len(uploads) {
+			_, object, uploadID, ok := parseUploadIndexKey(it.Key())
+			if ok && afterUploadMarkers(object, uploadID, keyMarker, uploadIDMarker) {
+				refs = append(refs, MultipartUploadInfo{Bucket: bucket, Object: object, UploadID: uploadID})
+			}
+			if err = it.Next(); err != nil {
+				return nil, false, err
+			}
+		}
+		if len(refs) == 0 {
+			break
+		}
+		found, err := resolveUploads(tx, refs)
+		if err != nil {
+			return nil, false, err
+		}
+		uploads = append(uploads, found...)
+	}
+	if len(uploads) > limit {
+		return uploads[:limit], true, nil
+	}
+	return uploads, false, nil
+}
+
+// afterUploadMarkers tells whether the upload follows the markers of
+// ListMultipartUploads.
+func afterUploadMarkers(object string, uploadID string, keyMarker string, uploadIDMarker string) bool {
+	if keyMarker == "" || object > keyMarker {
+		return true
+	}
+	return object == keyMarker && uploadIDMarker != "" && uploadID > uploadIDMarker
+}
+
+// resolveUploads reads the records and the parts of the uploads refs points
+// to, dropping the ones without a record of their object.
+func resolveUploads(tx *transaction.KVTxn, refs []MultipartUploadInfo) ([]MultipartUploadInfo, error) {
+	keys := make([][]byte, 0, 2*len(refs))
+	for _, r := range refs {
+		keys = append(keys, []byte(GenMultipartKey(r.Bucket, r.UploadID)),
+			[]byte(legacyMultipartKey(r.Bucket, r.UploadID)))
+	}
+	vals, err := tx.BatchGet(context.TODO(), keys)
+	if err != nil {
+		return nil, err
+	}
+	uploads := make([]MultipartUploadInfo, 0, len(refs))
+	for i, r := range refs {
+		val, ok := vals[string(keys[2*i])]
+		if !ok {
+			val, ok = vals[string(keys[2*i+1])]
+		}
+		if !ok {
+			continue
+		}
+		meta, err := decodeUpload(val)
+		if err != nil || meta.Object != r.Object {
+			continue
+		}
+		u := newUploadInfo(r.Bucket, r.UploadID, meta)
+		if err = addUploadParts(tx, &u); err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, u)
+	}
+	return uploads, nil
+}
+
+// addUploadParts counts the parts of u.
+func addUploadParts(tx *transaction.KVTxn, u *MultipartUploadInfo) error {
+	it, err := iterDual(tx, []byte(GenMultipartKey(u.Bucket, u.UploadID)), nil,
+		[]byte(legacyMultipartKey(u.Bucket, u.UploadID)+KEY_SEPARATOR), nil)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	for it.Valid() {
+		// legacy keys of uploads whose ID extends ours share the prefix
+		if pk, ok := ParsePartKey(string(it.Key())); ok && pk.UploadID == u.UploadID {
+			part := &MultipartPartMetaV1{}
+			if DecodeValue(it.Value(), part) == nil {
+				u.addPart(part)
+			}
+		}
+		if err = it.Next(); err != nil {
+			return err
+		}
+	}
+	return nil
+}